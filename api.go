@@ -0,0 +1,266 @@
+package reliablesocket
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reliablesocket/proto/webpubsub"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// registerAPI adds the management REST API of Azure Web PubSub, so tools
+// written against the service work with this server. Requests carry an
+// HS256 bearer token signed with Server.AccessKey whose audience is the
+// request URL, which tells them from client access tokens signed with the
+// same key.
+func (s *Server) registerAPI() {
+	s.mux.HandleFunc("POST /api/hubs/{hub}/:send", s.api(s.sendToAll))
+	s.mux.HandleFunc("POST /api/hubs/{hub}/:generateToken", s.api(s.generateToken))
+	s.mux.HandleFunc("POST /api/hubs/{hub}/groups/{group}/:send", s.api(s.sendToGroup))
+	s.mux.HandleFunc("POST /api/hubs/{hub}/users/{user}/:send", s.api(s.sendToUser))
+	s.mux.HandleFunc("POST /api/hubs/{hub}/connections/{connectionId}/:send", s.api(s.sendToConnection))
+
+	s.mux.HandleFunc("HEAD /api/hubs/{hub}/groups/{group}", s.api(s.groupExists))
+	s.mux.HandleFunc("HEAD /api/hubs/{hub}/users/{user}", s.api(s.userExists))
+	s.mux.HandleFunc("HEAD /api/hubs/{hub}/connections/{connectionId}", s.api(s.connectionExists))
+
+	s.mux.HandleFunc("PUT /api/hubs/{hub}/groups/{group}/connections/{connectionId}", s.api(s.addConnectionToGroup))
+	s.mux.HandleFunc("DELETE /api/hubs/{hub}/groups/{group}/connections/{connectionId}", s.api(s.removeConnectionFromGroup))
+	s.mux.HandleFunc("DELETE /api/hubs/{hub}/connections/{connectionId}/groups", s.api(s.removeConnectionFromAllGroups))
+	s.mux.HandleFunc("PUT /api/hubs/{hub}/users/{user}/groups/{group}", s.api(s.addUserToGroup))
+	s.mux.HandleFunc("DELETE /api/hubs/{hub}/users/{user}/groups/{group}", s.api(s.removeUserFromGroup))
+	s.mux.HandleFunc("DELETE /api/hubs/{hub}/users/{user}/groups", s.api(s.removeUserFromAllGroups))
+
+	s.mux.HandleFunc("DELETE /api/hubs/{hub}/connections/{connectionId}", s.api(s.closeConnection))
+	s.mux.HandleFunc("POST /api/hubs/{hub}/users/{user}/:closeConnections", s.api(s.closeUserConnections))
+}
+
+// api authenticates a management request before passing it the hub.
+func (s *Server) api(fn func(w http.ResponseWriter, r *http.Request, hub *Hub)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AccessKey == "" {
+			http.Error(w, "management API is disabled", http.StatusUnauthorized)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			http.Error(w, "bearer token is required", http.StatusUnauthorized)
+			return
+		}
+		claims, err := ParseToken(s.AccessKey, token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !audienceMatches(claims.Audience, r) {
+			http.Error(w, "token audience does not match the request", http.StatusUnauthorized)
+			return
+		}
+		if claims.ExpiresAt == 0 {
+			http.Error(w, "token expiry is required", http.StatusUnauthorized)
+			return
+		}
+		fn(w, r, s.Hub(r.PathValue("hub")))
+	}
+}
+
+// audienceMatches reports whether aud is the URL of r. Only the paths are
+// compared, as proxies may rewrite the scheme and host, and clients add
+// query parameters such as api-version.
+func audienceMatches(aud string, r *http.Request) bool {
+	u, err := url.Parse(aud)
+	if err != nil || aud == "" {
+		return false
+	}
+	return strings.TrimSuffix(u.EscapedPath(), "/") == strings.TrimSuffix(r.URL.EscapedPath(), "/")
+}
+
+// readMessageData reads the request body as text, json or binary data
+// according to its content type.
+func readMessageData(r *http.Request) (*webpubsub.MessageData, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	switch mediaType {
+	case "text/plain":
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_TextData{TextData: string(body)}}, nil
+	case "application/json":
+		if !json.Valid(body) {
+			return nil, errors.New("invalid json")
+		}
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_JsonData{JsonData: string(body)}}, nil
+	case "application/octet-stream":
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_BinaryData{BinaryData: body}}, nil
+	}
+	return nil, errUnsupportedContentType
+}
+
+var errUnsupportedContentType = errors.New("content type must be text/plain, application/json or application/octet-stream")
+
+const maxAPIBodySize = 1 << 20
+
+func readBody(r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+	return io.ReadAll(io.LimitReader(r.Body, maxAPIBodySize))
+}
+
+func writeDataError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedContentType) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func writeExists(w http.ResponseWriter, ok bool) {
+	if ok {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *Server) sendToAll(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	data, err := readMessageData(r)
+	if err != nil {
+		writeDataError(w, err)
+		return
+	}
+	hub.SendToAll(data, r.URL.Query()["excluded"]...)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) sendToGroup(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	data, err := readMessageData(r)
+	if err != nil {
+		writeDataError(w, err)
+		return
+	}
+	hub.SendToGroup(r.PathValue("group"), data, r.URL.Query()["excluded"]...)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) sendToUser(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	data, err := readMessageData(r)
+	if err != nil {
+		writeDataError(w, err)
+		return
+	}
+	hub.SendToUser(r.PathValue("user"), data)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) sendToConnection(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	data, err := readMessageData(r)
+	if err != nil {
+		writeDataError(w, err)
+		return
+	}
+	if err := hub.SendToConnection(r.PathValue("connectionId"), data); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) groupExists(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	writeExists(w, hub.GroupExists(r.PathValue("group")))
+}
+
+func (s *Server) userExists(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	writeExists(w, hub.UserExists(r.PathValue("user")))
+}
+
+func (s *Server) connectionExists(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	writeExists(w, hub.ConnectionExists(r.PathValue("connectionId")))
+}
+
+func (s *Server) addConnectionToGroup(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	if err := hub.AddConnectionToGroup(r.PathValue("group"), r.PathValue("connectionId")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) removeConnectionFromGroup(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	hub.RemoveConnectionFromGroup(r.PathValue("group"), r.PathValue("connectionId"))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) removeConnectionFromAllGroups(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	hub.RemoveConnectionFromAllGroups(r.PathValue("connectionId"))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) addUserToGroup(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	hub.AddUserToGroup(r.PathValue("group"), r.PathValue("user"))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) removeUserFromGroup(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	hub.RemoveUserFromGroup(r.PathValue("group"), r.PathValue("user"))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) removeUserFromAllGroups(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	hub.RemoveUserFromAllGroups(r.PathValue("user"))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) closeConnection(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	// Closing a connection that is already gone succeeds, as in Azure.
+	hub.CloseConnection(r.PathValue("connectionId"), r.URL.Query().Get("reason"))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) closeUserConnections(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	hub.CloseUserConnections(r.PathValue("user"), r.URL.Query().Get("reason"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// generateToken returns a client access token for the hub, as
+//
+//	{"token": "..."}
+func (s *Server) generateToken(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	q := r.URL.Query()
+	minutes := 60
+	if v := q.Get("minutesToExpire"); v != "" {
+		m, err := strconv.Atoi(v)
+		if err != nil || m <= 0 {
+			http.Error(w, "invalid minutesToExpire", http.StatusBadRequest)
+			return
+		}
+		minutes = m
+	}
+	now := time.Now()
+	token, err := SignToken(s.AccessKey, &TokenClaims{
+		Audience:  clientURL(r, hub.hubId),
+		Subject:   q.Get("userId"),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Duration(minutes) * time.Minute).Unix(),
+		Roles:     q["role"],
+		Groups:    q["group"],
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+func clientURL(r *http.Request, hubId string) string {
+	scheme := "ws"
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	return scheme + "://" + r.Host + "/client/hubs/" + hubId
+}
@@ -0,0 +1,172 @@
+package reliablesocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAccessKey = "test-access-key"
+
+func apiRequest(t *testing.T, method, url, contentType, body string) *http.Response {
+	t.Helper()
+	token, err := SignToken(testAccessKey, &TokenClaims{Audience: url, ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	s := NewServer()
+	s.AccessKey = testAccessKey
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/api/hubs/chat/:send", "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("no token: got %d, want 401", resp.StatusCode)
+	}
+
+	forged, _ := SignToken("other-key", &TokenClaims{})
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/hubs/chat/:send", strings.NewReader("hi"))
+	req.Header.Set("Authorization", "Bearer "+forged)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("forged token: got %d, want 401", resp.StatusCode)
+	}
+
+	// Client access tokens are signed with the same key, for another
+	// audience.
+	for _, aud := range []string{"", "ws" + strings.TrimPrefix(ts.URL, "http") + "/client/hubs/chat", ts.URL + "/api/hubs/other/:send"} {
+		token, _ := SignToken(testAccessKey, &TokenClaims{Audience: aud, Subject: "mallory"})
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/hubs/chat/:send", strings.NewReader("hi"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "text/plain")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("token for %q: got %d, want 401", aud, resp.StatusCode)
+		}
+	}
+
+	// Management tokens must expire.
+	endless, _ := SignToken(testAccessKey, &TokenClaims{Audience: ts.URL + "/api/hubs/chat/:send"})
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/api/hubs/chat/:send", strings.NewReader("hi"))
+	req.Header.Set("Authorization", "Bearer "+endless)
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("token without exp: got %d, want 401", resp.StatusCode)
+	}
+
+	if resp := apiRequest(t, http.MethodPost, ts.URL+"/api/hubs/chat/:send?api-version=2024-01-01", "text/plain", "hi"); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("send: got %d, want 202", resp.StatusCode)
+	}
+	if resp := apiRequest(t, http.MethodPost, ts.URL+"/api/hubs/chat/:send", "image/png", "hi"); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("send png: got %d, want 415", resp.StatusCode)
+	}
+}
+
+func TestAPIGenerateTokenAndSend(t *testing.T) {
+	s := NewServer()
+	s.AccessKey = testAccessKey
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	generateURL := ts.URL + "/api/hubs/chat/:generateToken?userId=alice&group=lobby"
+	token, _ := SignToken(testAccessKey, &TokenClaims{Audience: generateURL, ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	req, _ := http.NewRequest(http.MethodPost, generateURL, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	c, err := NewClient(ClientOptions{
+		Endpoint:    "ws" + strings.TrimPrefix(ts.URL, "http"),
+		Hub:         "chat",
+		AccessToken: StaticAccessToken(body.Token),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 2)
+	c.OnServerMessage(func(msg *ServerMessage) { received <- msg.Data.Text })
+	connected := make(chan *ConnectedEvent, 1)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	select {
+	case e := <-connected:
+		if e.UserId != "alice" {
+			t.Fatalf("user id %q, want alice", e.UserId)
+		}
+	case <-ctx.Done():
+		t.Fatal("not connected")
+	}
+
+	if resp := apiRequest(t, http.MethodHead, ts.URL+"/api/hubs/chat/users/alice", "", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("user exists: got %d, want 200", resp.StatusCode)
+	}
+	if resp := apiRequest(t, http.MethodHead, ts.URL+"/api/hubs/chat/users/bob", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("user exists: got %d, want 404", resp.StatusCode)
+	}
+	apiRequest(t, http.MethodPost, ts.URL+"/api/hubs/chat/users/alice/:send", "text/plain", "to alice")
+	apiRequest(t, http.MethodPost, ts.URL+"/api/hubs/chat/groups/lobby/:send", "text/plain", "to lobby")
+
+	// Messages sent through the API come from the server, even to a group.
+	for _, want := range []string{"to alice", "to lobby"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("did not receive %q", want)
+		}
+	}
+}
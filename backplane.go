@@ -0,0 +1,612 @@
+package reliablesocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reliablesocket/proto/webpubsub"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Backplane connects the hubs of several server nodes. Every node publishes
+// the messages and membership changes its hubs cannot handle alone, and
+// applies those published by the other nodes.
+type Backplane interface {
+	// Publish sends m to every node subscribed to hub, this one included.
+	Publish(ctx context.Context, hub string, m *BackplaneMessage) error
+	// Subscribe calls handler, in publication order, with every message
+	// published for hub until unsubscribe is called.
+	Subscribe(hub string, handler func(m *BackplaneMessage)) (unsubscribe func(), err error)
+}
+
+// BackplaneMessage is a message, operation or membership change published by
+// the hub of node Node.
+type BackplaneMessage struct {
+	Node         string
+	Type         string
+	Group        string
+	UserId       string
+	ConnectionId string
+	Excluded     []string
+	NoEcho       bool
+	Reason       string
+	Data         *webpubsub.MessageData
+	// Target is the node a reply is for.
+	Target  string
+	Session *SessionState
+	// Forwarded is set on a group message sent to the owner of its sharded
+	// group, for it to fan out.
+	Forwarded bool
+	// SequenceId and Timestamp number group messages of groups keeping
+	// history, as numbered by the node that recorded them.
+	SequenceId int64
+	Timestamp  int64
+}
+
+// Types of BackplaneMessage.
+const (
+	bpSendToAll                     = "sendToAll"
+	bpSendToGroup                   = "sendToGroup"
+	bpGroupMessage                  = "groupMessage"
+	bpSendToUser                    = "sendToUser"
+	bpSendToConnection              = "sendToConnection"
+	bpAddConnectionToGroup          = "addConnectionToGroup"
+	bpRemoveConnectionFromGroup     = "removeConnectionFromGroup"
+	bpRemoveConnectionFromAllGroups = "removeConnectionFromAllGroups"
+	bpAddUserToGroup                = "addUserToGroup"
+	bpRemoveUserFromGroup           = "removeUserFromGroup"
+	bpRemoveUserFromAllGroups       = "removeUserFromAllGroups"
+	bpCloseGroup                    = "closeGroup"
+	bpCloseConnection               = "closeConnection"
+	bpCloseUserConnections          = "closeUserConnections"
+
+	// Membership changes keep the view every node has of the others.
+	bpConnected    = "connected"
+	bpDisconnected = "disconnected"
+	bpJoined       = "joined"
+	bpLeft         = "left"
+	// bpHello asks the other nodes to announce their connections.
+	bpHello = "hello"
+	// bpNode announces a node, bpNodeLeft tells it shut down and that the
+	// connections it still announced are gone.
+	bpNode     = "node"
+	bpNodeLeft = "nodeLeft"
+
+	// bpTakeSession asks the node serving a connection to hand over its
+	// session in a bpSession, as the client is recovering elsewhere.
+	bpTakeSession = "takeSession"
+	bpSession     = "session"
+)
+
+type backplaneWire struct {
+	Node         string        `json:"node"`
+	Type         string        `json:"type"`
+	Group        string        `json:"group,omitempty"`
+	UserId       string        `json:"userId,omitempty"`
+	ConnectionId string        `json:"connectionId,omitempty"`
+	Excluded     []string      `json:"excluded,omitempty"`
+	NoEcho       bool          `json:"noEcho,omitempty"`
+	Reason       string        `json:"reason,omitempty"`
+	Data         []byte        `json:"data,omitempty"`
+	Target       string        `json:"target,omitempty"`
+	Session      *SessionState `json:"session,omitempty"`
+	Forwarded    bool          `json:"forwarded,omitempty"`
+	SequenceId   int64         `json:"sequenceId,omitempty"`
+	Timestamp    int64         `json:"timestamp,omitempty"`
+}
+
+// EncodeBackplaneMessage encodes m for backplanes that cross the process
+// boundary.
+func EncodeBackplaneMessage(m *BackplaneMessage) ([]byte, error) {
+	w := backplaneWire{
+		Node:         m.Node,
+		Type:         m.Type,
+		Group:        m.Group,
+		UserId:       m.UserId,
+		ConnectionId: m.ConnectionId,
+		Excluded:     m.Excluded,
+		NoEcho:       m.NoEcho,
+		Reason:       m.Reason,
+		Target:       m.Target,
+		Session:      m.Session,
+		Forwarded:    m.Forwarded,
+		SequenceId:   m.SequenceId,
+		Timestamp:    m.Timestamp,
+	}
+	if m.Data != nil {
+		data, err := proto.Marshal(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		w.Data = data
+	}
+	return json.Marshal(&w)
+}
+
+func DecodeBackplaneMessage(data []byte) (*BackplaneMessage, error) {
+	var w backplaneWire
+	if err := json.Unmarshal(data, &w); err != nil {
+		return nil, err
+	}
+	m := &BackplaneMessage{
+		Node:         w.Node,
+		Type:         w.Type,
+		Group:        w.Group,
+		UserId:       w.UserId,
+		ConnectionId: w.ConnectionId,
+		Excluded:     w.Excluded,
+		NoEcho:       w.NoEcho,
+		Reason:       w.Reason,
+		Target:       w.Target,
+		Session:      w.Session,
+		Forwarded:    w.Forwarded,
+		SequenceId:   w.SequenceId,
+		Timestamp:    w.Timestamp,
+	}
+	if w.Data != nil {
+		m.Data = &webpubsub.MessageData{}
+		if err := proto.Unmarshal(w.Data, m.Data); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// MemoryBackplane connects servers running in one process, mostly for
+// tests. Each subscriber gets the messages in order on its own goroutine.
+type MemoryBackplane struct {
+	mu   sync.Mutex
+	subs map[string]map[*mailbox[*BackplaneMessage]]bool
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{subs: map[string]map[*mailbox[*BackplaneMessage]]bool{}}
+}
+
+func (b *MemoryBackplane) Publish(ctx context.Context, hub string, m *BackplaneMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for mb := range b.subs[hub] {
+		mb.put(m)
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(hub string, handler func(m *BackplaneMessage)) (func(), error) {
+	mb := newMailbox(handler)
+	b.mu.Lock()
+	if b.subs[hub] == nil {
+		b.subs[hub] = map[*mailbox[*BackplaneMessage]]bool{}
+	}
+	b.subs[hub][mb] = true
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		delete(b.subs[hub], mb)
+		b.mu.Unlock()
+		mb.close()
+	}, nil
+}
+
+// mailbox is an unbounded queue handled by one goroutine, so publishing
+// never blocks on a slow subscriber.
+type mailbox[T any] struct {
+	mu      sync.Mutex
+	queue   []T
+	wake    chan struct{}
+	done    chan struct{}
+	handler func(m T)
+}
+
+func newMailbox[T any](handler func(m T)) *mailbox[T] {
+	mb := &mailbox[T]{wake: make(chan struct{}, 1), done: make(chan struct{}), handler: handler}
+	go mb.run()
+	return mb
+}
+
+func (mb *mailbox[T]) put(m T) {
+	mb.mu.Lock()
+	mb.queue = append(mb.queue, m)
+	mb.mu.Unlock()
+	select {
+	case mb.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (mb *mailbox[T]) run() {
+	for {
+		select {
+		case <-mb.wake:
+		case <-mb.done:
+			return
+		}
+		mb.mu.Lock()
+		queue := mb.queue
+		mb.queue = nil
+		mb.mu.Unlock()
+		for _, m := range queue {
+			mb.handler(m)
+		}
+	}
+}
+
+func (mb *mailbox[T]) close() {
+	close(mb.done)
+}
+
+// defaultNodeTimeout is how long a node goes unheard before the others drop
+// it.
+const defaultNodeTimeout = 15 * time.Second
+
+// hubBackplane is the backplane a hub is attached to. ring is set when
+// groups are sharded. outbox publishes, in order, the messages queued under
+// the hub locks.
+type hubBackplane struct {
+	Backplane
+	node        string
+	ring        *hashRing
+	outbox      *mailbox[*BackplaneMessage]
+	unsubscribe func()
+
+	// seen is when the other nodes were last heard from, dropped those not
+	// heard from for timeout until they are again.
+	timeout time.Duration
+	mu      sync.Mutex
+	seen    map[string]time.Time
+	dropped map[string]bool
+	done    chan struct{}
+}
+
+// heard records a message of node and reports whether node had been dropped.
+func (b *hubBackplane) heard(node string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seen[node] = time.Now()
+	if b.dropped[node] {
+		delete(b.dropped, node)
+		return true
+	}
+	return false
+}
+
+// left forgets node, which shut down.
+func (b *hubBackplane) left(node string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.seen, node)
+	delete(b.dropped, node)
+}
+
+// expire returns the nodes not heard from for timeout, now dropped.
+func (b *hubBackplane) expire() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var expired []string
+	for node, t := range b.seen {
+		if time.Since(t) > b.timeout {
+			delete(b.seen, node)
+			b.dropped[node] = true
+			expired = append(expired, node)
+		}
+	}
+	return expired
+}
+
+// remotePeer is a connection of another node.
+type remotePeer struct {
+	node   string
+	userId string
+	groups map[string]bool
+}
+
+// remoteIndex is what a hub knows of the connections of the other nodes.
+// groups counts the members of every group by node, which makes the
+// delivery list of a sharded group.
+type remoteIndex struct {
+	mu     sync.Mutex
+	peers  map[string]*remotePeer
+	groups map[string]map[string]int
+}
+
+func newRemoteIndex() *remoteIndex {
+	return &remoteIndex{peers: map[string]*remotePeer{}, groups: map[string]map[string]int{}}
+}
+
+func (r *remoteIndex) apply(m *BackplaneMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch m.Type {
+	case bpNodeLeft:
+		for connectionId, rp := range r.peers {
+			if rp.node == m.Node {
+				r.forget(connectionId, rp)
+			}
+		}
+		return
+	case bpConnected:
+		if rp, ok := r.peers[m.ConnectionId]; !ok || rp.node != m.Node {
+			if ok {
+				r.forget(m.ConnectionId, rp)
+			}
+			r.peers[m.ConnectionId] = &remotePeer{node: m.Node, userId: m.UserId, groups: map[string]bool{}}
+		}
+		return
+	}
+	// A connection moved to another node may be announced there before it
+	// is gone from here, so only its current node changes it.
+	rp, ok := r.peers[m.ConnectionId]
+	if !ok || rp.node != m.Node {
+		return
+	}
+	switch m.Type {
+	case bpDisconnected:
+		r.forget(m.ConnectionId, rp)
+	case bpJoined:
+		if !rp.groups[m.Group] {
+			rp.groups[m.Group] = true
+			if r.groups[m.Group] == nil {
+				r.groups[m.Group] = map[string]int{}
+			}
+			r.groups[m.Group][rp.node]++
+		}
+	case bpLeft:
+		if rp.groups[m.Group] {
+			r.leave(rp, m.Group)
+		}
+	}
+}
+
+// forget drops a connection and its memberships. The caller holds r.mu.
+func (r *remoteIndex) forget(connectionId string, rp *remotePeer) {
+	for groupId := range rp.groups {
+		r.leave(rp, groupId)
+	}
+	delete(r.peers, connectionId)
+}
+
+// leave drops rp from groupId. The caller holds r.mu.
+func (r *remoteIndex) leave(rp *remotePeer, groupId string) {
+	delete(rp.groups, groupId)
+	nodes := r.groups[groupId]
+	if nodes[rp.node]--; nodes[rp.node] <= 0 {
+		delete(nodes, rp.node)
+	}
+	if len(nodes) == 0 {
+		delete(r.groups, groupId)
+	}
+}
+
+func (r *remoteIndex) hasConnection(connectionId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.peers[connectionId]
+	return ok
+}
+
+func (r *remoteIndex) hasUser(userId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rp := range r.peers {
+		if rp.userId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *remoteIndex) hasGroup(groupId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.groups[groupId]) > 0
+}
+
+// groupNodes returns the other nodes with members in groupId.
+func (r *remoteIndex) groupNodes(groupId string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Sorted(maps.Keys(r.groups[groupId]))
+}
+
+// attachBackplane subscribes h to b as node and asks the other nodes for
+// their connections. Sharded hubs also subscribe to the channel of their
+// node, where the owners of groups send group messages. Hubs keeping group
+// history must be sharded. Nodes not heard from for nodeTimeout are dropped.
+func (h *Hub) attachBackplane(node string, b Backplane, shard bool, nodeTimeout time.Duration) error {
+	if !shard && h.history.Count() > 0 {
+		return ErrHistoryNotSharded
+	}
+	if nodeTimeout <= 0 {
+		nodeTimeout = defaultNodeTimeout
+	}
+	hb := &hubBackplane{
+		Backplane: b,
+		node:      node,
+		outbox:    newMailbox(h.publish),
+		timeout:   nodeTimeout,
+		seen:      map[string]time.Time{},
+		dropped:   map[string]bool{},
+		done:      make(chan struct{}),
+	}
+	if shard {
+		hb.ring = newHashRing()
+		hb.ring.add(node)
+	}
+	// Messages may arrive before Subscribe returns.
+	h.backplane.Store(hb)
+	unsubscribe, err := b.Subscribe(h.hubId, h.handleBackplane)
+	if err != nil {
+		h.backplane.Store(nil)
+		hb.outbox.close()
+		return err
+	}
+	unsubscribeNode := func() {}
+	if shard {
+		unsubscribeNode, err = b.Subscribe(nodeChannel(h.hubId, node), h.handleBackplane)
+		if err != nil {
+			h.backplane.Store(nil)
+			hb.outbox.close()
+			unsubscribe()
+			return err
+		}
+	}
+	hb.unsubscribe = func() {
+		close(hb.done)
+		unsubscribe()
+		unsubscribeNode()
+		hb.outbox.close()
+	}
+	h.publish(&BackplaneMessage{Type: bpHello})
+	h.announce()
+	go h.heartbeat(hb)
+	return nil
+}
+
+// heartbeat announces this node every third of the node timeout, and drops
+// the other nodes not heard from for longer, taken for crashed.
+func (h *Hub) heartbeat(b *hubBackplane) {
+	ticker := time.NewTicker(b.timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+		h.publish(&BackplaneMessage{Type: bpNode})
+		for _, node := range b.expire() {
+			h.dropNode(b, node)
+		}
+	}
+}
+
+// dropNode forgets the connections of node, which left or crashed, and takes
+// it off the ring, which gives its groups to other owners.
+func (h *Hub) dropNode(b *hubBackplane, node string) {
+	if b.ring != nil {
+		b.ring.remove(node)
+	}
+	h.remote.apply(&BackplaneMessage{Type: bpNodeLeft, Node: node})
+}
+
+// publish sends m to the other nodes, if any.
+func (h *Hub) publish(m *BackplaneMessage) {
+	b := h.backplane.Load()
+	if b == nil {
+		return
+	}
+	m.Node = b.node
+	if err := b.Publish(context.Background(), h.hubId, m); err != nil {
+		h.report(fmt.Errorf("backplane: %w", err))
+	}
+}
+
+// publishLater queues m for the outbox to publish, for callers holding
+// locks the backplane must not be waited for under.
+func (h *Hub) publishLater(m *BackplaneMessage) {
+	if b := h.backplane.Load(); b != nil {
+		b.outbox.put(m)
+	}
+}
+
+// publishTo sends m to node only.
+func (h *Hub) publishTo(node string, m *BackplaneMessage) {
+	b := h.backplane.Load()
+	if b == nil {
+		return
+	}
+	m.Node = b.node
+	if err := b.Publish(context.Background(), nodeChannel(h.hubId, node), m); err != nil {
+		h.report(fmt.Errorf("backplane: %w", err))
+	}
+}
+
+// announce publishes this node, the local connections and their groups.
+func (h *Hub) announce() {
+	h.publish(&BackplaneMessage{Type: bpNode})
+	for _, p := range h.peers.Items() {
+		h.publish(&BackplaneMessage{Type: bpConnected, ConnectionId: p.PeerId, UserId: p.UserId})
+		for _, groupId := range p.groups.Keys() {
+			h.publish(&BackplaneMessage{Type: bpJoined, ConnectionId: p.PeerId, Group: groupId})
+		}
+	}
+}
+
+// handleBackplane applies a message published by another node to the local
+// connections only.
+func (h *Hub) handleBackplane(m *BackplaneMessage) {
+	b := h.backplane.Load()
+	if b == nil || m.Node == b.node {
+		return
+	}
+	if m.Type == bpNodeLeft {
+		b.left(m.Node)
+		h.dropNode(b, m.Node)
+		return
+	}
+	// Any message shows its node is up. A node joining or leaving the ring
+	// rebalances the groups, some of which get another owner.
+	if b.heard(m.Node) {
+		// Its connections were forgotten when it was dropped.
+		h.publish(&BackplaneMessage{Type: bpHello})
+	}
+	if b.ring != nil {
+		b.ring.add(m.Node)
+	}
+	switch m.Type {
+	case bpSendToAll:
+		h.sendToAll(m.Data, m.Excluded...)
+	case bpSendToGroup, bpGroupMessage:
+		if m.Forwarded {
+			// Owned here, at least as the sender saw the ring.
+			c := *m
+			h.fanOut(&c)
+		} else {
+			h.deliverGroup(m, nil)
+		}
+	case bpSendToUser:
+		h.sendToUser(m.UserId, m.Data)
+	case bpSendToConnection:
+		if p, ok := h.peers.Get(m.ConnectionId); ok {
+			p.sendDownStreamDataMessage("server", nil, m.Data)
+		}
+	case bpAddConnectionToGroup:
+		h.addConnectionToGroup(m.Group, m.ConnectionId)
+	case bpRemoveConnectionFromGroup:
+		h.removeConnectionFromGroup(m.Group, m.ConnectionId)
+	case bpRemoveConnectionFromAllGroups:
+		if p, ok := h.peers.Get(m.ConnectionId); ok {
+			h.removePeerFromAllGroups(p)
+		}
+	case bpAddUserToGroup:
+		h.addUserToGroup(m.Group, m.UserId)
+	case bpRemoveUserFromGroup:
+		h.removeUserFromGroup(m.Group, m.UserId)
+	case bpRemoveUserFromAllGroups:
+		h.removeUserFromAllGroups(m.UserId)
+	case bpCloseGroup:
+		h.closeGroup(m.Group)
+	case bpCloseConnection:
+		if p, ok := h.peers.Get(m.ConnectionId); ok {
+			p.abort(m.Reason)
+		}
+	case bpCloseUserConnections:
+		h.closeUserConnections(m.UserId, m.Reason)
+	case bpHello:
+		h.announce()
+	case bpNode:
+	case bpTakeSession:
+		h.handOverSession(m.Node, m.ConnectionId)
+	case bpSession:
+		if m.Target == b.node {
+			h.sessionHandedOver(m.ConnectionId, m.Session)
+		}
+	default:
+		h.remote.apply(m)
+	}
+}
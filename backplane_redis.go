@@ -0,0 +1,373 @@
+package reliablesocket
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RedisBackplaneOptions struct {
+	// Addr is the host:port of the Redis server.
+	Addr     string
+	Password string
+	// ChannelPrefix prefixes the channel of every hub. Defaults to
+	// "reliablesocket:".
+	ChannelPrefix string
+	// DialTimeout also bounds how long Subscribe waits for Redis to confirm
+	// the subscription. Defaults to 5s.
+	DialTimeout time.Duration
+	// OnError is called with the errors the backplane works around, such as
+	// a lost connection it is re-establishing or a message it could not
+	// decode.
+	OnError func(err error)
+}
+
+// RedisBackplane is a Backplane over Redis pub/sub, with one channel per hub.
+// It talks RESP itself: one connection publishes, another one receives.
+// Messages published while the receiving connection is being re-established
+// are lost, as Redis pub/sub keeps nothing.
+type RedisBackplane struct {
+	opts RedisBackplaneOptions
+
+	pubMu sync.Mutex
+	pub   *respConn
+
+	subMu sync.Mutex
+	sub   *respConn
+	// mailboxes holds the handler of every subscribed channel, confirmed
+	// the channels whose subscription Redis has not confirmed yet.
+	mailboxes map[string]*mailbox[*BackplaneMessage]
+	confirmed map[string]chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewRedisBackplane(opts RedisBackplaneOptions) *RedisBackplane {
+	if opts.ChannelPrefix == "" {
+		opts.ChannelPrefix = "reliablesocket:"
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	return &RedisBackplane{
+		opts:      opts,
+		mailboxes: map[string]*mailbox[*BackplaneMessage]{},
+		confirmed: map[string]chan struct{}{},
+		closed:    make(chan struct{}),
+	}
+}
+
+func (b *RedisBackplane) report(err error) {
+	if b.opts.OnError != nil {
+		b.opts.OnError(fmt.Errorf("redis backplane: %w", err))
+	}
+}
+
+func (b *RedisBackplane) channel(hub string) string {
+	return b.opts.ChannelPrefix + hub
+}
+
+func (b *RedisBackplane) dial() (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", b.opts.Addr, b.opts.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &respConn{Conn: conn, r: bufio.NewReader(conn)}
+	if b.opts.Password != "" {
+		if _, err := c.do("AUTH", b.opts.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Publish sends m on the channel of hub, redialing once if the connection
+// was lost.
+func (b *RedisBackplane) Publish(ctx context.Context, hub string, m *BackplaneMessage) error {
+	payload, err := EncodeBackplaneMessage(m)
+	if err != nil {
+		return err
+	}
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.pub == nil {
+			if b.pub, err = b.dial(); err != nil {
+				return err
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			b.pub.SetDeadline(deadline)
+		} else {
+			b.pub.SetDeadline(time.Time{})
+		}
+		_, err = b.pub.do("PUBLISH", b.channel(hub), string(payload))
+		var re redisError
+		if err == nil || errors.As(err, &re) {
+			return err
+		}
+		b.pub.Close()
+		b.pub = nil
+	}
+	return err
+}
+
+func (b *RedisBackplane) Subscribe(hub string, handler func(m *BackplaneMessage)) (func(), error) {
+	channel := b.channel(hub)
+	mb := newMailbox(handler)
+	confirmed := make(chan struct{})
+	b.subMu.Lock()
+	b.mailboxes[channel] = mb
+	b.confirmed[channel] = confirmed
+	var err error
+	if b.sub == nil {
+		err = b.connectSubscriber()
+	} else {
+		err = b.sub.write("SUBSCRIBE", channel)
+	}
+	b.subMu.Unlock()
+	if err == nil {
+		select {
+		case <-confirmed:
+		case <-time.After(b.opts.DialTimeout):
+			err = errors.New("redis subscription not confirmed")
+		}
+	}
+	unsubscribe := func() {
+		b.subMu.Lock()
+		defer b.subMu.Unlock()
+		if b.mailboxes[channel] != mb {
+			return
+		}
+		delete(b.mailboxes, channel)
+		delete(b.confirmed, channel)
+		if b.sub != nil {
+			b.sub.write("UNSUBSCRIBE", channel)
+		}
+		mb.close()
+	}
+	if err != nil {
+		unsubscribe()
+		return nil, err
+	}
+	return unsubscribe, nil
+}
+
+// connectSubscriber dials the receiving connection and subscribes every
+// channel. The caller holds subMu.
+func (b *RedisBackplane) connectSubscriber() error {
+	c, err := b.dial()
+	if err != nil {
+		return err
+	}
+	args := []string{"SUBSCRIBE"}
+	for channel := range b.mailboxes {
+		args = append(args, channel)
+	}
+	if err := c.write(args...); err != nil {
+		c.Close()
+		return err
+	}
+	b.sub = c
+	go b.receive(c)
+	return nil
+}
+
+func (b *RedisBackplane) receive(c *respConn) {
+	for {
+		v, err := c.read()
+		if err != nil {
+			c.Close()
+			b.resubscribe(c)
+			return
+		}
+		msg, ok := v.([]any)
+		if !ok || len(msg) != 3 {
+			continue
+		}
+		kind, _ := msg[0].(string)
+		channel, _ := msg[1].(string)
+		b.subMu.Lock()
+		switch kind {
+		case "subscribe":
+			if ch, ok := b.confirmed[channel]; ok {
+				close(ch)
+				delete(b.confirmed, channel)
+			}
+		case "message":
+			if mb, ok := b.mailboxes[channel]; ok {
+				payload, _ := msg[2].(string)
+				if m, err := DecodeBackplaneMessage([]byte(payload)); err == nil {
+					mb.put(m)
+				} else {
+					b.report(err)
+				}
+			}
+		}
+		b.subMu.Unlock()
+	}
+}
+
+// resubscribe replaces the lost receiving connection c, retrying with
+// backoff until the backplane is closed.
+func (b *RedisBackplane) resubscribe(c *respConn) {
+	delay := 100 * time.Millisecond
+	for {
+		b.subMu.Lock()
+		if b.sub != c {
+			b.subMu.Unlock()
+			return
+		}
+		select {
+		case <-b.closed:
+			b.sub = nil
+			b.subMu.Unlock()
+			return
+		default:
+		}
+		err := b.connectSubscriber()
+		b.subMu.Unlock()
+		if err == nil {
+			return
+		}
+		b.report(err)
+		select {
+		case <-b.closed:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, 5*time.Second)
+	}
+}
+
+func (b *RedisBackplane) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		b.pubMu.Lock()
+		if b.pub != nil {
+			b.pub.Close()
+			b.pub = nil
+		}
+		b.pubMu.Unlock()
+		b.subMu.Lock()
+		if b.sub != nil {
+			b.sub.Close()
+		}
+		for _, mb := range b.mailboxes {
+			mb.close()
+		}
+		b.mailboxes = map[string]*mailbox[*BackplaneMessage]{}
+		b.subMu.Unlock()
+	})
+	return nil
+}
+
+// redisError is an error reply.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// respConn reads and writes RESP2. Bulk and simple strings are read as
+// string, integers as int64, arrays as []any and nulls as nil.
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *respConn) write(args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := c.Write(buf)
+	return err
+}
+
+func (c *respConn) do(args ...string) (any, error) {
+	if err := c.write(args...); err != nil {
+		return nil, err
+	}
+	v, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if re, ok := v.(redisError); ok {
+		return nil, re
+	}
+	return v, nil
+}
+
+func (c *respConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("redis: malformed line")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (c *respConn) read() (any, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,373 @@
+package reliablesocket
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the pub/sub subset of RESP the Redis backplane uses.
+type fakeRedis struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns map[*respConn]*sync.Mutex
+	subs  map[string]map[*respConn]bool
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{ln: ln, conns: map[*respConn]*sync.Mutex{}, subs: map[string]map[*respConn]bool{}}
+	t.Cleanup(func() { ln.Close(); r.drop() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c := &respConn{Conn: conn, r: bufio.NewReader(conn)}
+			r.mu.Lock()
+			r.conns[c] = &sync.Mutex{}
+			r.mu.Unlock()
+			go r.serve(c)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) reply(c *respConn, raw string) {
+	r.mu.Lock()
+	mu := r.conns[c]
+	r.mu.Unlock()
+	if mu == nil {
+		return
+	}
+	mu.Lock()
+	c.Write([]byte(raw))
+	mu.Unlock()
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func (r *fakeRedis) serve(c *respConn) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, c)
+		for _, subs := range r.subs {
+			delete(subs, c)
+		}
+		r.mu.Unlock()
+		c.Close()
+	}()
+	for {
+		v, err := c.read()
+		if err != nil {
+			return
+		}
+		args, _ := v.([]any)
+		if len(args) == 0 {
+			return
+		}
+		cmd, _ := args[0].(string)
+		switch strings.ToUpper(cmd) {
+		case "PING", "AUTH":
+			r.reply(c, "+OK\r\n")
+		case "SUBSCRIBE":
+			for i, arg := range args[1:] {
+				channel := arg.(string)
+				r.mu.Lock()
+				if r.subs[channel] == nil {
+					r.subs[channel] = map[*respConn]bool{}
+				}
+				r.subs[channel][c] = true
+				r.mu.Unlock()
+				r.reply(c, "*3\r\n"+bulk("subscribe")+bulk(channel)+":"+strconv.Itoa(i+1)+"\r\n")
+			}
+		case "UNSUBSCRIBE":
+			for _, arg := range args[1:] {
+				r.mu.Lock()
+				delete(r.subs[arg.(string)], c)
+				r.mu.Unlock()
+			}
+		case "PUBLISH":
+			channel, payload := args[1].(string), args[2].(string)
+			r.mu.Lock()
+			var subs []*respConn
+			for s := range r.subs[channel] {
+				subs = append(subs, s)
+			}
+			r.mu.Unlock()
+			for _, s := range subs {
+				r.reply(s, "*3\r\n"+bulk("message")+bulk(channel)+bulk(payload))
+			}
+			r.reply(c, ":"+strconv.Itoa(len(subs))+"\r\n")
+		default:
+			r.reply(c, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+// drop closes every client connection, as a Redis restart would.
+func (r *fakeRedis) drop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for c := range r.conns {
+		c.Close()
+	}
+}
+
+func TestBackplane(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		b := NewMemoryBackplane()
+		testBackplane(t, b, b, nil)
+	})
+	t.Run("redis", func(t *testing.T) {
+		r := newFakeRedis(t)
+		opts := RedisBackplaneOptions{Addr: r.ln.Addr().String(), Password: "secret"}
+		b1, b2 := NewRedisBackplane(opts), NewRedisBackplane(opts)
+		defer b1.Close()
+		defer b2.Close()
+		testBackplane(t, b1, b2, r.drop)
+	})
+}
+
+// testBackplane runs two nodes over b1 and b2, calling drop, if set, to
+// check they get connected again.
+func testBackplane(t *testing.T, b1, b2 Backplane, drop func()) {
+	s1, s2 := NewServer(), NewServer()
+	if err := s1.UseBackplane(b1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.UseBackplane(b2); err != nil {
+		t.Fatal(err)
+	}
+	ts1, ts2 := httptest.NewServer(s1), httptest.NewServer(s2)
+	defer ts1.Close()
+	defer ts2.Close()
+	h1, h2 := s1.Hub("chat"), s2.Hub("chat")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := func(ts *httptest.Server, user string) (*Client, string, chan string) {
+		c := newTestClient(t, ts, user)
+		connected := make(chan string, 1)
+		c.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+		messages := make(chan string, 16)
+		c.OnServerMessage(func(msg *ServerMessage) { messages <- msg.Data.Text })
+		c.OnGroupMessage(func(msg *GroupMessage) { messages <- msg.Group + ": " + msg.Data.Text })
+		if err := c.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return c, <-connected, messages
+	}
+	alice, aliceId, aliceMessages := start(ts1, "alice")
+	defer alice.Close()
+	bob, _, bobMessages := start(ts2, "bob")
+	defer bob.Close()
+
+	expect := func(messages chan string, want string) {
+		t.Helper()
+		select {
+		case got := <-messages:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%q not delivered", want)
+		}
+	}
+	eventually := func(what string, cond func() bool) {
+		t.Helper()
+		for !cond() {
+			select {
+			case <-ctx.Done():
+				t.Fatal(what)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	if err := bob.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	eventually("bob's group unknown to the first node", func() bool { return h1.GroupExists("room") })
+	if err := alice.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SendToGroup(ctx, "room", textData("hi"), true); err != nil {
+		t.Fatal(err)
+	}
+	expect(bobMessages, "room: hi")
+
+	h1.SendToUser("bob", textData("to bob"))
+	expect(bobMessages, "to bob")
+	if err := h2.SendToConnection(aliceId, textData("to alice")); err != nil {
+		t.Fatal(err)
+	}
+	expect(aliceMessages, "to alice")
+	if err := h2.SendToConnection("unknown", textData("lost")); err != ErrConnectionNotFound {
+		t.Fatalf("got %v, want ErrConnectionNotFound", err)
+	}
+
+	h1.AddUserToGroup("lobby", "bob")
+	eventually("bob not added to lobby", func() bool { return h1.GroupExists("lobby") })
+	h1.SendToGroup("lobby", textData("welcome"))
+	expect(bobMessages, "welcome")
+
+	if drop == nil {
+		return
+	}
+	drop()
+	sent := 0
+	for {
+		h1.SendToUser("bob", textData("again"))
+		sent++
+		select {
+		case got := <-bobMessages:
+			if got != "again" {
+				t.Fatalf("got %q after reconnecting", got)
+			}
+			return
+		case <-ctx.Done():
+			t.Fatalf("nothing delivered after %d sends once the backplane dropped", sent)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// slowBackplane holds the membership announcements until release is closed.
+type slowBackplane struct {
+	*MemoryBackplane
+	release chan struct{}
+}
+
+func (b *slowBackplane) Publish(ctx context.Context, hub string, m *BackplaneMessage) error {
+	if m.Type == bpJoined || m.Type == bpLeft {
+		<-b.release
+	}
+	return b.MemoryBackplane.Publish(ctx, hub, m)
+}
+
+func TestMembershipPublishedOutsideLock(t *testing.T) {
+	b := &slowBackplane{MemoryBackplane: NewMemoryBackplane(), release: make(chan struct{})}
+	s1, s2 := NewServer(), NewServer()
+	if err := s1.UseBackplane(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.UseBackplane(b.MemoryBackplane); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s1)
+	defer ts.Close()
+	h1, h2 := s1.Hub("chat"), s2.Hub("chat")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := newTestClient(t, ts, "alice")
+	connected := make(chan string, 1)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := <-connected
+
+	// Group changes go on while the backplane is stuck, and reach the other
+	// node in order once it is not.
+	for _, group := range []string{"a", "b", "c"} {
+		if err := h1.AddConnectionToGroup(group, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h1.RemoveConnectionFromGroup("b", id)
+	if members := h1.GroupMembers("a"); len(members) != 1 {
+		t.Fatalf("%d members in a", len(members))
+	}
+	close(b.release)
+	for !h2.remote.hasGroup("c") || h2.remote.hasGroup("b") || !h2.remote.hasGroup("a") {
+		if ctx.Err() != nil {
+			t.Fatal("membership not announced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failingBackplane fails to subscribe to the hub "broken", and to publish
+// once failing is set.
+type failingBackplane struct {
+	*MemoryBackplane
+	failing atomic.Bool
+}
+
+func (b *failingBackplane) Publish(ctx context.Context, hub string, m *BackplaneMessage) error {
+	if b.failing.Load() {
+		return errors.New("publish failed")
+	}
+	return b.MemoryBackplane.Publish(ctx, hub, m)
+}
+
+func (b *failingBackplane) Subscribe(hub string, handler func(m *BackplaneMessage)) (func(), error) {
+	if hub == "broken" {
+		return nil, errors.New("subscribe failed")
+	}
+	return b.MemoryBackplane.Subscribe(hub, handler)
+}
+
+func TestBackplaneErrors(t *testing.T) {
+	b := &failingBackplane{MemoryBackplane: NewMemoryBackplane()}
+	s := NewServer()
+	reported := make(chan error, 4)
+	s.OnError = func(err error) { reported <- err }
+	if err := s.UseBackplane(b); err != nil {
+		t.Fatal(err)
+	}
+	s.Hub("broken")
+	if err := <-reported; !strings.Contains(err.Error(), "hub broken") || !strings.Contains(err.Error(), "subscribe failed") {
+		t.Fatalf("reported %v", err)
+	}
+	h := s.Hub("chat")
+	b.failing.Store(true)
+	h.SendToAll(textData("hi"))
+	if err := <-reported; !strings.Contains(err.Error(), "hub chat") || !strings.Contains(err.Error(), "publish failed") {
+		t.Fatalf("reported %v", err)
+	}
+
+	// A message the Redis backplane cannot decode is reported, and the
+	// subscription goes on.
+	r := newFakeRedis(t)
+	redisErrors := make(chan error, 1)
+	rb := NewRedisBackplane(RedisBackplaneOptions{Addr: r.ln.Addr().String(), OnError: func(err error) { redisErrors <- err }})
+	defer rb.Close()
+	received := make(chan *BackplaneMessage, 1)
+	if _, err := rb.Subscribe("chat", func(m *BackplaneMessage) { received <- m }); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := rb.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.do("PUBLISH", rb.channel("chat"), "not a message"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-redisErrors; !strings.HasPrefix(err.Error(), "redis backplane:") {
+		t.Fatalf("reported %v", err)
+	}
+	if err := rb.Publish(context.Background(), "chat", &BackplaneMessage{Type: bpHello}); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-received; m.Type != bpHello {
+		t.Fatalf("received %+v", m)
+	}
+}
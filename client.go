@@ -2,88 +2,694 @@ package reliablesocket
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"net/http"
+	"net/url"
+	"reliablesocket/events"
 	"reliablesocket/proto/webpubsub"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coder/websocket"
-	"google.golang.org/protobuf/proto"
 )
 
+const (
+	// recoveryTimeout is how long the client keeps trying to recover a dropped
+	// connection before it gives up and makes a new one (spec §1.4).
+	recoveryTimeout   = 30 * time.Second
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 5 * time.Second
+	// sessionSaveInterval is how often the sequence id received is saved
+	// when there is no SequenceAckInterval.
+	sessionSaveInterval = time.Second
+)
+
+var (
+	ErrConnectionDropped = errors.New("connection dropped before ack received")
+	ErrClientClosed      = errors.New("client closed")
+	ErrNotStarted        = errors.New("client not started")
+)
+
+// AckError is returned when the service answers an ack-ed message with
+// success set to false.
+type AckError struct {
+	AckId   int64
+	Name    string
+	Message string
+}
+
+func (e *AckError) Error() string {
+	return fmt.Sprintf("ack %d failed: %s: %s", e.AckId, e.Name, e.Message)
+}
+
+type ClientOptions struct {
+	// Endpoint is the base URI of the service, e.g. ws://127.0.0.1:1234.
+	Endpoint string
+	Hub      string
+	// AccessToken is called every time the client makes a new connection,
+	// but not when it recovers one. Leave it nil for anonymous connections.
+	AccessToken func(ctx context.Context) (string, error)
+	// Header and HTTPClient are used for the WebSocket handshake.
+	Header     http.Header
+	HTTPClient *http.Client
+	// Subprotocol defaults to ProtobufReliableSubprotocol. Any subprotocol
+	// with a registered Codec can be used.
+	Subprotocol string
+	// SequenceAckInterval batches SequenceAckMessages. Zero acks every
+	// message as soon as it is received.
+	SequenceAckInterval time.Duration
+	// SessionStore keeps the state needed to resume the connection. Defaults
+	// to an in-memory store.
+	SessionStore SessionStore
+}
+
+// StaticAccessToken returns an access token provider that always returns token.
+func StaticAccessToken(token string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		return token, nil
+	}
+}
+
 type Client struct {
+	opts           ClientOptions
+	codec          Codec
 	peerId         string
-	conn           *websocket.Conn
+	conn           *atomic.Value
 	userId         string
 	reconnectToken string
+	events.EventEmmiter[ClientEvent]
+
+	// newConnection is set until the first ConnectedMessage of a brand-new
+	// connection, so recoveries do not fire "connected" again.
+	newConnection    bool
+	disconnectReason string
+	// groups joined through JoinGroup, mapped to whether they are rejoined
+	// after a new connection.
+	groups map[string]bool
+	// groupSequences holds the largest group sequence id received from
+	// each group keeping history.
+	groupSequences map[string]int64
+
+	mu     sync.Mutex
+	ackId  *atomic.Int64
+	acks   map[int64]chan *webpubsub.DownstreamMessage_AckMessage
+	closed chan struct{}
+
+	invocationId *atomic.Int64
+	invocations  map[string]chan *webpubsub.DownstreamMessage_InvokeResponseMessage
+	// handlers answer invocations from the service, running holds the
+	// cancel functions of those in progress.
+	handlers map[string]ClientInvokeHandler
+	running  map[string]context.CancelFunc
+
+	// sequenceId is the largest sequence id received on the current
+	// connection. sequenceAcked is the largest one already acknowledged,
+	// sequenceSaved the one in the SessionStore.
+	sequenceId          int64
+	sequenceAcked       int64
+	sequenceSaved       int64
+	sequenceAckInterval time.Duration
+}
+
+func (c *Client) start() {
+	go c.readLoop()
+	go c.sequenceAckLoop()
 }
 
+// Send writes msg as is. Messages expecting an AckMessage should go through
+// SendWithAck, which numbers them after those the client sends itself.
 func (c *Client) Send(msg *webpubsub.UpstreamMessage) error {
-	data, err := proto.Marshal(msg)
+	data, err := c.codec.EncodeUpstream(msg)
 	if err != nil {
 		return err
 	}
-	return c.conn.Write(context.Background(), websocket.MessageBinary, data)
+	conn, ok := c.conn.Load().(*websocket.Conn)
+	if !ok {
+		return ErrNotStarted
+	}
+	return conn.Write(context.Background(), c.codec.FrameType(), data)
+}
+
+// SendWithAck assigns a fresh ack id to msg, sends it and waits for the
+// matching AckMessage. Messages still waiting when the connection drops fail
+// with ErrConnectionDropped.
+func (c *Client) SendWithAck(ctx context.Context, msg *webpubsub.UpstreamMessage) (*webpubsub.DownstreamMessage_AckMessage, error) {
+	id := c.ackId.Add(1)
+	if !setAckId(msg, id) {
+		return nil, fmt.Errorf("message %T does not support ack", msg.GetMessage())
+	}
+	ch := make(chan *webpubsub.DownstreamMessage_AckMessage, 1)
+	c.mu.Lock()
+	c.acks[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.acks, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.Send(msg); err != nil {
+		return nil, err
+	}
+	select {
+	case ack, ok := <-ch:
+		if !ok {
+			return nil, ErrConnectionDropped
+		}
+		if !ack.GetSuccess() {
+			return ack, &AckError{AckId: id, Name: ack.GetError().GetName(), Message: ack.GetError().GetMessage()}
+		}
+		return ack, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type JoinGroupOptions struct {
+	// NoAutoRejoin keeps the client from rejoining the group when it has to
+	// make a new connection because recovery failed.
+	NoAutoRejoin bool
+	// HistoryAfterSequenceId and HistorySince narrow the history the group
+	// replays on join, if it keeps one. By default all of it is replayed.
+	// Rejoins only ask for the messages not received yet.
+	HistoryAfterSequenceId int64
+	HistorySince           time.Time
+}
+
+func (c *Client) JoinGroup(ctx context.Context, group string) error {
+	return c.JoinGroupWithOptions(ctx, group, JoinGroupOptions{})
+}
+
+func (c *Client) JoinGroupWithOptions(ctx context.Context, group string, opts JoinGroupOptions) error {
+	msg := &webpubsub.UpstreamMessage_JoinGroupMessage{Group: group}
+	if opts.HistoryAfterSequenceId != 0 {
+		msg.HistoryAfterSequenceId = &opts.HistoryAfterSequenceId
+	}
+	if !opts.HistorySince.IsZero() {
+		since := opts.HistorySince.UnixMilli()
+		msg.HistorySince = &since
+	}
+	_, err := c.SendWithAck(ctx, &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_JoinGroupMessage_{
+		JoinGroupMessage: msg,
+	}})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.groups[group] = !opts.NoAutoRejoin
+	c.mu.Unlock()
+	c.saveSession()
+	return nil
+}
+
+func (c *Client) LeaveGroup(ctx context.Context, group string) error {
+	_, err := c.SendWithAck(ctx, &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_LeaveGroupMessage_{
+		LeaveGroupMessage: &webpubsub.UpstreamMessage_LeaveGroupMessage{Group: group},
+	}})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.groups, group)
+	delete(c.groupSequences, group)
+	c.mu.Unlock()
+	c.saveSession()
+	return nil
 }
-func (c *Client) readLoop() {
 
+// rejoinGroups joins again every group that asked for it. Group membership is
+// kept across recoveries but lost with a new connection (spec §3).
+func (c *Client) rejoinGroups() {
+	c.mu.Lock()
+	groups := map[string]JoinGroupOptions{}
+	for group, rejoin := range c.groups {
+		if rejoin {
+			groups[group] = JoinGroupOptions{HistoryAfterSequenceId: c.groupSequences[group]}
+		} else {
+			delete(c.groups, group)
+			delete(c.groupSequences, group)
+		}
+	}
+	c.mu.Unlock()
+	for group, opts := range groups {
+		go func() {
+			if err := c.JoinGroupWithOptions(context.Background(), group, opts); err != nil {
+				c.mu.Lock()
+				delete(c.groups, group)
+				delete(c.groupSequences, group)
+				c.mu.Unlock()
+				c.saveSession()
+				c.Emit("rejoingroupfailed", ClientEvent{RejoinGroupFailed: &RejoinGroupFailedEvent{Group: group, Err: err}})
+			}
+		}()
+	}
+}
+
+func (c *Client) SendToGroup(ctx context.Context, group string, data *webpubsub.MessageData, noEcho bool) error {
+	_, err := c.SendWithAck(ctx, &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_SendToGroupMessage_{
+		SendToGroupMessage: &webpubsub.UpstreamMessage_SendToGroupMessage{Group: group, Data: data, NoEcho: &noEcho},
+	}})
+	return err
+}
+
+func (c *Client) SendEvent(ctx context.Context, event string, data *webpubsub.MessageData) error {
+	_, err := c.SendWithAck(ctx, &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_EventMessage_{
+		EventMessage: &webpubsub.UpstreamMessage_EventMessage{Event: event, Data: data},
+	}})
+	return err
+}
+
+// Close stops the client. It will no longer try to recover or reconnect.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		return nil
+	default:
+		close(c.closed)
+	}
+	c.mu.Unlock()
+	c.failAcks()
+	c.cancelInvocations()
+	conn, ok := c.conn.Load().(*websocket.Conn)
+	if !ok {
+		return nil
+	}
+	return conn.Close(websocket.StatusNormalClosure, "")
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// failAcks fails every message that has not received its AckMessage yet,
+// and every invocation still waiting for its response.
+func (c *Client) failAcks() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, ch := range c.acks {
+		close(ch)
+		delete(c.acks, id)
+	}
+	for id, ch := range c.invocations {
+		close(ch)
+		delete(c.invocations, id)
+	}
+}
+
+func (c *Client) readLoop() {
+	var stopErr error
+	defer func() {
+		c.Emit("stopped", ClientEvent{Stopped: &StoppedEvent{Err: stopErr}})
+	}()
 	for {
-		typ, data, err := c.conn.Read(context.Background())
+		dropped := c.conn.Load().(*websocket.Conn)
+		err := c.readMessages(dropped)
+		// Sends until the next connection is up fail rather than vanish.
+		dropped.CloseNow()
+		c.failAcks()
+		c.mu.Lock()
+		disconnected := &DisconnectedEvent{ConnectionId: c.peerId, Reason: c.disconnectReason, Err: err}
+		c.disconnectReason = ""
+		c.mu.Unlock()
+		c.Emit("disconnected", ClientEvent{Disconnected: disconnected})
+		if c.isClosed() {
+			return
+		}
+
+		conn, err := c.reconnect(err)
 		if err != nil {
-			fmt.Println(err)
+			stopErr = err
 			return
 		}
-		fmt.Println(string(data))
-		if typ == websocket.MessageBinary {
-			var m webpubsub.DownstreamMessage
-			err := proto.Unmarshal(data, &m)
+		c.conn.Store(conn)
+		if c.isClosed() {
+			conn.Close(websocket.StatusNormalClosure, "")
+			return
+		}
+		// Tell the service right away what we already have so it can skip
+		// those messages when replaying its queue.
+		c.mu.Lock()
+		c.sequenceAcked = 0
+		c.mu.Unlock()
+		// A failure drops the connection, which the read loop handles.
+		c.sendSequenceAck()
+	}
+}
+
+func (c *Client) readMessages(conn *websocket.Conn) error {
+	for {
+		typ, data, err := conn.Read(context.Background())
+		if err != nil {
+			return err
+		}
+		if typ == c.codec.FrameType() {
+			m, err := c.codec.DecodeDownstream(data)
 			if err != nil {
-				fmt.Println(err)
-				return
+				return err
 			}
 
-			if x := m.GetSystemMessage(); x != nil {
-				fmt.Println("recive", m.GetSystemMessage())
-				c.peerId = x.GetConnectedMessage().GetConnectionId()
-				c.userId = x.GetConnectedMessage().GetUserId()
-				c.reconnectToken = x.GetConnectedMessage().GetReconnectionToken()
-
-				data, _ := json.Marshal(x.GetConnectedMessage())
-				f, _ := os.Create("token.json")
-				f.Write(data)
-				f.Close()
+			if x := m.GetSystemMessage().GetConnectedMessage(); x != nil {
+				c.mu.Lock()
+				c.peerId = x.GetConnectionId()
+				c.userId = x.GetUserId()
+				c.reconnectToken = x.GetReconnectionToken()
+				first := c.newConnection
+				c.newConnection = false
+				c.mu.Unlock()
+				c.saveSession()
+				if first {
+					c.rejoinGroups()
+					c.Emit("connected", ClientEvent{Connected: &ConnectedEvent{ConnectionId: x.GetConnectionId(), UserId: x.GetUserId()}})
+				}
+			}
+			if x := m.GetSystemMessage().GetDisconnectedMessage(); x != nil {
+				c.mu.Lock()
+				c.disconnectReason = x.GetReason()
+				c.mu.Unlock()
+			}
+			if x := m.GetSystemMessage().GetPresenceMessage(); x != nil {
+				c.Emit("presence", ClientEvent{Presence: &PresenceEvent{
+					Group:        x.GetGroup(),
+					Event:        x.GetEvent(),
+					UserId:       x.GetUserId(),
+					ConnectionId: x.GetConnectionId(),
+				}})
+			}
+			if x := m.GetAckMessage(); x != nil {
+				c.mu.Lock()
+				if ch, ok := c.acks[x.GetAckId()]; ok {
+					ch <- x
+					delete(c.acks, x.GetAckId())
+				}
+				c.mu.Unlock()
+			}
+			if x := m.GetInvokeResponseMessage(); x != nil {
+				c.resolveInvocation(x)
+			}
+			if x := m.GetInvokeMessage(); x != nil {
+				if !c.trackSequence(x.SequenceId) {
+					continue
+				}
+				go c.handleInvoke(x)
 			}
-			if m.GetAckMessage() != nil {
-				fmt.Println("recive", m.GetAckMessage())
+			if x := m.GetCancelInvocationMessage(); x != nil {
+				c.cancelInvocation(x.GetInvocationId())
 			}
-			if m.GetDataMessage() != nil {
-				fmt.Println("recive", m.GetDataMessage())
+			if x := m.GetDataMessage(); x != nil {
+				if !c.trackSequence(x.SequenceId) {
+					continue
+				}
+				if x.GroupSequenceId != nil {
+					c.mu.Lock()
+					if x.GetGroupSequenceId() > c.groupSequences[x.GetGroup()] {
+						c.groupSequences[x.GetGroup()] = x.GetGroupSequenceId()
+					}
+					c.mu.Unlock()
+				}
+				c.emitDataMessage(x)
 			}
 		}
 	}
 }
 
-func ReNewClient(peerId string, reconnectToken string) *Client {
-	conn, _, err := websocket.Dial(context.Background(), "ws://127.0.0.1:1234/client/hubs/testhub?awps_connection_id="+peerId+"&awps_reconnection_token="+reconnectToken, &websocket.DialOptions{})
-	if err != nil {
-		panic(err)
+// trackSequence records the sequence id of a data message and acknowledges
+// it, right away or on the next sequenceAckInterval tick. It reports false
+// for messages already received before a recovery, which must be dropped.
+func (c *Client) trackSequence(sequenceId *int64) bool {
+	if sequenceId == nil {
+		return true
+	}
+	id := *sequenceId
+	c.mu.Lock()
+	duplicate := id <= c.sequenceId
+	if !duplicate {
+		c.sequenceId = id
+	}
+	c.mu.Unlock()
+	if c.sequenceAckInterval <= 0 {
+		c.sendSequenceAck()
 	}
-	cli := &Client{
-		peerId: "",
-		conn:   conn,
+	return !duplicate
+}
+
+// sendSequenceAck acknowledges the largest sequence id received so far, if it
+// has not been acknowledged yet.
+func (c *Client) sendSequenceAck() error {
+	c.mu.Lock()
+	id := c.sequenceId
+	if id == 0 || id == c.sequenceAcked {
+		c.mu.Unlock()
+		return nil
 	}
-	go cli.readLoop()
-	return cli
+	c.sequenceAcked = id
+	c.mu.Unlock()
+	return c.Send(&webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_SequenceAckMessage_{
+		SequenceAckMessage: &webpubsub.UpstreamMessage_SequenceAckMessage{SequenceId: id},
+	}})
 }
-func NewClient(accessToken string) *Client {
-	conn, _, err := websocket.Dial(context.Background(), "ws://127.0.0.1:1234/client/hubs/testhub?access_token="+accessToken, &websocket.DialOptions{})
+
+// sequenceAckLoop sends the batched SequenceAckMessages, if any, and saves
+// the sequence id received on the same interval rather than on every message.
+func (c *Client) sequenceAckLoop() {
+	interval := c.sequenceAckInterval
+	if interval <= 0 {
+		interval = sessionSaveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.sequenceAckInterval > 0 {
+				c.sendSequenceAck()
+			}
+			c.mu.Lock()
+			received := c.sequenceId != c.sequenceSaved
+			c.mu.Unlock()
+			if received {
+				c.saveSession()
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// reconnect first tries to recover the dropped connection for up to
+// recoveryTimeout, unless the service closed it with 1008, and then falls
+// back to making a brand-new connection.
+func (c *Client) reconnect(cause error) (*websocket.Conn, error) {
+	c.mu.Lock()
+	peerId, token := c.peerId, c.reconnectToken
+	c.mu.Unlock()
+
+	if token != "" && websocket.CloseStatus(cause) != websocket.StatusPolicyViolation {
+		deadline := time.Now().Add(recoveryTimeout)
+		conn, err := c.retry(deadline, func() (*websocket.Conn, error) {
+			return c.recover(context.Background(), peerId, token)
+		})
+		if err == nil {
+			return conn, nil
+		}
+		if c.isClosed() {
+			return nil, ErrClientClosed
+		}
+		c.emitError(fmt.Errorf("recovery failed: %w", err))
+	}
+
+	c.resetSession()
+	return c.retry(time.Time{}, func() (*websocket.Conn, error) {
+		return c.connect(context.Background())
+	})
+}
+
+// retry calls fn with exponential backoff until it succeeds, the client is
+// closed or the deadline passes. A zero deadline retries forever.
+func (c *Client) retry(deadline time.Time, fn func() (*websocket.Conn, error)) (*websocket.Conn, error) {
+	delay := reconnectMinDelay
+	for {
+		conn, err := fn()
+		if err == nil {
+			return conn, nil
+		}
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.closed:
+			return nil, ErrClientClosed
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+}
+
+func setAckId(msg *webpubsub.UpstreamMessage, id int64) bool {
+	switch x := msg.GetMessage().(type) {
+	case *webpubsub.UpstreamMessage_JoinGroupMessage_:
+		x.JoinGroupMessage.AckId = &id
+	case *webpubsub.UpstreamMessage_LeaveGroupMessage_:
+		x.LeaveGroupMessage.AckId = &id
+	case *webpubsub.UpstreamMessage_SendToGroupMessage_:
+		x.SendToGroupMessage.AckId = &id
+	case *webpubsub.UpstreamMessage_EventMessage_:
+		x.EventMessage.AckId = &id
+	case *webpubsub.UpstreamMessage_InvokeResponseMessage_:
+		x.InvokeResponseMessage.AckId = &id
+	default:
+		return false
+	}
+	return true
+}
+
+// connect makes a brand-new connection, asking for a fresh access token.
+func (c *Client) connect(ctx context.Context) (*websocket.Conn, error) {
+	query := url.Values{}
+	if c.opts.AccessToken != nil {
+		accessToken, err := c.opts.AccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("access_token", accessToken)
+	}
+	return c.dial(ctx, query)
+}
+
+func (c *Client) recover(ctx context.Context, peerId, reconnectToken string) (*websocket.Conn, error) {
+	query := url.Values{}
+	query.Set("awps_connection_id", peerId)
+	query.Set("awps_reconnection_token", reconnectToken)
+	return c.dial(ctx, query)
+}
+
+func (c *Client) dial(ctx context.Context, query url.Values) (*websocket.Conn, error) {
+	u := strings.TrimSuffix(c.opts.Endpoint, "/") + "/client/hubs/" + url.PathEscape(c.opts.Hub) + "?" + query.Encode()
+	conn, _, err := websocket.Dial(ctx, u, &websocket.DialOptions{
+		HTTPClient:   c.opts.HTTPClient,
+		HTTPHeader:   c.opts.Header,
+		Subprotocols: []string{c.opts.Subprotocol},
+	})
+	return conn, err
+}
+
+// Start connects the client. If the SessionStore holds a session it first
+// tries to recover that connection, e.g. after a process restart, and falls
+// back to a new connection. Register event handlers before calling Start so
+// the first "connected" event is not missed.
+func (c *Client) Start(ctx context.Context) error {
+	session, err := c.opts.SessionStore.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if session != nil && session.ConnectionId != "" && session.ReconnectionToken != "" {
+		c.mu.Lock()
+		c.peerId = session.ConnectionId
+		c.userId = session.UserId
+		c.reconnectToken = session.ReconnectionToken
+		c.sequenceId = session.SequenceId
+		c.sequenceAcked = session.SequenceId
+		c.sequenceSaved = session.SequenceId
+		if session.Groups != nil {
+			c.groups = session.Groups
+		}
+		c.mu.Unlock()
+		conn, err := c.recover(ctx, session.ConnectionId, session.ReconnectionToken)
+		if err == nil {
+			c.conn.Store(conn)
+			c.start()
+			return nil
+		}
+		c.emitError(fmt.Errorf("recovery failed: %w", err))
+		c.resetSession()
+	}
+
+	c.mu.Lock()
+	c.newConnection = true
+	c.mu.Unlock()
+	conn, err := c.connect(ctx)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	c.conn.Store(conn)
+	c.start()
+	return nil
+}
+
+// resetSession forgets the connection state once it can no longer be
+// recovered. Joined groups are kept so they can be rejoined.
+func (c *Client) resetSession() {
+	c.mu.Lock()
+	c.peerId = ""
+	c.reconnectToken = ""
+	c.sequenceId = 0
+	c.sequenceAcked = 0
+	c.newConnection = true
+	c.mu.Unlock()
+	c.saveSession()
+}
+
+func (c *Client) saveSession() {
+	c.mu.Lock()
+	groups := make(map[string]bool, len(c.groups))
+	for group, rejoin := range c.groups {
+		groups[group] = rejoin
+	}
+	session := &Session{
+		ConnectionId:      c.peerId,
+		UserId:            c.userId,
+		ReconnectionToken: c.reconnectToken,
+		SequenceId:        c.sequenceId,
+		Groups:            groups,
+	}
+	c.sequenceSaved = c.sequenceId
+	c.mu.Unlock()
+	if err := c.opts.SessionStore.Save(context.Background(), session); err != nil {
+		c.emitError(fmt.Errorf("session not saved: %w", err))
+	}
+}
+
+func (c *Client) emitError(err error) {
+	c.Emit("error", ClientEvent{Error: err})
+}
+
+func NewClient(opts ClientOptions) (*Client, error) {
+	if opts.Endpoint == "" || opts.Hub == "" {
+		return nil, errors.New("endpoint and hub are required")
+	}
+	if opts.Subprotocol == "" {
+		opts.Subprotocol = ProtobufReliableSubprotocol
+	}
+	codec, ok := CodecFor(opts.Subprotocol)
+	if !ok {
+		return nil, fmt.Errorf("unsupported subprotocol %q", opts.Subprotocol)
 	}
-	cli := &Client{
-		peerId: "",
-		conn:   conn,
+	if opts.SessionStore == nil {
+		opts.SessionStore = NewMemorySessionStore()
 	}
-	go cli.readLoop()
-	return cli
+	return &Client{
+		opts:                opts,
+		codec:               codec,
+		conn:                &atomic.Value{},
+		ackId:               &atomic.Int64{},
+		acks:                map[int64]chan *webpubsub.DownstreamMessage_AckMessage{},
+		closed:              make(chan struct{}),
+		invocationId:        &atomic.Int64{},
+		invocations:         map[string]chan *webpubsub.DownstreamMessage_InvokeResponseMessage{},
+		handlers:            map[string]ClientInvokeHandler{},
+		running:             map[string]context.CancelFunc{},
+		EventEmmiter:        events.New[ClientEvent](),
+		groups:              map[string]bool{},
+		groupSequences:      map[string]int64{},
+		sequenceAckInterval: opts.SequenceAckInterval,
+	}, nil
 }
@@ -0,0 +1,177 @@
+package reliablesocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"reliablesocket/proto/webpubsub"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+type DataType string
+
+const (
+	DataTypeText     DataType = "text"
+	DataTypeJSON     DataType = "json"
+	DataTypeBinary   DataType = "binary"
+	DataTypeProtobuf DataType = "protobuf"
+)
+
+// MessageData is the decoded payload of a data message. Text holds the
+// payload of text and json data.
+type MessageData struct {
+	DataType DataType
+	Text     string
+	Binary   []byte
+	Protobuf *anypb.Any
+}
+
+func newMessageData(data *webpubsub.MessageData) MessageData {
+	switch x := data.GetData().(type) {
+	case *webpubsub.MessageData_TextData:
+		return MessageData{DataType: DataTypeText, Text: x.TextData}
+	case *webpubsub.MessageData_JsonData:
+		return MessageData{DataType: DataTypeJSON, Text: x.JsonData}
+	case *webpubsub.MessageData_BinaryData:
+		return MessageData{DataType: DataTypeBinary, Binary: x.BinaryData}
+	case *webpubsub.MessageData_ProtobufData:
+		return MessageData{DataType: DataTypeProtobuf, Protobuf: x.ProtobufData}
+	}
+	return MessageData{}
+}
+
+// Unmarshal decodes json data into v, or protobuf data into v which must
+// then be a proto.Message.
+func (d MessageData) Unmarshal(v any) error {
+	switch d.DataType {
+	case DataTypeJSON:
+		return json.Unmarshal([]byte(d.Text), v)
+	case DataTypeProtobuf:
+		m, ok := v.(proto.Message)
+		if !ok {
+			return fmt.Errorf("%T is not a proto.Message", v)
+		}
+		return d.Protobuf.UnmarshalTo(m)
+	}
+	return fmt.Errorf("cannot unmarshal %s data", d.DataType)
+}
+
+type ConnectedEvent struct {
+	ConnectionId string
+	UserId       string
+}
+
+type DisconnectedEvent struct {
+	ConnectionId string
+	// Reason is set when the service sent a DisconnectedMessage before
+	// closing the connection.
+	Reason string
+	Err    error
+}
+
+type StoppedEvent struct {
+	Err error
+}
+
+type GroupMessage struct {
+	Group      string
+	SequenceId int64
+	Data       MessageData
+	// GroupSequenceId and Time are set by groups keeping history. History
+	// is set on messages replayed on join.
+	GroupSequenceId int64
+	Time            time.Time
+	History         bool
+}
+
+type ServerMessage struct {
+	SequenceId int64
+	Data       MessageData
+}
+
+type RejoinGroupFailedEvent struct {
+	Group string
+	Err   error
+}
+
+// PresenceEvent reports a user joining or leaving a group with presence
+// enabled. Event is PresenceJoin or PresenceLeave.
+type PresenceEvent struct {
+	Group        string
+	Event        string
+	UserId       string
+	ConnectionId string
+}
+
+type ClientEvent struct {
+	Connected         *ConnectedEvent
+	Disconnected      *DisconnectedEvent
+	Stopped           *StoppedEvent
+	GroupMessage      *GroupMessage
+	ServerMessage     *ServerMessage
+	RejoinGroupFailed *RejoinGroupFailedEvent
+	Presence          *PresenceEvent
+	Error             error
+}
+
+// OnConnected is called once per new connection, never after a recovery.
+func (c *Client) OnConnected(fn func(e *ConnectedEvent)) {
+	c.On("connected", func(arg ClientEvent) { fn(arg.Connected) })
+}
+
+// OnDisconnected is called every time the transport drops.
+func (c *Client) OnDisconnected(fn func(e *DisconnectedEvent)) {
+	c.On("disconnected", func(arg ClientEvent) { fn(arg.Disconnected) })
+}
+
+// OnStopped is called once the client gives up reconnecting or is closed.
+func (c *Client) OnStopped(fn func(e *StoppedEvent)) {
+	c.On("stopped", func(arg ClientEvent) { fn(arg.Stopped) })
+}
+
+// OnError is called with the errors the client works around on its own,
+// such as a failed recovery before it makes a new connection, or a session
+// it could not save.
+func (c *Client) OnError(fn func(err error)) {
+	c.On("error", func(arg ClientEvent) { fn(arg.Error) })
+}
+
+func (c *Client) OnGroupMessage(fn func(msg *GroupMessage)) {
+	c.On("groupmessage", func(arg ClientEvent) { fn(arg.GroupMessage) })
+}
+
+func (c *Client) OnServerMessage(fn func(msg *ServerMessage)) {
+	c.On("servermessage", func(arg ClientEvent) { fn(arg.ServerMessage) })
+}
+
+func (c *Client) OnRejoinGroupFailed(fn func(e *RejoinGroupFailedEvent)) {
+	c.On("rejoingroupfailed", func(arg ClientEvent) { fn(arg.RejoinGroupFailed) })
+}
+
+func (c *Client) OnPresence(fn func(e *PresenceEvent)) {
+	c.On("presence", func(arg ClientEvent) { fn(arg.Presence) })
+}
+
+func (c *Client) emitDataMessage(msg *webpubsub.DownstreamMessage_DataMessage) {
+	data := newMessageData(msg.GetData())
+	if msg.GetFrom() == "group" {
+		e := &GroupMessage{
+			Group:           msg.GetGroup(),
+			SequenceId:      msg.GetSequenceId(),
+			Data:            data,
+			GroupSequenceId: msg.GetGroupSequenceId(),
+			History:         msg.GetHistory(),
+		}
+		if msg.Timestamp != nil {
+			e.Time = time.UnixMilli(msg.GetTimestamp())
+		}
+		c.Emit("groupmessage", ClientEvent{GroupMessage: e})
+		return
+	}
+	c.Emit("servermessage", ClientEvent{ServerMessage: &ServerMessage{
+		SequenceId: msg.GetSequenceId(),
+		Data:       data,
+	}})
+}
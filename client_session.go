@@ -0,0 +1,108 @@
+package reliablesocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// Session is the client state needed to resume a connection, for example
+// after a process restart within the service's grace window.
+type Session struct {
+	ConnectionId      string `json:"connection_id"`
+	UserId            string `json:"user_id"`
+	ReconnectionToken string `json:"reconnection_token"`
+	// SequenceId is the largest sequence id received.
+	SequenceId int64 `json:"sequence_id,omitempty"`
+	// Groups maps joined groups to whether they are rejoined after a new
+	// connection.
+	Groups map[string]bool `json:"groups,omitempty"`
+}
+
+// SessionStore persists the client Session. Load returns nil and no error
+// when nothing is stored.
+type SessionStore interface {
+	Load(ctx context.Context) (*Session, error)
+	Save(ctx context.Context, s *Session) error
+	Delete(ctx context.Context) error
+}
+
+type memorySessionStore struct {
+	mu      sync.Mutex
+	session *Session
+}
+
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{}
+}
+
+func (m *memorySessionStore) Load(ctx context.Context) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.session, nil
+}
+
+func (m *memorySessionStore) Save(ctx context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.session = s
+	return nil
+}
+
+func (m *memorySessionStore) Delete(ctx context.Context) error {
+	return m.Save(ctx, nil)
+}
+
+type fileSessionStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileSessionStore stores the session as JSON in the file at path.
+func NewFileSessionStore(path string) SessionStore {
+	return &fileSessionStore{path: path}
+}
+
+func (f *fileSessionStore) Load(ctx context.Context) (*Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (f *fileSessionStore) Save(ctx context.Context, s *Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Write to a temporary file first so a crash never leaves a torn session.
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+func (f *fileSessionStore) Delete(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := os.Remove(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,834 @@
+package reliablesocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"reliablesocket/proto/webpubsub"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestClientSendBeforeStart(t *testing.T) {
+	c, err := NewClient(ClientOptions{Endpoint: "ws://127.0.0.1:1", Hub: "chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_SequenceAckMessage_{
+		SequenceAckMessage: &webpubsub.UpstreamMessage_SequenceAckMessage{SequenceId: 1},
+	}}
+	if err := c.Send(msg); !errors.Is(err, ErrNotStarted) {
+		t.Fatalf("got %v, want ErrNotStarted", err)
+	}
+}
+
+// countingSessionStore counts the saves of a MemorySessionStore.
+type countingSessionStore struct {
+	SessionStore
+	saves atomic.Int32
+}
+
+func (s *countingSessionStore) Save(ctx context.Context, session *Session) error {
+	s.saves.Add(1)
+	return s.SessionStore.Save(ctx, session)
+}
+
+func TestClientSessionSaves(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	store := &countingSessionStore{SessionStore: NewMemorySessionStore()}
+	c, err := NewClient(ClientOptions{
+		Endpoint:     "ws" + strings.TrimPrefix(ts.URL, "http"),
+		Hub:          "chat",
+		AccessToken:  StaticAccessToken("alice"),
+		SessionStore: store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan string, 1)
+	received := make(chan struct{}, 100)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+	c.OnServerMessage(func(*ServerMessage) { received <- struct{}{} })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := <-connected
+
+	// Every message is acked right away, but the session is saved once per
+	// sessionSaveInterval.
+	before := store.saves.Load()
+	for i := 0; i < 100; i++ {
+		s.Hub("chat").SendToConnection(id, textData("hi"))
+	}
+	for i := 0; i < 100; i++ {
+		<-received
+	}
+	for {
+		session, _ := store.Load(ctx)
+		if session.SequenceId == 100 {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("sequence id %d saved, want 100", session.SequenceId)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if saves := store.saves.Load() - before; saves > 3 {
+		t.Fatalf("session saved %d times for 100 messages", saves)
+	}
+}
+
+// serveTestHub serves the hub "chat" and records the query of every
+// handshake.
+func serveTestHub(t *testing.T) (*httptest.Server, chan url.Values, *Hub) {
+	s := NewServer()
+	queries := make(chan url.Values, 16)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		s.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, queries, s.Hub("chat")
+}
+
+func newTestClient(t *testing.T, ts *httptest.Server, token string) *Client {
+	c, err := NewClient(ClientOptions{
+		Endpoint:    "ws" + strings.TrimPrefix(ts.URL, "http"),
+		Hub:         "chat",
+		AccessToken: StaticAccessToken(token),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientRecovery(t *testing.T) {
+	ts, _, hub := serveTestHub(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := newTestClient(t, ts, "alice")
+	connected := make(chan string, 2)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := <-connected
+	p, _ := hub.peers.Get(id)
+
+	// The client recovers the same connection after it drops.
+	dropped := p.conn.Load().(*websocket.Conn)
+	clientConn := c.conn.Load()
+	dropped.CloseNow()
+	for p.conn.Load().(*websocket.Conn) == dropped || p.status.Load() != peerStatusAlive || c.conn.Load() == clientConn {
+		if ctx.Err() != nil {
+			t.Fatal("not recovered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-connected:
+		t.Fatalf("connected again as %s", id)
+	default:
+	}
+}
+
+func TestClientRecoveryRejected(t *testing.T) {
+	ts, queries, _ := serveTestHub(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	store := NewMemorySessionStore()
+	store.Save(ctx, &Session{ConnectionId: "missing", ReconnectionToken: "bogus"})
+	c, err := NewClient(ClientOptions{
+		Endpoint:     "ws" + strings.TrimPrefix(ts.URL, "http"),
+		Hub:          "chat",
+		AccessToken:  StaticAccessToken("alice"),
+		SessionStore: store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan string, 1)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The service refuses the recovery with 1008: the client makes a new
+	// connection right away instead of retrying.
+	if q := <-queries; q.Get("awps_connection_id") != "missing" {
+		t.Fatalf("first handshake %v", q)
+	}
+	select {
+	case q := <-queries:
+		if q.Get("access_token") != "alice" || q.Has("awps_connection_id") {
+			t.Fatalf("second handshake %v", q)
+		}
+	case <-ctx.Done():
+		t.Fatal("no new connection")
+	}
+	select {
+	case id := <-connected:
+		if id == "missing" {
+			t.Fatal("connection recovered after 1008")
+		}
+	case <-ctx.Done():
+		t.Fatal("not connected")
+	}
+}
+
+func TestClientRetryBackoff(t *testing.T) {
+	c, err := NewClient(ClientOptions{Endpoint: "ws://127.0.0.1:1", Hub: "chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("failed")
+	var calls []time.Time
+	fail := func() (*websocket.Conn, error) {
+		calls = append(calls, time.Now())
+		return nil, failed
+	}
+
+	// The second attempt waits reconnectMinDelay, the third would wait twice
+	// as long and pass the deadline.
+	if _, err := c.retry(time.Now().Add(reconnectMinDelay*3/2), fail); err != failed {
+		t.Fatalf("got %v, want the last error", err)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("%d attempts, want 2", len(calls))
+	}
+	if d := calls[1].Sub(calls[0]); d < reconnectMinDelay {
+		t.Fatalf("retried after %v", d)
+	}
+
+	// Without a deadline it retries until the client is closed.
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.retry(time.Time{}, func() (*websocket.Conn, error) { return nil, failed })
+		done <- err
+	}()
+	close(c.closed)
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClientClosed) {
+			t.Fatalf("got %v, want ErrClientClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still retrying after Close")
+	}
+}
+
+// fakeService accepts client connections and lets the test script both
+// sides of the protobuf reliable subprotocol.
+type fakeService struct {
+	*httptest.Server
+	t     *testing.T
+	conns chan *fakeConn
+
+	mu       sync.Mutex
+	down     bool
+	accepted []*websocket.Conn
+}
+
+type fakeConn struct {
+	t     *testing.T
+	conn  *websocket.Conn
+	query url.Values
+	codec Codec
+}
+
+func newFakeService(t *testing.T) *fakeService {
+	codec, _ := CodecFor(ProtobufReliableSubprotocol)
+	s := &fakeService{t: t, conns: make(chan *fakeConn, 4)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.down {
+			http.Error(w, "shut down", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{ProtobufReliableSubprotocol}})
+		if err != nil {
+			return
+		}
+		s.accepted = append(s.accepted, conn)
+		s.conns <- &fakeConn{t: t, conn: conn, query: r.URL.Query(), codec: codec}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeService) accept() *fakeConn {
+	s.t.Helper()
+	select {
+	case c := <-s.conns:
+		return c
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("no connection")
+	}
+	return nil
+}
+
+// shutdown drops every connection and refuses new ones, so closing the
+// client does not wait for a close handshake nobody answers.
+func (s *fakeService) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = true
+	for _, conn := range s.accepted {
+		conn.CloseNow()
+	}
+}
+
+func (c *fakeConn) send(msg *webpubsub.DownstreamMessage) {
+	c.t.Helper()
+	data, err := c.codec.EncodeDownstream(msg)
+	if err == nil {
+		err = c.conn.Write(context.Background(), c.codec.FrameType(), data)
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *fakeConn) sendConnected(id, token string) {
+	c.send(&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+		Message: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage_{ConnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage{
+			ConnectionId:      id,
+			ReconnectionToken: token,
+		}},
+	}}})
+}
+
+func (c *fakeConn) sendText(sequenceId int64, text string) {
+	c.send(&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_DataMessage_{DataMessage: &webpubsub.DownstreamMessage_DataMessage{
+		From:       "server",
+		Data:       textData(text),
+		SequenceId: &sequenceId,
+	}}})
+}
+
+func (c *fakeConn) read() *webpubsub.UpstreamMessage {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, data, err := c.conn.Read(ctx)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	msg, err := c.codec.DecodeUpstream(data)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// ackJoin answers the JoinGroupMessage for group with a failure if errMsg
+// is set.
+func (c *fakeConn) ackJoin(group string, errMsg *webpubsub.DownstreamMessage_AckMessage_ErrorMessage) {
+	c.t.Helper()
+	join := c.read().GetJoinGroupMessage()
+	if join.GetGroup() != group {
+		c.t.Fatalf("got join %v, want %s", join, group)
+	}
+	c.send(&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_AckMessage_{AckMessage: &webpubsub.DownstreamMessage_AckMessage{
+		AckId:   join.GetAckId(),
+		Success: errMsg == nil,
+		Error:   errMsg,
+	}}})
+}
+
+func (c *fakeConn) readSequenceAck(want int64) {
+	c.t.Helper()
+	if got := c.read().GetSequenceAckMessage(); got == nil || got.GetSequenceId() != want {
+		c.t.Fatalf("got ack %v, want %d", got, want)
+	}
+}
+
+func TestClientSequenceAck(t *testing.T) {
+	s := newFakeService(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := NewClient(ClientOptions{Endpoint: "ws" + strings.TrimPrefix(s.URL, "http"), Hub: "chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, 8)
+	c.OnServerMessage(func(msg *ServerMessage) { messages <- msg.Data.Text })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer s.shutdown()
+
+	conn := s.accept()
+	conn.sendConnected("conn1", "token1")
+	for i := int64(1); i <= 3; i++ {
+		conn.sendText(i, strconv.FormatInt(i, 10))
+		conn.readSequenceAck(i)
+	}
+
+	// After a recovery the client first tells what it has, and drops the
+	// messages the service replays anyway.
+	conn.conn.CloseNow()
+	conn = s.accept()
+	if conn.query.Get("awps_connection_id") != "conn1" || conn.query.Get("awps_reconnection_token") != "token1" {
+		t.Fatalf("recovered with %v", conn.query)
+	}
+	conn.readSequenceAck(3)
+	for i := int64(2); i <= 4; i++ {
+		conn.sendText(i, strconv.FormatInt(i, 10))
+	}
+	conn.readSequenceAck(4)
+	for _, want := range []string{"1", "2", "3", "4"} {
+		select {
+		case got := <-messages:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%q not received", want)
+		}
+	}
+	select {
+	case got := <-messages:
+		t.Fatalf("got %q again", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClientSequenceAckInterval(t *testing.T) {
+	s := newFakeService(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := NewClient(ClientOptions{
+		Endpoint:            "ws" + strings.TrimPrefix(s.URL, "http"),
+		Hub:                 "chat",
+		SequenceAckInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer s.shutdown()
+
+	// Messages received within an interval are acknowledged at once.
+	conn := s.accept()
+	conn.sendConnected("conn1", "token1")
+	for i := int64(1); i <= 10; i++ {
+		conn.sendText(i, "hi")
+	}
+	conn.readSequenceAck(10)
+}
+
+func TestClientOptions(t *testing.T) {
+	for _, opts := range []ClientOptions{
+		{Hub: "chat"},
+		{Endpoint: "ws://127.0.0.1:1"},
+		{Endpoint: "ws://127.0.0.1:1", Hub: "chat", Subprotocol: "unknown"},
+	} {
+		if _, err := NewClient(opts); err == nil {
+			t.Fatalf("%+v accepted", opts)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	failing, _ := NewClient(ClientOptions{
+		Endpoint:    "ws://127.0.0.1:1",
+		Hub:         "chat",
+		AccessToken: func(ctx context.Context) (string, error) { return "", errors.New("signed out") },
+	})
+	if err := failing.Start(ctx); err == nil || err.Error() != "signed out" {
+		t.Fatalf("started with %v", err)
+	}
+
+	s := NewServer()
+	requests := make(chan ConnectRequest, 4)
+	s.OnConnect = func(ctx context.Context, req ConnectRequest) (ConnectResponse, error) {
+		requests <- req
+		return ConnectResponse{}, nil
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	var tokens, dials atomic.Int32
+	c, err := NewClient(ClientOptions{
+		Endpoint: "ws" + strings.TrimPrefix(ts.URL, "http"),
+		Hub:      "chat",
+		AccessToken: func(ctx context.Context) (string, error) {
+			tokens.Add(1)
+			return "alice", nil
+		},
+		Header:      http.Header{"X-Tenant": {"contoso"}},
+		HTTPClient:  &http.Client{Transport: countingTransport{&dials}},
+		Subprotocol: JSONReliableSubprotocol,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan string, 2)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := <-connected
+	req := <-requests
+	if req.Headers.Get("X-Tenant") != "contoso" || len(req.Subprotocols) != 1 || req.Subprotocols[0] != JSONReliableSubprotocol {
+		t.Fatalf("connected with %+v", req)
+	}
+
+	// Recovering does not ask for a token; a new connection does.
+	p, _ := s.Hub("chat").peers.Get(id)
+	dropped := p.conn.Load().(*websocket.Conn)
+	dropped.CloseNow()
+	for p.conn.Load().(*websocket.Conn) == dropped {
+		if ctx.Err() != nil {
+			t.Fatal("not recovered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := tokens.Load(); n != 1 {
+		t.Fatalf("%d tokens asked for after a recovery", n)
+	}
+	s.Hub("chat").CloseConnection(id, "kicked")
+	<-connected
+	if n := tokens.Load(); n != 2 {
+		t.Fatalf("%d tokens asked for after a new connection", n)
+	}
+	if n := dials.Load(); n != 3 {
+		t.Fatalf("HTTPClient used for %d of 3 handshakes", n)
+	}
+}
+
+// countingTransport counts the requests made through http.DefaultTransport.
+type countingTransport struct {
+	n *atomic.Int32
+}
+
+func (t countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.n.Add(1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestClientEvents(t *testing.T) {
+	ts, _, hub := serveTestHub(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := newTestClient(t, ts, "alice")
+	connected := make(chan *ConnectedEvent, 1)
+	serverMessages := make(chan *ServerMessage, 1)
+	groupMessages := make(chan *GroupMessage, 1)
+	var order []string
+	var orderMu sync.Mutex
+	stopped := make(chan *StoppedEvent, 1)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e })
+	c.OnServerMessage(func(msg *ServerMessage) { serverMessages <- msg })
+	c.OnGroupMessage(func(msg *GroupMessage) { groupMessages <- msg })
+	c.OnDisconnected(func(e *DisconnectedEvent) {
+		orderMu.Lock()
+		order = append(order, "disconnected")
+		orderMu.Unlock()
+	})
+	c.OnStopped(func(e *StoppedEvent) {
+		orderMu.Lock()
+		order = append(order, "stopped")
+		orderMu.Unlock()
+		stopped <- e
+	})
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	e := <-connected
+	if e.UserId != "alice" || !hub.ConnectionExists(e.ConnectionId) {
+		t.Fatalf("connected as %+v", e)
+	}
+
+	type point struct{ X, Y int }
+	hub.SendToConnection(e.ConnectionId, &webpubsub.MessageData{Data: &webpubsub.MessageData_JsonData{JsonData: `{"X":1,"Y":2}`}})
+	msg := <-serverMessages
+	var pt point
+	if err := msg.Data.Unmarshal(&pt); err != nil || pt != (point{1, 2}) || msg.SequenceId != 1 {
+		t.Fatalf("got %+v, %v from %+v", pt, err, msg)
+	}
+
+	// Messages a client sends to a group it is in come back as group
+	// messages unless noEcho is set.
+	if err := c.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendToGroup(ctx, "room", &webpubsub.MessageData{Data: &webpubsub.MessageData_BinaryData{BinaryData: []byte{1, 2}}}, false); err != nil {
+		t.Fatal(err)
+	}
+	gm := <-groupMessages
+	if gm.Group != "room" || gm.Data.DataType != DataTypeBinary || string(gm.Data.Binary) != "\x01\x02" {
+		t.Fatalf("got %+v", gm)
+	}
+	if err := gm.Data.Unmarshal(&pt); err == nil {
+		t.Fatal("binary data unmarshalled")
+	}
+
+	c.Close()
+	select {
+	case e := <-stopped:
+		if e.Err != nil {
+			t.Fatalf("stopped with %v", e.Err)
+		}
+	case <-ctx.Done():
+		t.Fatal("not stopped")
+	}
+	orderMu.Lock()
+	defer orderMu.Unlock()
+	if len(order) != 2 || order[0] != "disconnected" {
+		t.Fatalf("got events %v", order)
+	}
+}
+
+func TestClientRejoinGroups(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	hub := s.Hub("chat")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := newTestClient(t, ts, "alice")
+	connected := make(chan string, 2)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+	c.OnRejoinGroupFailed(func(e *RejoinGroupFailedEvent) { t.Errorf("rejoining %s failed: %v", e.Group, e.Err) })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := <-connected
+	if err := c.JoinGroup(ctx, "rejoined"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.JoinGroupWithOptions(ctx, "left", JoinGroupOptions{NoAutoRejoin: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new connection starts without groups; the client joins back only
+	// those that asked for it.
+	hub.CloseConnection(id, "kicked")
+	newId := <-connected
+	for !isMember(hub, "rejoined", newId) {
+		if ctx.Err() != nil {
+			t.Fatal("group not rejoined")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if isMember(hub, "left", newId) {
+		t.Fatal("NoAutoRejoin group rejoined")
+	}
+}
+
+func isMember(h *Hub, groupId, connectionId string) bool {
+	for _, p := range h.GroupMembers(groupId) {
+		if p.PeerId == connectionId {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClientRejoinGroupFailed(t *testing.T) {
+	s := newFakeService(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := NewClient(ClientOptions{Endpoint: "ws" + strings.TrimPrefix(s.URL, "http"), Hub: "chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := make(chan *RejoinGroupFailedEvent, 1)
+	c.OnRejoinGroupFailed(func(e *RejoinGroupFailedEvent) { failed <- e })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer s.shutdown()
+
+	conn := s.accept()
+	conn.sendConnected("conn1", "token1")
+	joined := make(chan error, 1)
+	go func() { joined <- c.JoinGroup(ctx, "room") }()
+	conn.ackJoin("room", nil)
+	if err := <-joined; err != nil {
+		t.Fatal(err)
+	}
+	groupSequenceId := int64(5)
+	conn.send(&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_DataMessage_{DataMessage: &webpubsub.DownstreamMessage_DataMessage{
+		From:            "group",
+		Group:           ptr("room"),
+		Data:            textData("hi"),
+		SequenceId:      ptr[int64](1),
+		GroupSequenceId: &groupSequenceId,
+	}}})
+	conn.readSequenceAck(1)
+
+	conn.conn.Close(websocket.StatusPolicyViolation, "kicked")
+	conn = s.accept()
+	conn.sendConnected("conn2", "token2")
+	conn.ackJoin("room", &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: "Forbidden", Message: "no access"})
+	select {
+	case e := <-failed:
+		var ackErr *AckError
+		if e.Group != "room" || !errors.As(e.Err, &ackErr) || ackErr.Name != "Forbidden" {
+			t.Fatalf("got %+v", e)
+		}
+	case <-ctx.Done():
+		t.Fatal("no rejoingroupfailed event")
+	}
+	// A group that could not be rejoined is forgotten, along with its
+	// history position.
+	c.mu.Lock()
+	_, kept := c.groupSequences["room"]
+	c.mu.Unlock()
+	if kept {
+		t.Fatal("group sequence id kept")
+	}
+	conn.conn.Close(websocket.StatusPolicyViolation, "kicked")
+	conn = s.accept()
+	conn.sendConnected("conn3", "token3")
+	conn.sendText(1, "hi")
+	if msg := conn.read(); msg.GetJoinGroupMessage() != nil {
+		t.Fatalf("rejoined %s again", msg.GetJoinGroupMessage().GetGroup())
+	}
+}
+
+func TestSessionStores(t *testing.T) {
+	ctx := context.Background()
+	stores := map[string]SessionStore{
+		"memory": NewMemorySessionStore(),
+		"file":   NewFileSessionStore(filepath.Join(t.TempDir(), "session.json")),
+	}
+	for name, store := range stores {
+		if s, err := store.Load(ctx); s != nil || err != nil {
+			t.Fatalf("%s: empty store loaded %+v, %v", name, s, err)
+		}
+		want := &Session{ConnectionId: "conn1", UserId: "alice", ReconnectionToken: "token", SequenceId: 7, Groups: map[string]bool{"room": true}}
+		if err := store.Save(ctx, want); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := store.Load(ctx); err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: loaded %+v, %v", name, got, err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := store.Delete(ctx); err != nil {
+				t.Fatalf("%s: delete %d: %v", name, i, err)
+			}
+		}
+		if s, err := store.Load(ctx); s != nil || err != nil {
+			t.Fatalf("%s: deleted store loaded %+v, %v", name, s, err)
+		}
+	}
+}
+
+// failingTransport fails every request once down is set.
+type failingTransport struct {
+	down *atomic.Bool
+}
+
+func (t failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.down.Load() {
+		return nil, errors.New("process stopped")
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestClientResumeSession(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	hub := s.Hub("chat")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "session.json")
+	newClient := func(down *atomic.Bool) *Client {
+		c, err := NewClient(ClientOptions{
+			Endpoint:     "ws" + strings.TrimPrefix(ts.URL, "http"),
+			Hub:          "chat",
+			AccessToken:  StaticAccessToken("alice"),
+			HTTPClient:   &http.Client{Transport: failingTransport{down}},
+			SessionStore: NewFileSessionStore(path),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	var stopped atomic.Bool
+	first := newClient(&stopped)
+	connected := make(chan string, 1)
+	received := make(chan string, 1)
+	first.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+	first.OnServerMessage(func(msg *ServerMessage) { received <- msg.Data.Text })
+	if err := first.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	id := <-connected
+	if err := first.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	hub.SendToConnection(id, textData("before"))
+	<-received
+	store := NewFileSessionStore(path)
+	for {
+		session, _ := store.Load(ctx)
+		if session.SequenceId == 1 {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal("sequence id not saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The process stops without closing the connection; a new one resumes it
+	// from the stored session.
+	stopped.Store(true)
+	first.conn.Load().(*websocket.Conn).CloseNow()
+	hub.SendToGroup("room", textData("during"))
+	second := newClient(&atomic.Bool{})
+	second.OnConnected(func(e *ConnectedEvent) { t.Errorf("connected again as %s", e.ConnectionId) })
+	messages := make(chan *ServerMessage, 2)
+	second.OnServerMessage(func(msg *ServerMessage) { messages <- msg })
+	if err := second.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	select {
+	case msg := <-messages:
+		if msg.Data.Text != "during" || msg.SequenceId != 2 {
+			t.Fatalf("got %q, sequence id %d", msg.Data.Text, msg.SequenceId)
+		}
+	case <-ctx.Done():
+		t.Fatal("queued message not received")
+	}
+	if !isMember(hub, "room", id) {
+		t.Fatal("group membership lost")
+	}
+}
@@ -0,0 +1,118 @@
+package reliablesocket
+
+import (
+	"reliablesocket/proto/webpubsub"
+	"strings"
+	"sync"
+
+	"github.com/coder/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ProtobufReliableSubprotocol = "protobuf.reliable.webpubsub.azure.v1"
+	ProtobufSubprotocol         = "protobuf.webpubsub.azure.v1"
+	JSONReliableSubprotocol     = "json.reliable.webpubsub.azure.v1"
+	JSONSubprotocol             = "json.webpubsub.azure.v1"
+	MsgpackReliableSubprotocol  = "msgpack.reliable.webpubsub.v1"
+)
+
+// Codec translates between the wire format of a subprotocol and webpubsub
+// messages, so Peer and Client never deal with a wire format directly.
+type Codec interface {
+	// Subprotocol is the WebSocket subprotocol the codec is registered for.
+	Subprotocol() string
+	// Reliable reports whether connections get a reconnection token,
+	// sequence ids and a grace window to recover.
+	Reliable() bool
+	// FrameType is the WebSocket message type every frame is sent with.
+	FrameType() websocket.MessageType
+	EncodeUpstream(msg *webpubsub.UpstreamMessage) ([]byte, error)
+	DecodeUpstream(data []byte) (*webpubsub.UpstreamMessage, error)
+	EncodeDownstream(msg *webpubsub.DownstreamMessage) ([]byte, error)
+	DecodeDownstream(data []byte) (*webpubsub.DownstreamMessage, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+	// subprotocols are negotiated by the server in registration order.
+	subprotocols []string
+)
+
+func init() {
+	RegisterCodec(protobufCodec{subprotocol: ProtobufReliableSubprotocol, reliable: true})
+	RegisterCodec(jsonCodec{subprotocol: JSONReliableSubprotocol, reliable: true})
+	RegisterCodec(protobufCodec{subprotocol: ProtobufSubprotocol})
+	RegisterCodec(jsonCodec{subprotocol: JSONSubprotocol})
+	RegisterCodec(msgpackCodec{subprotocol: MsgpackReliableSubprotocol, reliable: true})
+}
+
+// RegisterCodec makes a subprotocol available to the server and the Client.
+// Registering a codec for a subprotocol that already has one replaces it.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	name := strings.ToLower(c.Subprotocol())
+	if _, ok := codecs[name]; !ok {
+		subprotocols = append(subprotocols, c.Subprotocol())
+	}
+	codecs[name] = c
+}
+
+// CodecFor returns the codec registered for subprotocol.
+func CodecFor(subprotocol string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[strings.ToLower(subprotocol)]
+	return c, ok
+}
+
+// Subprotocols lists the registered subprotocols in registration order.
+// Connections that negotiate none of them are simple WebSocket clients.
+func Subprotocols() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return append([]string(nil), subprotocols...)
+}
+
+type protobufCodec struct {
+	subprotocol string
+	reliable    bool
+}
+
+func (c protobufCodec) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c protobufCodec) Reliable() bool {
+	return c.reliable
+}
+
+func (protobufCodec) FrameType() websocket.MessageType {
+	return websocket.MessageBinary
+}
+
+func (protobufCodec) EncodeUpstream(msg *webpubsub.UpstreamMessage) ([]byte, error) {
+	return proto.Marshal(msg)
+}
+
+func (protobufCodec) DecodeUpstream(data []byte) (*webpubsub.UpstreamMessage, error) {
+	var m webpubsub.UpstreamMessage
+	if err := proto.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (protobufCodec) EncodeDownstream(msg *webpubsub.DownstreamMessage) ([]byte, error) {
+	return proto.Marshal(msg)
+}
+
+func (protobufCodec) DecodeDownstream(data []byte) (*webpubsub.DownstreamMessage, error) {
+	var m webpubsub.DownstreamMessage
+	if err := proto.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,444 @@
+package reliablesocket
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reliablesocket/proto/webpubsub"
+
+	"github.com/coder/websocket"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// jsonMessage carries every field used by the JSON subprotocols, see
+// https://learn.microsoft.com/azure/azure-web-pubsub/reference-json-reliable-webpubsub-subprotocol
+type jsonMessage struct {
+	Type              string          `json:"type"`
+	Event             string          `json:"event,omitempty"`
+	Group             *string         `json:"group,omitempty"`
+	AckId             *int64          `json:"ackId,omitempty"`
+	NoEcho            *bool           `json:"noEcho,omitempty"`
+	Success           *bool           `json:"success,omitempty"`
+	Error             *jsonAckError   `json:"error,omitempty"`
+	SequenceId        *int64          `json:"sequenceId,omitempty"`
+	From              string          `json:"from,omitempty"`
+	DataType          DataType        `json:"dataType,omitempty"`
+	Data              json.RawMessage `json:"data,omitempty"`
+	UserId            string          `json:"userId,omitempty"`
+	ConnectionId      string          `json:"connectionId,omitempty"`
+	ReconnectionToken string          `json:"reconnectionToken,omitempty"`
+	Message           string          `json:"message,omitempty"`
+	InvocationId      string          `json:"invocationId,omitempty"`
+	Target            string          `json:"target,omitempty"`
+	Action            string          `json:"action,omitempty"`
+	// History fields of joinGroup and group messages.
+	HistoryAfter    *int64 `json:"historyAfterSequenceId,omitempty"`
+	HistorySince    *int64 `json:"historySince,omitempty"`
+	GroupSequenceId *int64 `json:"groupSequenceId,omitempty"`
+	Timestamp       *int64 `json:"timestamp,omitempty"`
+	History         bool   `json:"history,omitempty"`
+}
+
+type jsonAckError struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+type jsonCodec struct {
+	subprotocol string
+	reliable    bool
+}
+
+func (c jsonCodec) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c jsonCodec) Reliable() bool {
+	return c.reliable
+}
+
+func (jsonCodec) FrameType() websocket.MessageType {
+	return websocket.MessageText
+}
+
+func (jsonCodec) EncodeUpstream(msg *webpubsub.UpstreamMessage) ([]byte, error) {
+	var m jsonMessage
+	switch x := msg.GetMessage().(type) {
+	case *webpubsub.UpstreamMessage_JoinGroupMessage_:
+		m = jsonMessage{
+			Type:         "joinGroup",
+			Group:        &x.JoinGroupMessage.Group,
+			AckId:        x.JoinGroupMessage.AckId,
+			HistoryAfter: x.JoinGroupMessage.HistoryAfterSequenceId,
+			HistorySince: x.JoinGroupMessage.HistorySince,
+		}
+	case *webpubsub.UpstreamMessage_LeaveGroupMessage_:
+		m = jsonMessage{Type: "leaveGroup", Group: &x.LeaveGroupMessage.Group, AckId: x.LeaveGroupMessage.AckId}
+	case *webpubsub.UpstreamMessage_SendToGroupMessage_:
+		dataType, data, err := encodeJSONData(x.SendToGroupMessage.GetData())
+		if err != nil {
+			return nil, err
+		}
+		m = jsonMessage{
+			Type:     "sendToGroup",
+			Group:    &x.SendToGroupMessage.Group,
+			AckId:    x.SendToGroupMessage.AckId,
+			NoEcho:   x.SendToGroupMessage.NoEcho,
+			DataType: dataType,
+			Data:     data,
+		}
+	case *webpubsub.UpstreamMessage_EventMessage_:
+		dataType, data, err := encodeJSONData(x.EventMessage.GetData())
+		if err != nil {
+			return nil, err
+		}
+		m = jsonMessage{Type: "event", Event: x.EventMessage.GetEvent(), AckId: x.EventMessage.AckId, DataType: dataType, Data: data}
+	case *webpubsub.UpstreamMessage_SequenceAckMessage_:
+		m = jsonMessage{Type: "sequenceAck", SequenceId: &x.SequenceAckMessage.SequenceId}
+	case *webpubsub.UpstreamMessage_InvokeMessage_:
+		dataType, data, err := encodeJSONData(x.InvokeMessage.GetData())
+		if err != nil {
+			return nil, err
+		}
+		m = jsonMessage{
+			Type:         "invoke",
+			InvocationId: x.InvokeMessage.GetInvocationId(),
+			Target:       x.InvokeMessage.GetTarget(),
+			DataType:     dataType,
+			Data:         data,
+		}
+	case *webpubsub.UpstreamMessage_CancelInvocationMessage_:
+		m = jsonMessage{Type: "cancelInvocation", InvocationId: x.CancelInvocationMessage.GetInvocationId()}
+	case *webpubsub.UpstreamMessage_InvokeResponseMessage_:
+		r := x.InvokeResponseMessage
+		dataType, data, err := encodeJSONData(r.GetData())
+		if err != nil {
+			return nil, err
+		}
+		success := r.GetSuccess()
+		m = jsonMessage{Type: "invokeResponse", InvocationId: r.GetInvocationId(), AckId: r.AckId, Success: &success, DataType: dataType, Data: data}
+		if e := r.Error; e != nil {
+			m.Error = &jsonAckError{Name: e.GetName(), Message: e.GetMessage()}
+		}
+	default:
+		return nil, fmt.Errorf("unknown upstream message %T", x)
+	}
+	return json.Marshal(m)
+}
+
+func (jsonCodec) DecodeUpstream(data []byte) (*webpubsub.UpstreamMessage, error) {
+	var m jsonMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	switch m.Type {
+	case "joinGroup":
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_JoinGroupMessage_{
+			JoinGroupMessage: &webpubsub.UpstreamMessage_JoinGroupMessage{
+				Group:                  m.group(),
+				AckId:                  m.AckId,
+				HistoryAfterSequenceId: m.HistoryAfter,
+				HistorySince:           m.HistorySince,
+			},
+		}}, nil
+	case "leaveGroup":
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_LeaveGroupMessage_{
+			LeaveGroupMessage: &webpubsub.UpstreamMessage_LeaveGroupMessage{Group: m.group(), AckId: m.AckId},
+		}}, nil
+	case "sendToGroup":
+		d, err := decodeJSONData(m.DataType, m.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_SendToGroupMessage_{
+			SendToGroupMessage: &webpubsub.UpstreamMessage_SendToGroupMessage{Group: m.group(), AckId: m.AckId, NoEcho: m.NoEcho, Data: d},
+		}}, nil
+	case "event":
+		d, err := decodeJSONData(m.DataType, m.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_EventMessage_{
+			EventMessage: &webpubsub.UpstreamMessage_EventMessage{Event: m.Event, AckId: m.AckId, Data: d},
+		}}, nil
+	case "sequenceAck":
+		var id int64
+		if m.SequenceId != nil {
+			id = *m.SequenceId
+		}
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_SequenceAckMessage_{
+			SequenceAckMessage: &webpubsub.UpstreamMessage_SequenceAckMessage{SequenceId: id},
+		}}, nil
+	case "invoke":
+		d, err := decodeJSONData(m.DataType, m.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_InvokeMessage_{
+			InvokeMessage: &webpubsub.UpstreamMessage_InvokeMessage{InvocationId: m.InvocationId, Target: m.Target, Data: d},
+		}}, nil
+	case "cancelInvocation":
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_CancelInvocationMessage_{
+			CancelInvocationMessage: &webpubsub.UpstreamMessage_CancelInvocationMessage{InvocationId: m.InvocationId},
+		}}, nil
+	case "invokeResponse":
+		d, err := decodeJSONData(m.DataType, m.Data)
+		if err != nil {
+			return nil, err
+		}
+		r := &webpubsub.UpstreamMessage_InvokeResponseMessage{InvocationId: m.InvocationId, AckId: m.AckId, Data: d}
+		if m.Success != nil {
+			r.Success = *m.Success
+		}
+		if m.Error != nil {
+			r.Error = &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: m.Error.Name, Message: m.Error.Message}
+		}
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_InvokeResponseMessage_{InvokeResponseMessage: r}}, nil
+	}
+	return nil, fmt.Errorf("unknown message type %q", m.Type)
+}
+
+func (jsonCodec) EncodeDownstream(msg *webpubsub.DownstreamMessage) ([]byte, error) {
+	var m jsonMessage
+	switch x := msg.GetMessage().(type) {
+	case *webpubsub.DownstreamMessage_AckMessage_:
+		ackId, success := x.AckMessage.GetAckId(), x.AckMessage.GetSuccess()
+		m = jsonMessage{Type: "ack", AckId: &ackId, Success: &success}
+		if e := x.AckMessage.Error; e != nil {
+			m.Error = &jsonAckError{Name: e.GetName(), Message: e.GetMessage()}
+		}
+	case *webpubsub.DownstreamMessage_DataMessage_:
+		dataType, data, err := encodeJSONData(x.DataMessage.GetData())
+		if err != nil {
+			return nil, err
+		}
+		m = jsonMessage{
+			Type:            "message",
+			From:            x.DataMessage.GetFrom(),
+			Group:           x.DataMessage.Group,
+			SequenceId:      x.DataMessage.SequenceId,
+			DataType:        dataType,
+			Data:            data,
+			GroupSequenceId: x.DataMessage.GroupSequenceId,
+			Timestamp:       x.DataMessage.Timestamp,
+			History:         x.DataMessage.GetHistory(),
+		}
+	case *webpubsub.DownstreamMessage_SystemMessage_:
+		switch y := x.SystemMessage.GetMessage().(type) {
+		case *webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage_:
+			m = jsonMessage{
+				Type:              "system",
+				Event:             "connected",
+				UserId:            y.ConnectedMessage.GetUserId(),
+				ConnectionId:      y.ConnectedMessage.GetConnectionId(),
+				ReconnectionToken: y.ConnectedMessage.GetReconnectionToken(),
+			}
+		case *webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage_:
+			m = jsonMessage{Type: "system", Event: "disconnected", Message: y.DisconnectedMessage.GetReason()}
+		case *webpubsub.DownstreamMessage_SystemMessage_PresenceMessage_:
+			m = jsonMessage{
+				Type:         "system",
+				Event:        "presence",
+				Group:        &y.PresenceMessage.Group,
+				Action:       y.PresenceMessage.GetEvent(),
+				UserId:       y.PresenceMessage.GetUserId(),
+				ConnectionId: y.PresenceMessage.GetConnectionId(),
+			}
+		default:
+			return nil, fmt.Errorf("unknown system message %T", y)
+		}
+	case *webpubsub.DownstreamMessage_InvokeResponseMessage_:
+		r := x.InvokeResponseMessage
+		dataType, data, err := encodeJSONData(r.GetData())
+		if err != nil {
+			return nil, err
+		}
+		success := r.GetSuccess()
+		m = jsonMessage{Type: "invokeResponse", InvocationId: r.GetInvocationId(), Success: &success, DataType: dataType, Data: data}
+		if e := r.Error; e != nil {
+			m.Error = &jsonAckError{Name: e.GetName(), Message: e.GetMessage()}
+		}
+	case *webpubsub.DownstreamMessage_InvokeMessage_:
+		dataType, data, err := encodeJSONData(x.InvokeMessage.GetData())
+		if err != nil {
+			return nil, err
+		}
+		m = jsonMessage{
+			Type:         "invoke",
+			InvocationId: x.InvokeMessage.GetInvocationId(),
+			Target:       x.InvokeMessage.GetTarget(),
+			SequenceId:   x.InvokeMessage.SequenceId,
+			DataType:     dataType,
+			Data:         data,
+		}
+	case *webpubsub.DownstreamMessage_CancelInvocationMessage_:
+		m = jsonMessage{Type: "cancelInvocation", InvocationId: x.CancelInvocationMessage.GetInvocationId()}
+	default:
+		return nil, fmt.Errorf("unknown downstream message %T", x)
+	}
+	return json.Marshal(m)
+}
+
+func (jsonCodec) DecodeDownstream(data []byte) (*webpubsub.DownstreamMessage, error) {
+	var m jsonMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	switch m.Type {
+	case "ack":
+		ack := &webpubsub.DownstreamMessage_AckMessage{}
+		if m.AckId != nil {
+			ack.AckId = *m.AckId
+		}
+		if m.Success != nil {
+			ack.Success = *m.Success
+		}
+		if m.Error != nil {
+			ack.Error = &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: m.Error.Name, Message: m.Error.Message}
+		}
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_AckMessage_{AckMessage: ack}}, nil
+	case "message":
+		d, err := decodeJSONData(m.DataType, m.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_DataMessage_{DataMessage: &webpubsub.DownstreamMessage_DataMessage{
+			From:            m.From,
+			Group:           m.Group,
+			Data:            d,
+			SequenceId:      m.SequenceId,
+			GroupSequenceId: m.GroupSequenceId,
+			Timestamp:       m.Timestamp,
+			History:         m.History,
+		}}}, nil
+	case "system":
+		switch m.Event {
+		case "connected":
+			return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+				Message: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage_{ConnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage{
+					ConnectionId:      m.ConnectionId,
+					UserId:            m.UserId,
+					ReconnectionToken: m.ReconnectionToken,
+				}},
+			}}}, nil
+		case "disconnected":
+			return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+				Message: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage_{DisconnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage{
+					Reason: m.Message,
+				}},
+			}}}, nil
+		case "presence":
+			return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+				Message: &webpubsub.DownstreamMessage_SystemMessage_PresenceMessage_{PresenceMessage: &webpubsub.DownstreamMessage_SystemMessage_PresenceMessage{
+					Group:        m.group(),
+					Event:        m.Action,
+					UserId:       m.UserId,
+					ConnectionId: m.ConnectionId,
+				}},
+			}}}, nil
+		}
+		return nil, fmt.Errorf("unknown system event %q", m.Event)
+	case "invokeResponse":
+		d, err := decodeJSONData(m.DataType, m.Data)
+		if err != nil {
+			return nil, err
+		}
+		r := &webpubsub.DownstreamMessage_InvokeResponseMessage{InvocationId: m.InvocationId, Data: d}
+		if m.Success != nil {
+			r.Success = *m.Success
+		}
+		if m.Error != nil {
+			r.Error = &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: m.Error.Name, Message: m.Error.Message}
+		}
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_InvokeResponseMessage_{InvokeResponseMessage: r}}, nil
+	case "invoke":
+		d, err := decodeJSONData(m.DataType, m.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_InvokeMessage_{InvokeMessage: &webpubsub.DownstreamMessage_InvokeMessage{
+			InvocationId: m.InvocationId,
+			Target:       m.Target,
+			Data:         d,
+			SequenceId:   m.SequenceId,
+		}}}, nil
+	case "cancelInvocation":
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_CancelInvocationMessage_{
+			CancelInvocationMessage: &webpubsub.DownstreamMessage_CancelInvocationMessage{InvocationId: m.InvocationId},
+		}}, nil
+	}
+	return nil, fmt.Errorf("unknown message type %q", m.Type)
+}
+
+func (m *jsonMessage) group() string {
+	if m.Group == nil {
+		return ""
+	}
+	return *m.Group
+}
+
+// encodeJSONData maps MessageData onto the dataType/data pair: text is a
+// JSON string, json is embedded as is, binary is base64 and protobuf is the
+// base64 of the marshaled google.protobuf.Any.
+func encodeJSONData(d *webpubsub.MessageData) (DataType, json.RawMessage, error) {
+	var (
+		dataType DataType
+		v        any
+	)
+	switch x := d.GetData().(type) {
+	case *webpubsub.MessageData_TextData:
+		dataType, v = DataTypeText, x.TextData
+	case *webpubsub.MessageData_JsonData:
+		if !json.Valid([]byte(x.JsonData)) {
+			return "", nil, fmt.Errorf("invalid json data")
+		}
+		return DataTypeJSON, json.RawMessage(x.JsonData), nil
+	case *webpubsub.MessageData_BinaryData:
+		dataType, v = DataTypeBinary, x.BinaryData
+	case *webpubsub.MessageData_ProtobufData:
+		b, err := proto.Marshal(x.ProtobufData)
+		if err != nil {
+			return "", nil, err
+		}
+		dataType, v = DataTypeProtobuf, b
+	default:
+		return "", nil, nil
+	}
+	data, err := json.Marshal(v)
+	return dataType, data, err
+}
+
+func decodeJSONData(dataType DataType, data json.RawMessage) (*webpubsub.MessageData, error) {
+	switch dataType {
+	case "":
+		// Only invocations may come without data.
+		return nil, nil
+	case DataTypeText:
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return nil, err
+		}
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_TextData{TextData: text}}, nil
+	case DataTypeJSON:
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_JsonData{JsonData: string(data)}}, nil
+	case DataTypeBinary, DataTypeProtobuf:
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, err
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		if dataType == DataTypeBinary {
+			return &webpubsub.MessageData{Data: &webpubsub.MessageData_BinaryData{BinaryData: b}}, nil
+		}
+		var a anypb.Any
+		if err := proto.Unmarshal(b, &a); err != nil {
+			return nil, err
+		}
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_ProtobufData{ProtobufData: &a}}, nil
+	}
+	return nil, fmt.Errorf("unknown dataType %q", dataType)
+}
@@ -0,0 +1,130 @@
+package reliablesocket
+
+import (
+	"encoding/json"
+	"reflect"
+	"reliablesocket/proto/webpubsub"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// The samples follow the documentation of the json.reliable.webpubsub.azure.v1
+// subprotocol.
+
+func TestJSONCodecUpstream(t *testing.T) {
+	codec, _ := CodecFor(JSONReliableSubprotocol)
+	for sample, want := range map[string]*webpubsub.UpstreamMessage{
+		`{"type":"joinGroup","group":"group1","ackId":1}`: {Message: &webpubsub.UpstreamMessage_JoinGroupMessage_{
+			JoinGroupMessage: &webpubsub.UpstreamMessage_JoinGroupMessage{Group: "group1", AckId: ptr[int64](1)},
+		}},
+		`{"type":"leaveGroup","group":"group1","ackId":2}`: {Message: &webpubsub.UpstreamMessage_LeaveGroupMessage_{
+			LeaveGroupMessage: &webpubsub.UpstreamMessage_LeaveGroupMessage{Group: "group1", AckId: ptr[int64](2)},
+		}},
+		`{"type":"sendToGroup","group":"group1","ackId":3,"noEcho":true,"dataType":"text","data":"text data"}`: {Message: &webpubsub.UpstreamMessage_SendToGroupMessage_{
+			SendToGroupMessage: &webpubsub.UpstreamMessage_SendToGroupMessage{Group: "group1", AckId: ptr[int64](3), NoEcho: ptr(true), Data: textData("text data")},
+		}},
+		`{"type":"sendToGroup","group":"group1","dataType":"json","data":{"hello":"world"}}`: {Message: &webpubsub.UpstreamMessage_SendToGroupMessage_{
+			SendToGroupMessage: &webpubsub.UpstreamMessage_SendToGroupMessage{Group: "group1", Data: &webpubsub.MessageData{Data: &webpubsub.MessageData_JsonData{JsonData: `{"hello":"world"}`}}},
+		}},
+		`{"type":"event","event":"event1","ackId":4,"dataType":"binary","data":"aGVsbG8="}`: {Message: &webpubsub.UpstreamMessage_EventMessage_{
+			EventMessage: &webpubsub.UpstreamMessage_EventMessage{Event: "event1", AckId: ptr[int64](4), Data: &webpubsub.MessageData{Data: &webpubsub.MessageData_BinaryData{BinaryData: []byte("hello")}}},
+		}},
+		`{"type":"sequenceAck","sequenceId":10}`: {Message: &webpubsub.UpstreamMessage_SequenceAckMessage_{
+			SequenceAckMessage: &webpubsub.UpstreamMessage_SequenceAckMessage{SequenceId: 10},
+		}},
+	} {
+		got, err := codec.DecodeUpstream([]byte(sample))
+		if err != nil {
+			t.Fatalf("%s: %v", sample, err)
+		}
+		if !proto.Equal(got, want) {
+			t.Fatalf("%s: decoded %v", sample, got)
+		}
+		data, err := codec.EncodeUpstream(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameJSON(t, string(data), sample)
+	}
+
+	for _, bad := range []string{
+		`{"type":"unknown"}`,
+		`{"type":"event","event":"e","dataType":"binary","data":"not base64"}`,
+		`{"type":"event","event":"e","dataType":"text","data":1}`,
+		`{"type":"event","event":"e","dataType":"xml","data":"<a/>"}`,
+		`not json`,
+	} {
+		if _, err := codec.DecodeUpstream([]byte(bad)); err == nil {
+			t.Fatalf("%s decoded", bad)
+		}
+	}
+}
+
+func TestJSONCodecDownstream(t *testing.T) {
+	codec, _ := CodecFor(JSONReliableSubprotocol)
+	for sample, want := range map[string]*webpubsub.DownstreamMessage{
+		`{"type":"ack","ackId":1,"success":true}`: {Message: &webpubsub.DownstreamMessage_AckMessage_{
+			AckMessage: &webpubsub.DownstreamMessage_AckMessage{AckId: 1, Success: true},
+		}},
+		`{"type":"ack","ackId":2,"success":false,"error":{"name":"Forbidden","message":"no permission"}}`: {Message: &webpubsub.DownstreamMessage_AckMessage_{
+			AckMessage: &webpubsub.DownstreamMessage_AckMessage{AckId: 2, Error: &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: "Forbidden", Message: "no permission"}},
+		}},
+		`{"sequenceId":1,"type":"message","from":"group","group":"group1","dataType":"text","data":"text data"}`: {Message: &webpubsub.DownstreamMessage_DataMessage_{
+			DataMessage: &webpubsub.DownstreamMessage_DataMessage{From: "group", Group: ptr("group1"), SequenceId: ptr[int64](1), Data: textData("text data")},
+		}},
+		`{"sequenceId":2,"type":"message","from":"server","dataType":"json","data":{"hello":"world"}}`: {Message: &webpubsub.DownstreamMessage_DataMessage_{
+			DataMessage: &webpubsub.DownstreamMessage_DataMessage{From: "server", SequenceId: ptr[int64](2), Data: &webpubsub.MessageData{Data: &webpubsub.MessageData_JsonData{JsonData: `{"hello":"world"}`}}},
+		}},
+		`{"type":"system","event":"connected","userId":"user1","connectionId":"abcdefghijklmnop","reconnectionToken":"token"}`: {Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+			Message: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage_{ConnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage{
+				UserId: "user1", ConnectionId: "abcdefghijklmnop", ReconnectionToken: "token",
+			}},
+		}}},
+		`{"type":"system","event":"disconnected","message":"reason"}`: {Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+			Message: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage_{DisconnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage{Reason: "reason"}},
+		}}},
+	} {
+		got, err := codec.DecodeDownstream([]byte(sample))
+		if err != nil {
+			t.Fatalf("%s: %v", sample, err)
+		}
+		if !proto.Equal(got, want) {
+			t.Fatalf("%s: decoded %v", sample, got)
+		}
+		data, err := codec.EncodeDownstream(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameJSON(t, string(data), sample)
+	}
+
+	invalid := &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_DataMessage_{
+		DataMessage: &webpubsub.DownstreamMessage_DataMessage{From: "server", Data: &webpubsub.MessageData{Data: &webpubsub.MessageData_JsonData{JsonData: "{"}}},
+	}}
+	if _, err := codec.EncodeDownstream(invalid); err == nil {
+		t.Fatal("invalid json data encoded")
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func textData(s string) *webpubsub.MessageData {
+	return &webpubsub.MessageData{Data: &webpubsub.MessageData_TextData{TextData: s}}
+}
+
+func assertSameJSON(t *testing.T, got, want string) {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal([]byte(got), &g); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Fatalf("encoded %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,431 @@
+package reliablesocket
+
+import (
+	"fmt"
+	"reliablesocket/proto/webpubsub"
+
+	"github.com/coder/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// The msgpack types mirror UpstreamMessage and DownstreamMessage in
+// webpubsub.client.proto field by field: each message is a map holding
+// exactly one of its oneof fields, keyed by the proto field name.
+
+type msgpackUpstream struct {
+	SendToGroupMessage      *msgpackSendToGroup    `msgpack:"send_to_group_message,omitempty"`
+	EventMessage            *msgpackEvent          `msgpack:"event_message,omitempty"`
+	JoinGroupMessage        *msgpackGroup          `msgpack:"join_group_message,omitempty"`
+	LeaveGroupMessage       *msgpackGroup          `msgpack:"leave_group_message,omitempty"`
+	SequenceAckMessage      *msgpackSequenceAck    `msgpack:"sequence_ack_message,omitempty"`
+	InvokeMessage           *msgpackInvoke         `msgpack:"invoke_message,omitempty"`
+	CancelInvocationMessage *msgpackInvocation     `msgpack:"cancel_invocation_message,omitempty"`
+	InvokeResponseMessage   *msgpackInvokeResponse `msgpack:"invoke_response_message,omitempty"`
+}
+
+type msgpackSendToGroup struct {
+	Group  string       `msgpack:"group"`
+	AckId  *int64       `msgpack:"ack_id,omitempty"`
+	Data   *msgpackData `msgpack:"data,omitempty"`
+	NoEcho *bool        `msgpack:"no_echo,omitempty"`
+}
+
+type msgpackEvent struct {
+	Event string       `msgpack:"event"`
+	Data  *msgpackData `msgpack:"data,omitempty"`
+	AckId *int64       `msgpack:"ack_id,omitempty"`
+}
+
+type msgpackGroup struct {
+	Group                  string `msgpack:"group"`
+	AckId                  *int64 `msgpack:"ack_id,omitempty"`
+	HistoryAfterSequenceId *int64 `msgpack:"history_after_sequence_id,omitempty"`
+	HistorySince           *int64 `msgpack:"history_since,omitempty"`
+}
+
+type msgpackSequenceAck struct {
+	SequenceId int64 `msgpack:"sequence_id"`
+}
+
+type msgpackInvoke struct {
+	InvocationId string       `msgpack:"invocation_id"`
+	Target       string       `msgpack:"target"`
+	Data         *msgpackData `msgpack:"data,omitempty"`
+}
+
+type msgpackDownstreamInvoke struct {
+	InvocationId string       `msgpack:"invocation_id"`
+	Target       string       `msgpack:"target"`
+	Data         *msgpackData `msgpack:"data,omitempty"`
+	SequenceId   *int64       `msgpack:"sequence_id,omitempty"`
+}
+
+type msgpackInvocation struct {
+	InvocationId string `msgpack:"invocation_id"`
+}
+
+type msgpackDownstream struct {
+	AckMessage              *msgpackAck              `msgpack:"ack_message,omitempty"`
+	DataMessage             *msgpackDataMessage      `msgpack:"data_message,omitempty"`
+	SystemMessage           *msgpackSystem           `msgpack:"system_message,omitempty"`
+	InvokeResponseMessage   *msgpackInvokeResponse   `msgpack:"invoke_response_message,omitempty"`
+	InvokeMessage           *msgpackDownstreamInvoke `msgpack:"invoke_message,omitempty"`
+	CancelInvocationMessage *msgpackInvocation       `msgpack:"cancel_invocation_message,omitempty"`
+}
+
+// msgpackInvokeResponse is used in both directions, only upstream responses
+// carry an ack id.
+type msgpackInvokeResponse struct {
+	InvocationId string           `msgpack:"invocation_id"`
+	Success      bool             `msgpack:"success"`
+	Data         *msgpackData     `msgpack:"data,omitempty"`
+	Error        *msgpackAckError `msgpack:"error,omitempty"`
+	AckId        *int64           `msgpack:"ack_id,omitempty"`
+}
+
+type msgpackAck struct {
+	AckId   int64            `msgpack:"ack_id"`
+	Success bool             `msgpack:"success"`
+	Error   *msgpackAckError `msgpack:"error,omitempty"`
+}
+
+type msgpackAckError struct {
+	Name    string `msgpack:"name"`
+	Message string `msgpack:"message"`
+}
+
+type msgpackDataMessage struct {
+	From       string       `msgpack:"from"`
+	Group      *string      `msgpack:"group,omitempty"`
+	Data       *msgpackData `msgpack:"data,omitempty"`
+	SequenceId *int64       `msgpack:"sequence_id,omitempty"`
+	// GroupSequenceId, Timestamp and History are set on group messages of
+	// groups that keep history.
+	GroupSequenceId *int64 `msgpack:"group_sequence_id,omitempty"`
+	Timestamp       *int64 `msgpack:"timestamp,omitempty"`
+	History         bool   `msgpack:"history,omitempty"`
+}
+
+type msgpackSystem struct {
+	ConnectedMessage    *msgpackConnected    `msgpack:"connected_message,omitempty"`
+	DisconnectedMessage *msgpackDisconnected `msgpack:"disconnected_message,omitempty"`
+	PresenceMessage     *msgpackPresence     `msgpack:"presence_message,omitempty"`
+}
+
+type msgpackPresence struct {
+	Group        string `msgpack:"group"`
+	Event        string `msgpack:"event"`
+	UserId       string `msgpack:"user_id"`
+	ConnectionId string `msgpack:"connection_id"`
+}
+
+type msgpackConnected struct {
+	ConnectionId      string `msgpack:"connection_id"`
+	UserId            string `msgpack:"user_id"`
+	ReconnectionToken string `msgpack:"reconnection_token"`
+}
+
+type msgpackDisconnected struct {
+	Reason string `msgpack:"reason"`
+}
+
+// msgpackData mirrors MessageData. Protobuf data keeps the Any wrapping as a
+// type_url/value pair instead of a nested message.
+type msgpackData struct {
+	TextData     *string     `msgpack:"text_data,omitempty"`
+	BinaryData   *[]byte     `msgpack:"binary_data,omitempty"`
+	ProtobufData *msgpackAny `msgpack:"protobuf_data,omitempty"`
+	JsonData     *string     `msgpack:"json_data,omitempty"`
+}
+
+type msgpackAny struct {
+	TypeUrl string `msgpack:"type_url"`
+	Value   []byte `msgpack:"value"`
+}
+
+type msgpackCodec struct {
+	subprotocol string
+	reliable    bool
+}
+
+func (c msgpackCodec) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c msgpackCodec) Reliable() bool {
+	return c.reliable
+}
+
+func (msgpackCodec) FrameType() websocket.MessageType {
+	return websocket.MessageBinary
+}
+
+func (msgpackCodec) EncodeUpstream(msg *webpubsub.UpstreamMessage) ([]byte, error) {
+	var m msgpackUpstream
+	switch x := msg.GetMessage().(type) {
+	case *webpubsub.UpstreamMessage_SendToGroupMessage_:
+		m.SendToGroupMessage = &msgpackSendToGroup{
+			Group:  x.SendToGroupMessage.GetGroup(),
+			AckId:  x.SendToGroupMessage.AckId,
+			Data:   toMsgpackData(x.SendToGroupMessage.GetData()),
+			NoEcho: x.SendToGroupMessage.NoEcho,
+		}
+	case *webpubsub.UpstreamMessage_EventMessage_:
+		m.EventMessage = &msgpackEvent{
+			Event: x.EventMessage.GetEvent(),
+			Data:  toMsgpackData(x.EventMessage.GetData()),
+			AckId: x.EventMessage.AckId,
+		}
+	case *webpubsub.UpstreamMessage_JoinGroupMessage_:
+		m.JoinGroupMessage = &msgpackGroup{
+			Group:                  x.JoinGroupMessage.GetGroup(),
+			AckId:                  x.JoinGroupMessage.AckId,
+			HistoryAfterSequenceId: x.JoinGroupMessage.HistoryAfterSequenceId,
+			HistorySince:           x.JoinGroupMessage.HistorySince,
+		}
+	case *webpubsub.UpstreamMessage_LeaveGroupMessage_:
+		m.LeaveGroupMessage = &msgpackGroup{Group: x.LeaveGroupMessage.GetGroup(), AckId: x.LeaveGroupMessage.AckId}
+	case *webpubsub.UpstreamMessage_SequenceAckMessage_:
+		m.SequenceAckMessage = &msgpackSequenceAck{SequenceId: x.SequenceAckMessage.GetSequenceId()}
+	case *webpubsub.UpstreamMessage_InvokeMessage_:
+		m.InvokeMessage = &msgpackInvoke{
+			InvocationId: x.InvokeMessage.GetInvocationId(),
+			Target:       x.InvokeMessage.GetTarget(),
+			Data:         toMsgpackData(x.InvokeMessage.GetData()),
+		}
+	case *webpubsub.UpstreamMessage_CancelInvocationMessage_:
+		m.CancelInvocationMessage = &msgpackInvocation{InvocationId: x.CancelInvocationMessage.GetInvocationId()}
+	case *webpubsub.UpstreamMessage_InvokeResponseMessage_:
+		r := x.InvokeResponseMessage
+		m.InvokeResponseMessage = &msgpackInvokeResponse{
+			InvocationId: r.GetInvocationId(),
+			Success:      r.GetSuccess(),
+			Data:         toMsgpackData(r.GetData()),
+			AckId:        r.AckId,
+		}
+		if e := r.Error; e != nil {
+			m.InvokeResponseMessage.Error = &msgpackAckError{Name: e.GetName(), Message: e.GetMessage()}
+		}
+	default:
+		return nil, fmt.Errorf("unknown upstream message %T", x)
+	}
+	return msgpack.Marshal(&m)
+}
+
+func (msgpackCodec) DecodeUpstream(data []byte) (*webpubsub.UpstreamMessage, error) {
+	var m msgpackUpstream
+	if err := msgpack.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	switch {
+	case m.SendToGroupMessage != nil:
+		x := m.SendToGroupMessage
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_SendToGroupMessage_{
+			SendToGroupMessage: &webpubsub.UpstreamMessage_SendToGroupMessage{Group: x.Group, AckId: x.AckId, Data: x.Data.messageData(), NoEcho: x.NoEcho},
+		}}, nil
+	case m.EventMessage != nil:
+		x := m.EventMessage
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_EventMessage_{
+			EventMessage: &webpubsub.UpstreamMessage_EventMessage{Event: x.Event, Data: x.Data.messageData(), AckId: x.AckId},
+		}}, nil
+	case m.JoinGroupMessage != nil:
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_JoinGroupMessage_{
+			JoinGroupMessage: &webpubsub.UpstreamMessage_JoinGroupMessage{
+				Group:                  m.JoinGroupMessage.Group,
+				AckId:                  m.JoinGroupMessage.AckId,
+				HistoryAfterSequenceId: m.JoinGroupMessage.HistoryAfterSequenceId,
+				HistorySince:           m.JoinGroupMessage.HistorySince,
+			},
+		}}, nil
+	case m.LeaveGroupMessage != nil:
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_LeaveGroupMessage_{
+			LeaveGroupMessage: &webpubsub.UpstreamMessage_LeaveGroupMessage{Group: m.LeaveGroupMessage.Group, AckId: m.LeaveGroupMessage.AckId},
+		}}, nil
+	case m.SequenceAckMessage != nil:
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_SequenceAckMessage_{
+			SequenceAckMessage: &webpubsub.UpstreamMessage_SequenceAckMessage{SequenceId: m.SequenceAckMessage.SequenceId},
+		}}, nil
+	case m.InvokeMessage != nil:
+		x := m.InvokeMessage
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_InvokeMessage_{
+			InvokeMessage: &webpubsub.UpstreamMessage_InvokeMessage{InvocationId: x.InvocationId, Target: x.Target, Data: x.Data.messageData()},
+		}}, nil
+	case m.CancelInvocationMessage != nil:
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_CancelInvocationMessage_{
+			CancelInvocationMessage: &webpubsub.UpstreamMessage_CancelInvocationMessage{InvocationId: m.CancelInvocationMessage.InvocationId},
+		}}, nil
+	case m.InvokeResponseMessage != nil:
+		x := m.InvokeResponseMessage
+		r := &webpubsub.UpstreamMessage_InvokeResponseMessage{InvocationId: x.InvocationId, Success: x.Success, Data: x.Data.messageData(), AckId: x.AckId}
+		if e := x.Error; e != nil {
+			r.Error = &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: e.Name, Message: e.Message}
+		}
+		return &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_InvokeResponseMessage_{InvokeResponseMessage: r}}, nil
+	}
+	return nil, fmt.Errorf("empty upstream message")
+}
+
+func (msgpackCodec) EncodeDownstream(msg *webpubsub.DownstreamMessage) ([]byte, error) {
+	var m msgpackDownstream
+	switch x := msg.GetMessage().(type) {
+	case *webpubsub.DownstreamMessage_AckMessage_:
+		m.AckMessage = &msgpackAck{AckId: x.AckMessage.GetAckId(), Success: x.AckMessage.GetSuccess()}
+		if e := x.AckMessage.Error; e != nil {
+			m.AckMessage.Error = &msgpackAckError{Name: e.GetName(), Message: e.GetMessage()}
+		}
+	case *webpubsub.DownstreamMessage_DataMessage_:
+		m.DataMessage = &msgpackDataMessage{
+			From:            x.DataMessage.GetFrom(),
+			Group:           x.DataMessage.Group,
+			Data:            toMsgpackData(x.DataMessage.GetData()),
+			SequenceId:      x.DataMessage.SequenceId,
+			GroupSequenceId: x.DataMessage.GroupSequenceId,
+			Timestamp:       x.DataMessage.Timestamp,
+			History:         x.DataMessage.GetHistory(),
+		}
+	case *webpubsub.DownstreamMessage_SystemMessage_:
+		switch y := x.SystemMessage.GetMessage().(type) {
+		case *webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage_:
+			m.SystemMessage = &msgpackSystem{ConnectedMessage: &msgpackConnected{
+				ConnectionId:      y.ConnectedMessage.GetConnectionId(),
+				UserId:            y.ConnectedMessage.GetUserId(),
+				ReconnectionToken: y.ConnectedMessage.GetReconnectionToken(),
+			}}
+		case *webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage_:
+			m.SystemMessage = &msgpackSystem{DisconnectedMessage: &msgpackDisconnected{Reason: y.DisconnectedMessage.GetReason()}}
+		case *webpubsub.DownstreamMessage_SystemMessage_PresenceMessage_:
+			m.SystemMessage = &msgpackSystem{PresenceMessage: &msgpackPresence{
+				Group:        y.PresenceMessage.GetGroup(),
+				Event:        y.PresenceMessage.GetEvent(),
+				UserId:       y.PresenceMessage.GetUserId(),
+				ConnectionId: y.PresenceMessage.GetConnectionId(),
+			}}
+		default:
+			return nil, fmt.Errorf("unknown system message %T", y)
+		}
+	case *webpubsub.DownstreamMessage_InvokeResponseMessage_:
+		r := x.InvokeResponseMessage
+		m.InvokeResponseMessage = &msgpackInvokeResponse{
+			InvocationId: r.GetInvocationId(),
+			Success:      r.GetSuccess(),
+			Data:         toMsgpackData(r.GetData()),
+		}
+		if e := r.Error; e != nil {
+			m.InvokeResponseMessage.Error = &msgpackAckError{Name: e.GetName(), Message: e.GetMessage()}
+		}
+	case *webpubsub.DownstreamMessage_InvokeMessage_:
+		m.InvokeMessage = &msgpackDownstreamInvoke{
+			InvocationId: x.InvokeMessage.GetInvocationId(),
+			Target:       x.InvokeMessage.GetTarget(),
+			Data:         toMsgpackData(x.InvokeMessage.GetData()),
+			SequenceId:   x.InvokeMessage.SequenceId,
+		}
+	case *webpubsub.DownstreamMessage_CancelInvocationMessage_:
+		m.CancelInvocationMessage = &msgpackInvocation{InvocationId: x.CancelInvocationMessage.GetInvocationId()}
+	default:
+		return nil, fmt.Errorf("unknown downstream message %T", x)
+	}
+	return msgpack.Marshal(&m)
+}
+
+func (msgpackCodec) DecodeDownstream(data []byte) (*webpubsub.DownstreamMessage, error) {
+	var m msgpackDownstream
+	if err := msgpack.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	switch {
+	case m.AckMessage != nil:
+		ack := &webpubsub.DownstreamMessage_AckMessage{AckId: m.AckMessage.AckId, Success: m.AckMessage.Success}
+		if e := m.AckMessage.Error; e != nil {
+			ack.Error = &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: e.Name, Message: e.Message}
+		}
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_AckMessage_{AckMessage: ack}}, nil
+	case m.DataMessage != nil:
+		x := m.DataMessage
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_DataMessage_{DataMessage: &webpubsub.DownstreamMessage_DataMessage{
+			From:            x.From,
+			Group:           x.Group,
+			Data:            x.Data.messageData(),
+			SequenceId:      x.SequenceId,
+			GroupSequenceId: x.GroupSequenceId,
+			Timestamp:       x.Timestamp,
+			History:         x.History,
+		}}}, nil
+	case m.SystemMessage != nil && m.SystemMessage.ConnectedMessage != nil:
+		x := m.SystemMessage.ConnectedMessage
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+			Message: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage_{ConnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage{
+				ConnectionId:      x.ConnectionId,
+				UserId:            x.UserId,
+				ReconnectionToken: x.ReconnectionToken,
+			}},
+		}}}, nil
+	case m.SystemMessage != nil && m.SystemMessage.DisconnectedMessage != nil:
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+			Message: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage_{DisconnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage{
+				Reason: m.SystemMessage.DisconnectedMessage.Reason,
+			}},
+		}}}, nil
+	case m.SystemMessage != nil && m.SystemMessage.PresenceMessage != nil:
+		x := m.SystemMessage.PresenceMessage
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+			Message: &webpubsub.DownstreamMessage_SystemMessage_PresenceMessage_{PresenceMessage: &webpubsub.DownstreamMessage_SystemMessage_PresenceMessage{
+				Group:        x.Group,
+				Event:        x.Event,
+				UserId:       x.UserId,
+				ConnectionId: x.ConnectionId,
+			}},
+		}}}, nil
+	case m.InvokeResponseMessage != nil:
+		x := m.InvokeResponseMessage
+		r := &webpubsub.DownstreamMessage_InvokeResponseMessage{InvocationId: x.InvocationId, Success: x.Success, Data: x.Data.messageData()}
+		if e := x.Error; e != nil {
+			r.Error = &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: e.Name, Message: e.Message}
+		}
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_InvokeResponseMessage_{InvokeResponseMessage: r}}, nil
+	case m.InvokeMessage != nil:
+		x := m.InvokeMessage
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_InvokeMessage_{InvokeMessage: &webpubsub.DownstreamMessage_InvokeMessage{
+			InvocationId: x.InvocationId,
+			Target:       x.Target,
+			Data:         x.Data.messageData(),
+			SequenceId:   x.SequenceId,
+		}}}, nil
+	case m.CancelInvocationMessage != nil:
+		return &webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_CancelInvocationMessage_{
+			CancelInvocationMessage: &webpubsub.DownstreamMessage_CancelInvocationMessage{InvocationId: m.CancelInvocationMessage.InvocationId},
+		}}, nil
+	}
+	return nil, fmt.Errorf("empty downstream message")
+}
+
+func toMsgpackData(d *webpubsub.MessageData) *msgpackData {
+	switch x := d.GetData().(type) {
+	case *webpubsub.MessageData_TextData:
+		return &msgpackData{TextData: &x.TextData}
+	case *webpubsub.MessageData_BinaryData:
+		return &msgpackData{BinaryData: &x.BinaryData}
+	case *webpubsub.MessageData_ProtobufData:
+		return &msgpackData{ProtobufData: &msgpackAny{TypeUrl: x.ProtobufData.GetTypeUrl(), Value: x.ProtobufData.GetValue()}}
+	case *webpubsub.MessageData_JsonData:
+		return &msgpackData{JsonData: &x.JsonData}
+	}
+	return nil
+}
+
+func (d *msgpackData) messageData() *webpubsub.MessageData {
+	switch {
+	case d == nil:
+		return nil
+	case d.TextData != nil:
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_TextData{TextData: *d.TextData}}
+	case d.BinaryData != nil:
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_BinaryData{BinaryData: *d.BinaryData}}
+	case d.ProtobufData != nil:
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_ProtobufData{ProtobufData: &anypb.Any{TypeUrl: d.ProtobufData.TypeUrl, Value: d.ProtobufData.Value}}}
+	case d.JsonData != nil:
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_JsonData{JsonData: *d.JsonData}}
+	}
+	return &webpubsub.MessageData{}
+}
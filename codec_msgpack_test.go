@@ -0,0 +1,129 @@
+package reliablesocket
+
+import (
+	"reliablesocket/proto/webpubsub"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func testMessageData(t *testing.T) []*webpubsub.MessageData {
+	pb, err := anypb.New(wrapperspb.String("protobuf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*webpubsub.MessageData{
+		{Data: &webpubsub.MessageData_TextData{TextData: "text"}},
+		{Data: &webpubsub.MessageData_TextData{TextData: ""}},
+		{Data: &webpubsub.MessageData_JsonData{JsonData: `{"a":[1,2]}`}},
+		{Data: &webpubsub.MessageData_BinaryData{BinaryData: []byte{0, 1, 2, 255}}},
+		{Data: &webpubsub.MessageData_BinaryData{BinaryData: []byte{}}},
+		{Data: &webpubsub.MessageData_ProtobufData{ProtobufData: pb}},
+	}
+}
+
+func testUpstreamMessages(t *testing.T) []*webpubsub.UpstreamMessage {
+	msgs := []*webpubsub.UpstreamMessage{
+		{Message: &webpubsub.UpstreamMessage_JoinGroupMessage_{JoinGroupMessage: &webpubsub.UpstreamMessage_JoinGroupMessage{Group: "g", AckId: ptr[int64](1)}}},
+		{Message: &webpubsub.UpstreamMessage_JoinGroupMessage_{JoinGroupMessage: &webpubsub.UpstreamMessage_JoinGroupMessage{Group: "g"}}},
+		{Message: &webpubsub.UpstreamMessage_JoinGroupMessage_{JoinGroupMessage: &webpubsub.UpstreamMessage_JoinGroupMessage{Group: "g", HistoryAfterSequenceId: ptr[int64](3), HistorySince: ptr[int64](1700000000000)}}},
+		{Message: &webpubsub.UpstreamMessage_LeaveGroupMessage_{LeaveGroupMessage: &webpubsub.UpstreamMessage_LeaveGroupMessage{Group: "g", AckId: ptr[int64](2)}}},
+		{Message: &webpubsub.UpstreamMessage_SequenceAckMessage_{SequenceAckMessage: &webpubsub.UpstreamMessage_SequenceAckMessage{SequenceId: 42}}},
+		{Message: &webpubsub.UpstreamMessage_InvokeMessage_{InvokeMessage: &webpubsub.UpstreamMessage_InvokeMessage{InvocationId: "1", Target: "t"}}},
+		{Message: &webpubsub.UpstreamMessage_CancelInvocationMessage_{CancelInvocationMessage: &webpubsub.UpstreamMessage_CancelInvocationMessage{InvocationId: "1"}}},
+		{Message: &webpubsub.UpstreamMessage_InvokeResponseMessage_{InvokeResponseMessage: &webpubsub.UpstreamMessage_InvokeResponseMessage{InvocationId: "1", AckId: ptr[int64](4), Error: &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: "NotFound", Message: "no"}}}},
+	}
+	for _, d := range testMessageData(t) {
+		msgs = append(msgs,
+			&webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_SendToGroupMessage_{SendToGroupMessage: &webpubsub.UpstreamMessage_SendToGroupMessage{Group: "g", AckId: ptr[int64](3), NoEcho: ptr(true), Data: d}}},
+			&webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_EventMessage_{EventMessage: &webpubsub.UpstreamMessage_EventMessage{Event: "e", Data: d}}},
+			&webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_InvokeMessage_{InvokeMessage: &webpubsub.UpstreamMessage_InvokeMessage{InvocationId: "2", Target: "t", Data: d}}},
+			&webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_InvokeResponseMessage_{InvokeResponseMessage: &webpubsub.UpstreamMessage_InvokeResponseMessage{InvocationId: "2", Success: true, Data: d}}},
+		)
+	}
+	return msgs
+}
+
+func testDownstreamMessages(t *testing.T) []*webpubsub.DownstreamMessage {
+	msgs := []*webpubsub.DownstreamMessage{
+		{Message: &webpubsub.DownstreamMessage_AckMessage_{AckMessage: &webpubsub.DownstreamMessage_AckMessage{AckId: 1, Success: true}}},
+		{Message: &webpubsub.DownstreamMessage_AckMessage_{AckMessage: &webpubsub.DownstreamMessage_AckMessage{AckId: 2, Error: &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: "Forbidden", Message: "no"}}}},
+		{Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+			Message: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage_{ConnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage{ConnectionId: "c", UserId: "u", ReconnectionToken: "t"}},
+		}}},
+		{Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+			Message: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage_{DisconnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage{Reason: "bye"}},
+		}}},
+		{Message: &webpubsub.DownstreamMessage_InvokeResponseMessage_{InvokeResponseMessage: &webpubsub.DownstreamMessage_InvokeResponseMessage{InvocationId: "1", Error: &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: "NotFound", Message: "no"}}}},
+		{Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: &webpubsub.DownstreamMessage_SystemMessage{
+			Message: &webpubsub.DownstreamMessage_SystemMessage_PresenceMessage_{PresenceMessage: &webpubsub.DownstreamMessage_SystemMessage_PresenceMessage{Group: "g", Event: "join", UserId: "u", ConnectionId: "c"}},
+		}}},
+		{Message: &webpubsub.DownstreamMessage_CancelInvocationMessage_{CancelInvocationMessage: &webpubsub.DownstreamMessage_CancelInvocationMessage{InvocationId: "1"}}},
+	}
+	for _, d := range testMessageData(t) {
+		msgs = append(msgs,
+			&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_DataMessage_{DataMessage: &webpubsub.DownstreamMessage_DataMessage{From: "group", Group: ptr("g"), SequenceId: ptr[int64](7), Data: d}}},
+			&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_DataMessage_{DataMessage: &webpubsub.DownstreamMessage_DataMessage{From: "server", Data: d}}},
+			&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_DataMessage_{DataMessage: &webpubsub.DownstreamMessage_DataMessage{From: "group", Group: ptr("g"), Data: d, GroupSequenceId: ptr[int64](2), Timestamp: ptr[int64](1700000000000), History: true}}},
+			&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_InvokeResponseMessage_{InvokeResponseMessage: &webpubsub.DownstreamMessage_InvokeResponseMessage{InvocationId: "2", Success: true, Data: d}}},
+			&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_InvokeMessage_{InvokeMessage: &webpubsub.DownstreamMessage_InvokeMessage{InvocationId: "3", Target: "t", SequenceId: ptr[int64](8), Data: d}}},
+		)
+	}
+	return msgs
+}
+
+// TestMsgpackConformance checks that every message survives a msgpack round
+// trip exactly like it survives the protobuf encoding.
+func TestMsgpackConformance(t *testing.T) {
+	mp, ok := CodecFor(MsgpackReliableSubprotocol)
+	if !ok {
+		t.Fatal("msgpack codec not registered")
+	}
+	pb, _ := CodecFor(ProtobufReliableSubprotocol)
+
+	for _, msg := range testUpstreamMessages(t) {
+		data, err := pb.EncodeUpstream(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := pb.DecodeUpstream(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = mp.EncodeUpstream(msg)
+		if err != nil {
+			t.Fatalf("encode %v: %v", msg, err)
+		}
+		got, err := mp.DecodeUpstream(data)
+		if err != nil {
+			t.Fatalf("decode %v: %v", msg, err)
+		}
+		if !proto.Equal(got, want) {
+			t.Fatalf("upstream round trip: got %v, want %v", got, want)
+		}
+	}
+
+	for _, msg := range testDownstreamMessages(t) {
+		data, err := pb.EncodeDownstream(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := pb.DecodeDownstream(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = mp.EncodeDownstream(msg)
+		if err != nil {
+			t.Fatalf("encode %v: %v", msg, err)
+		}
+		got, err := mp.DecodeDownstream(data)
+		if err != nil {
+			t.Fatalf("decode %v: %v", msg, err)
+		}
+		if !proto.Equal(got, want) {
+			t.Fatalf("downstream round trip: got %v, want %v", got, want)
+		}
+	}
+}
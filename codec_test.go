@@ -0,0 +1,57 @@
+package reliablesocket
+
+import (
+	"context"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestRegisterCodec(t *testing.T) {
+	builtin := []string{ProtobufReliableSubprotocol, JSONReliableSubprotocol, ProtobufSubprotocol, JSONSubprotocol, MsgpackReliableSubprotocol}
+	if got := Subprotocols(); !slices.Equal(got[:len(builtin)], builtin) {
+		t.Fatalf("subprotocols %v", got)
+	}
+
+	const custom = "json.test.webpubsub.v1"
+	RegisterCodec(jsonCodec{subprotocol: custom})
+	RegisterCodec(jsonCodec{subprotocol: custom, reliable: true})
+	got := Subprotocols()
+	if got[len(got)-1] != custom || slices.Index(got, custom) != len(got)-1 {
+		t.Fatalf("subprotocols %v", got)
+	}
+	if c, ok := CodecFor(strings.ToUpper(custom)); !ok || !c.Reliable() {
+		t.Fatal("codec not replaced")
+	}
+	if _, ok := CodecFor("unknown"); ok {
+		t.Fatal("unknown subprotocol has a codec")
+	}
+
+	// The server negotiates it like the built-in ones.
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/client/hubs/chat?access_token=alice", &websocket.DialOptions{Subprotocols: []string{custom}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+	if conn.Subprotocol() != custom {
+		t.Fatalf("negotiated %q", conn.Subprotocol())
+	}
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := CodecFor(custom)
+	msg, err := c.DecodeDownstream(data)
+	if err != nil || msg.GetSystemMessage().GetConnectedMessage().GetReconnectionToken() == "" {
+		t.Fatalf("got %v, %v", msg, err)
+	}
+}
@@ -0,0 +1,54 @@
+package reliablesocket
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ConnectRequest describes a client that is connecting, before the WebSocket
+// upgrade. It is passed to Server.OnConnect and is the body of the connect
+// CloudEvent.
+type ConnectRequest struct {
+	Hub          string              `json:"-"`
+	ConnectionId string              `json:"-"`
+	Claims       map[string][]string `json:"claims"`
+	Query        url.Values          `json:"query"`
+	Headers      http.Header         `json:"headers"`
+	Subprotocols []string            `json:"subprotocols"`
+}
+
+// ConnectResponse accepts a connection. Empty fields keep what the access
+// token says.
+type ConnectResponse struct {
+	UserId string   `json:"userId,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Subprotocol must be one of the requested subprotocols.
+	Subprotocol string `json:"subprotocol,omitempty"`
+}
+
+// merge applies the non-empty fields of r2. Groups add up.
+func (r *ConnectResponse) merge(r2 *ConnectResponse) {
+	if r2.UserId != "" {
+		r.UserId = r2.UserId
+	}
+	if r2.Roles != nil {
+		r.Roles = r2.Roles
+	}
+	r.Groups = append(r.Groups, r2.Groups...)
+	if r2.Subprotocol != "" {
+		r.Subprotocol = r2.Subprotocol
+	}
+}
+
+// ConnectError rejects a connection with an HTTP status, before the
+// WebSocket upgrade.
+type ConnectError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connection rejected (%d): %s", e.StatusCode, e.Message)
+}
@@ -0,0 +1,62 @@
+package reliablesocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOnConnect(t *testing.T) {
+	s := NewServer()
+	var got ConnectRequest
+	s.OnConnect = func(ctx context.Context, req ConnectRequest) (ConnectResponse, error) {
+		got = req
+		switch req.Query.Get("access_token") {
+		case "banned":
+			return ConnectResponse{}, &ConnectError{StatusCode: http.StatusForbidden, Message: "banned"}
+		case "":
+			return ConnectResponse{}, errors.New("sign in first")
+		}
+		return ConnectResponse{UserId: "user-" + req.Query.Get("access_token"), Groups: []string{"lobby"}}, nil
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	for token, want := range map[string]int{"banned": http.StatusForbidden, "": http.StatusUnauthorized} {
+		resp, err := http.Get(ts.URL + "/client/hubs/chat?access_token=" + token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("token %q: got %d, want %d", token, resp.StatusCode, want)
+		}
+	}
+
+	c := newTestClient(t, ts, "alice")
+	connected := make(chan *ConnectedEvent, 1)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	select {
+	case e := <-connected:
+		if e.UserId != "user-alice" {
+			t.Fatalf("user id %q, want user-alice", e.UserId)
+		}
+	case <-ctx.Done():
+		t.Fatal("not connected")
+	}
+	if got.Hub != "chat" || got.Claims["sub"][0] != "alice" || len(got.Subprotocols) == 0 || got.Headers.Get("Sec-WebSocket-Key") == "" {
+		t.Fatalf("unexpected connect request %+v", got)
+	}
+	if members := s.Hub("chat").GroupMembers("lobby"); len(members) != 1 || members[0].UserId != "user-alice" {
+		t.Fatalf("lobby members %v", members)
+	}
+}
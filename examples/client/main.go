@@ -2,34 +2,35 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
 	"fmt"
 	"os"
 	"reliablesocket"
 	"reliablesocket/proto/webpubsub"
-	"sync/atomic"
 )
 
-var ackId = &atomic.Int64{}
 var join bool
 
 func main() {
-	data, _ := os.ReadFile("token.json")
-	var d webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage
-	json.Unmarshal(data, &d)
-	var cli *reliablesocket.Client
-	if d.GetReconnectionToken() != "" {
-		fmt.Println(d.String())
-		cli = reliablesocket.ReNewClient(d.GetConnectionId(), d.GetReconnectionToken())
-	} else {
-		cli = reliablesocket.NewClient("bob")
+	opts := reliablesocket.ClientOptions{
+		Endpoint:    "ws://127.0.0.1:1234",
+		Hub:         "testhub",
+		AccessToken: reliablesocket.StaticAccessToken("bob"),
+		// Resume the same connection when the example is restarted.
+		SessionStore: reliablesocket.NewFileSessionStore("token.json"),
+	}
+	cli, err := reliablesocket.NewClient(opts)
+	if err != nil {
+		panic(err)
+	}
+	cli.OnGroupMessage(func(msg *reliablesocket.GroupMessage) {
+		fmt.Println(msg.Group, msg.Data.Text)
+	})
+	if err := cli.Start(context.Background()); err != nil {
+		panic(err)
 	}
 	if !join {
-		id2 := ackId.Add(1)
-		err := cli.Send(&webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_JoinGroupMessage_{JoinGroupMessage: &webpubsub.UpstreamMessage_JoinGroupMessage{
-			Group: "golang",
-			AckId: &id2,
-		}}})
+		err := cli.JoinGroup(context.Background(), "golang")
 		join = true
 		if err != nil {
 			panic(err)
@@ -41,11 +42,10 @@ func main() {
 		for scanner.Scan() {
 			line := scanner.Text()
 
-			id3 := ackId.Add(1)
-			noecho := true
-			cli.Send(&webpubsub.UpstreamMessage{
-				Message: &webpubsub.UpstreamMessage_SendToGroupMessage_{SendToGroupMessage: &webpubsub.UpstreamMessage_SendToGroupMessage{Group: "golang", AckId: &id3, NoEcho: &noecho, Data: &webpubsub.MessageData{Data: &webpubsub.MessageData_TextData{TextData: line}}}},
-			})
+			data := &webpubsub.MessageData{Data: &webpubsub.MessageData_TextData{TextData: line}}
+			if err := cli.SendToGroup(context.Background(), "golang", data, true); err != nil {
+				fmt.Println(err)
+			}
 		}
 	}
 }
@@ -1,7 +1,14 @@
 package main
 
-import "reliablesocket"
+import (
+	"fmt"
+	"reliablesocket"
+)
 
 func main() {
-	reliablesocket.Start()
+	s := reliablesocket.NewServer()
+	s.Hub("testhub").On("message", func(arg reliablesocket.PeerEvent) {
+		fmt.Println("message from simple client", arg.Peer.PeerId, arg.Data)
+	})
+	s.ListenAndServe("0.0.0.0:1234")
 }
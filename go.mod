@@ -4,8 +4,10 @@ go 1.24.2
 
 require (
 	github.com/coder/websocket v1.8.13
+	github.com/orcaman/concurrent-map/v2 v2.0.1
 	github.com/rs/xid v1.6.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
 	google.golang.org/protobuf v1.36.6
 )
 
-require github.com/orcaman/concurrent-map/v2 v2.0.1 // indirect
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
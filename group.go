@@ -9,14 +9,29 @@ import (
 type Group struct {
 	groupId string
 	peers   cmap.ConcurrentMap[string, *Peer]
+	hub     *Hub
 }
 
+// Send sends a message of fromPeerId to the group. The members of every
+// node get it, in the order of the history of the group if it keeps one.
 func (g *Group) Send(fromPeerId string, noecho bool, data *webpubsub.MessageData) {
-	g.peers.IterCb(func(key string, v *Peer) {
-		peerId := key
-		if noecho && peerId == fromPeerId {
-			return
+	g.hub.sendGroup(&BackplaneMessage{Type: bpGroupMessage, Group: g.groupId, ConnectionId: fromPeerId, NoEcho: noecho, Data: data})
+}
+
+// deliver sends a group message to the local members.
+func (g *Group) deliver(fromPeerId string, noecho bool, data *webpubsub.MessageData, m *HistoryMessage) {
+	flushEach(g.queue(fromPeerId, noecho, data, m))
+}
+
+// queue queues a group message for the local members and returns them, to
+// be flushed once the history of the group is released.
+func (g *Group) queue(fromPeerId string, noecho bool, data *webpubsub.MessageData, m *HistoryMessage) []*Peer {
+	peers := make([]*Peer, 0, g.peers.Count())
+	for peerId, p := range g.peers.Items() {
+		if !noecho || peerId != fromPeerId {
+			p.queueGroupMessage(g.groupId, data, m, false)
+			peers = append(peers, p)
 		}
-		v.sendDownStreamDataMessage(data)
-	})
+	}
+	return peers
 }
@@ -0,0 +1,247 @@
+package reliablesocket
+
+import (
+	"errors"
+	"reliablesocket/proto/webpubsub"
+	"sync"
+	"time"
+)
+
+// HistoryMessage is a group message kept by a HistoryStore. SequenceId
+// numbers the messages of a group from 1.
+type HistoryMessage struct {
+	SequenceId int64
+	Time       time.Time
+	Data       *webpubsub.MessageData
+}
+
+// HistoryQuery selects the messages replayed to a joining connection. The
+// zero query selects all the history kept.
+type HistoryQuery struct {
+	AfterSequenceId int64
+	Since           time.Time
+}
+
+func (q HistoryQuery) matches(m *HistoryMessage) bool {
+	return m.SequenceId > q.AfterSequenceId && !m.Time.Before(q.Since)
+}
+
+// HistoryStore keeps the history of groups. Calls for a group are
+// serialized by the hub.
+type HistoryStore interface {
+	// Append stores data sent to groupId at t and returns it numbered.
+	Append(groupId string, data *webpubsub.MessageData, t time.Time) (HistoryMessage, error)
+	// Query returns the messages of groupId matching q, oldest first.
+	Query(groupId string, q HistoryQuery) ([]HistoryMessage, error)
+	// Trim drops the messages of groupId beyond the latest maxMessages, if
+	// positive, and those sent before the given time.
+	Trim(groupId string, maxMessages int, before time.Time) error
+	// Delete forgets groupId.
+	Delete(groupId string) error
+}
+
+type memoryHistory struct {
+	lastSequenceId int64
+	messages       []HistoryMessage
+}
+
+// MemoryHistoryStore is a HistoryStore that keeps messages in memory.
+type MemoryHistoryStore struct {
+	mu     sync.Mutex
+	groups map[string]*memoryHistory
+}
+
+func NewMemoryHistoryStore() *MemoryHistoryStore {
+	return &MemoryHistoryStore{groups: map[string]*memoryHistory{}}
+}
+
+func (s *MemoryHistoryStore) Append(groupId string, data *webpubsub.MessageData, t time.Time) (HistoryMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[groupId]
+	if !ok {
+		g = &memoryHistory{}
+		s.groups[groupId] = g
+	}
+	g.lastSequenceId++
+	m := HistoryMessage{SequenceId: g.lastSequenceId, Time: t, Data: data}
+	g.messages = append(g.messages, m)
+	return m, nil
+}
+
+func (s *MemoryHistoryStore) Query(groupId string, q HistoryQuery) ([]HistoryMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[groupId]
+	if !ok {
+		return nil, nil
+	}
+	var messages []HistoryMessage
+	for i := range g.messages {
+		if q.matches(&g.messages[i]) {
+			messages = append(messages, g.messages[i])
+		}
+	}
+	return messages, nil
+}
+
+func (s *MemoryHistoryStore) Trim(groupId string, maxMessages int, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[groupId]
+	if !ok {
+		return nil
+	}
+	i := 0
+	if maxMessages > 0 && len(g.messages) > maxMessages {
+		i = len(g.messages) - maxMessages
+	}
+	for i < len(g.messages) && g.messages[i].Time.Before(before) {
+		i++
+	}
+	// Copy so the dropped messages can be collected.
+	g.messages = append([]HistoryMessage(nil), g.messages[i:]...)
+	return nil
+}
+
+func (s *MemoryHistoryStore) Delete(groupId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.groups, groupId)
+	return nil
+}
+
+// defaultHistoryMessages is how many messages a group keeps by default.
+const defaultHistoryMessages = 100
+
+type HistoryOptions struct {
+	// MaxMessages keeps only the latest messages, defaultHistoryMessages if
+	// zero. Negative means no limit.
+	MaxMessages int
+	// MaxAge keeps only the messages younger than it. Zero means no limit.
+	MaxAge time.Duration
+	// Store defaults to a MemoryHistoryStore shared by the hub.
+	Store HistoryStore
+}
+
+// groupHistory serializes recording and replaying the history of a group, so
+// a joining connection gets every message exactly once: either replayed or
+// live.
+type groupHistory struct {
+	mu   sync.Mutex
+	opts HistoryOptions
+}
+
+// ErrHistoryNotSharded is returned for history on a hub whose backplane does
+// not shard groups, where every node would number the messages of a group on
+// its own.
+var ErrHistoryNotSharded = errors.New("group history needs ShardGroups on a backplane")
+
+// EnableHistory makes groupId keep the messages connections send to it and
+// replay them to connections joining it. On a backplane, it requires
+// Server.ShardGroups.
+func (h *Hub) EnableHistory(groupId string, opts HistoryOptions) error {
+	if b := h.backplane.Load(); b != nil && b.ring == nil {
+		return ErrHistoryNotSharded
+	}
+	if opts.Store == nil {
+		opts.Store = h.historyStore
+	}
+	if opts.MaxMessages == 0 {
+		opts.MaxMessages = defaultHistoryMessages
+	}
+	h.history.Set(groupId, &groupHistory{opts: opts})
+	return nil
+}
+
+// DisableHistory stops recording groupId and deletes its history.
+func (h *Hub) DisableHistory(groupId string) {
+	if gh, ok := h.history.Pop(groupId); ok {
+		gh.mu.Lock()
+		defer gh.mu.Unlock()
+		gh.opts.Store.Delete(groupId)
+	}
+}
+
+// GroupHistory returns the messages of groupId matching q.
+func (h *Hub) GroupHistory(groupId string, q HistoryQuery) ([]HistoryMessage, error) {
+	gh, ok := h.history.Get(groupId)
+	if !ok {
+		return nil, nil
+	}
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	return gh.query(groupId, q)
+}
+
+// JoinGroupWithHistory adds peerId to groupId and replays to it the history
+// matching q. At most half the unacknowledged messages a connection may have
+// are replayed, the latest ones.
+func (h *Hub) JoinGroupWithHistory(groupId, peerId string, q HistoryQuery) error {
+	gh, ok := h.history.Get(groupId)
+	if !ok {
+		return h.AddConnectionToGroup(groupId, peerId)
+	}
+	p, err := h.queueHistory(gh, groupId, peerId, q)
+	if err != nil {
+		return err
+	}
+	return p.flush()
+}
+
+// queueHistory adds peerId to groupId and queues the history replayed to it,
+// under gh.mu so it gets every message of the group exactly once: either
+// replayed or live.
+func (h *Hub) queueHistory(gh *groupHistory, groupId, peerId string, q HistoryQuery) (*Peer, error) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	if err := h.AddConnectionToGroup(groupId, peerId); err != nil {
+		return nil, err
+	}
+	messages, err := gh.query(groupId, q)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := h.peers.Get(peerId)
+	if !ok {
+		return nil, ErrConnectionNotFound
+	}
+	if room := p.replayRoom(); len(messages) > room {
+		messages = messages[len(messages)-room:]
+	}
+	for i := range messages {
+		if err := p.queueGroupMessage(groupId, messages[i].Data, &messages[i], true); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// query trims the expired messages before returning the matching ones. The
+// caller holds gh.mu.
+func (gh *groupHistory) query(groupId string, q HistoryQuery) ([]HistoryMessage, error) {
+	if gh.opts.MaxAge > 0 {
+		if err := gh.opts.Store.Trim(groupId, gh.opts.MaxMessages, time.Now().Add(-gh.opts.MaxAge)); err != nil {
+			return nil, err
+		}
+	}
+	return gh.opts.Store.Query(groupId, q)
+}
+
+// record stores data sent to groupId. The caller holds gh.mu until the
+// message is delivered.
+func (gh *groupHistory) record(groupId string, data *webpubsub.MessageData) (*HistoryMessage, error) {
+	now := time.Now()
+	m, err := gh.opts.Store.Append(groupId, data, now)
+	if err != nil {
+		return nil, err
+	}
+	var before time.Time
+	if gh.opts.MaxAge > 0 {
+		before = now.Add(-gh.opts.MaxAge)
+	}
+	if err := gh.opts.Store.Trim(groupId, gh.opts.MaxMessages, before); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
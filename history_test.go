@@ -0,0 +1,274 @@
+package reliablesocket
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reliablesocket/proto/webpubsub"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupHistory(t *testing.T) {
+	s := NewServer()
+	s.Hub("chat").EnableHistory("room", HistoryOptions{MaxMessages: 3})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	alice := newTestClient(t, ts, "alice")
+	if err := alice.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := alice.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := alice.SendToGroup(ctx, "room", textData(strconv.Itoa(i)), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	join := func(user string, opts JoinGroupOptions) chan *GroupMessage {
+		c := newTestClient(t, ts, user)
+		messages := make(chan *GroupMessage, 8)
+		c.OnGroupMessage(func(msg *GroupMessage) { messages <- msg })
+		if err := c.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if err := c.JoinGroupWithOptions(ctx, "room", opts); err != nil {
+			t.Fatal(err)
+		}
+		return messages
+	}
+	expect := func(messages chan *GroupMessage, text string, seq int64, history bool) {
+		t.Helper()
+		select {
+		case msg := <-messages:
+			if msg.Data.Text != text || msg.GroupSequenceId != seq || msg.History != history || msg.Time.IsZero() {
+				t.Fatalf("got %+v, want %q with group sequence id %d", msg, text, seq)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no message %q", text)
+		}
+	}
+
+	// Only the last three messages are kept.
+	bob := join("bob", JoinGroupOptions{})
+	expect(bob, "3", 3, true)
+	expect(bob, "4", 4, true)
+	expect(bob, "5", 5, true)
+
+	carol := join("carol", JoinGroupOptions{HistoryAfterSequenceId: 4})
+	expect(carol, "5", 5, true)
+
+	dave := join("dave", JoinGroupOptions{HistorySince: time.Now().Add(time.Minute)})
+
+	if err := alice.SendToGroup(ctx, "room", textData("6"), true); err != nil {
+		t.Fatal(err)
+	}
+	expect(bob, "6", 6, false)
+	expect(carol, "6", 6, false)
+	expect(dave, "6", 6, false)
+}
+
+func TestMemoryHistoryStoreTrim(t *testing.T) {
+	s := NewMemoryHistoryStore()
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		s.Append("g", textData(strconv.Itoa(i)), start.Add(time.Duration(i)*time.Minute))
+	}
+	if err := s.Trim("g", 0, start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := s.Query("g", HistoryQuery{})
+	if len(got) != 3 || got[0].SequenceId != 2 {
+		t.Fatalf("after trimming by age: %+v", got)
+	}
+	got, _ = s.Query("g", HistoryQuery{Since: start.Add(3 * time.Minute)})
+	if len(got) != 1 || got[0].SequenceId != 4 {
+		t.Fatalf("since: %+v", got)
+	}
+	s.Trim("g", 1, time.Time{})
+	s.Append("g", textData("4"), start)
+	if got, _ := s.Query("g", HistoryQuery{}); len(got) != 2 || got[1].SequenceId != 5 {
+		t.Fatalf("after trimming by count: %+v", got)
+	}
+}
+
+func TestHistoryReplayLimit(t *testing.T) {
+	s := NewServer()
+	hub := s.Hub("chat")
+	hub.EnableHistory("default", HistoryOptions{})
+	hub.EnableHistory("room", HistoryOptions{MaxMessages: -1})
+	sent := 3 * maxUnackedMessages / 2
+	for i := 1; i <= sent; i++ {
+		for _, group := range []string{"default", "room"} {
+			hub.sendGroup(&BackplaneMessage{Type: bpGroupMessage, Group: group, Data: textData(strconv.Itoa(i))})
+		}
+	}
+	if got, _ := hub.GroupHistory("default", HistoryQuery{}); len(got) != defaultHistoryMessages {
+		t.Fatalf("%d messages kept by default, want %d", len(got), defaultHistoryMessages)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A history longer than the unacked budget does not close the
+	// connection joining: only its latest messages are replayed.
+	c := newTestClient(t, ts, "alice")
+	messages := make(chan *GroupMessage, maxUnackedMessages)
+	disconnected := make(chan *DisconnectedEvent, 1)
+	c.OnGroupMessage(func(msg *GroupMessage) { messages <- msg })
+	c.OnDisconnected(func(e *DisconnectedEvent) { disconnected <- e })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	replayed := maxUnackedMessages / 2
+	for i := sent - replayed + 1; i <= sent; i++ {
+		select {
+		case msg := <-messages:
+			if !msg.History || msg.GroupSequenceId != int64(i) {
+				t.Fatalf("got %+v, want history message %d", msg, i)
+			}
+		case e := <-disconnected:
+			t.Fatalf("disconnected: %+v", e)
+		case <-ctx.Done():
+			t.Fatalf("history message %d not replayed", i)
+		}
+	}
+	hub.sendGroup(&BackplaneMessage{Type: bpGroupMessage, Group: "room", Data: textData("live")})
+	if msg := <-messages; msg.History || msg.Data.Text != "live" {
+		t.Fatalf("got %+v, want the live message", msg)
+	}
+}
+
+// failingHistoryStore fails to record any message.
+type failingHistoryStore struct {
+	*MemoryHistoryStore
+}
+
+func (failingHistoryStore) Append(groupId string, data *webpubsub.MessageData, t time.Time) (HistoryMessage, error) {
+	return HistoryMessage{}, errors.New("store down")
+}
+
+func TestHistoryNotRecorded(t *testing.T) {
+	s := NewServer()
+	reported := make(chan error, 1)
+	s.OnError = func(err error) { reported <- err }
+	hub := s.Hub("chat")
+	hub.EnableHistory("room", HistoryOptions{Store: failingHistoryStore{NewMemoryHistoryStore()}})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := newTestClient(t, ts, "alice")
+	messages := make(chan *GroupMessage, 1)
+	c.OnGroupMessage(func(msg *GroupMessage) { messages <- msg })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The message is still delivered, without a group sequence id.
+	if err := c.SendToGroup(ctx, "room", textData("hi"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-reported; !strings.Contains(err.Error(), "history not recorded: store down") {
+		t.Fatalf("reported %v", err)
+	}
+	if msg := <-messages; msg.Data.Text != "hi" || msg.GroupSequenceId != 0 {
+		t.Fatalf("got %+v", msg)
+	}
+}
+
+func TestClusterHistory(t *testing.T) {
+	if err := newTestCluster(t, 2).hub(0).EnableHistory("room", HistoryOptions{}); !errors.Is(err, ErrHistoryNotSharded) {
+		t.Fatalf("history enabled without sharding: %v", err)
+	}
+	s := NewServer()
+	s.Hub("chat").EnableHistory("room", HistoryOptions{})
+	if err := s.UseBackplane(NewMemoryBackplane()); !errors.Is(err, ErrHistoryNotSharded) {
+		t.Fatalf("backplane used without sharding: %v", err)
+	}
+
+	// With sharded groups, the owner numbers the messages sent on any node.
+	c := newTestCluster(t, 2, func(s *Server) { s.ShardGroups = true })
+	store := NewMemoryHistoryStore()
+	for i := 0; i < 2; i++ {
+		if err := c.hub(i).EnableHistory("room", HistoryOptions{Store: store}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for c.hub(0).backplane.Load().ring.size() != 2 || c.hub(1).backplane.Load().ring.size() != 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		c.route(i)
+		cl := newTestClient(t, c.front, "u"+strconv.Itoa(i))
+		if err := cl.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer cl.Close()
+		if err := cl.JoinGroup(ctx, "room"); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 2; j++ {
+			if err := cl.SendToGroup(ctx, "room", textData(strconv.Itoa(i)), false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for {
+		messages, _ := store.Query("room", HistoryQuery{})
+		if len(messages) == 4 {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("history %v", messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.route(1)
+	joiner := newTestClient(t, c.front, "joiner")
+	messages := make(chan *GroupMessage, 8)
+	joiner.OnGroupMessage(func(msg *GroupMessage) { messages <- msg })
+	if err := joiner.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer joiner.Close()
+	if err := joiner.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	sent := map[string]int{}
+	for seq := int64(1); seq <= 4; seq++ {
+		select {
+		case msg := <-messages:
+			if !msg.History || msg.GroupSequenceId != seq {
+				t.Fatalf("got %+v, want history message %d", msg, seq)
+			}
+			sent[msg.Data.Text]++
+		case <-ctx.Done():
+			t.Fatalf("history message %d not replayed", seq)
+		}
+	}
+	if sent["0"] != 2 || sent["1"] != 2 {
+		t.Fatalf("replayed %v", sent)
+	}
+}
@@ -1,51 +1,414 @@
 package reliablesocket
 
 import (
+	"errors"
+	"fmt"
+	"reliablesocket/events"
+	"reliablesocket/proto/webpubsub"
+	"sync"
+	"sync/atomic"
+
 	cmap "github.com/orcaman/concurrent-map/v2"
 )
 
+// Hub re-emits the events of all its peers, with PeerEvent.Peer set.
+//
+// Operations on connections, users and groups apply to the local
+// connections and, when the hub is attached to a backplane, are published
+// for the other nodes to apply to theirs.
 type Hub struct {
 	hubId  string
 	groups cmap.ConcurrentMap[string, *Group]
 	peers  cmap.ConcurrentMap[string, *Peer]
+	// users indexes the connections of every user id.
+	users cmap.ConcurrentMap[string, cmap.ConcurrentMap[string, *Peer]]
+	// groupsMu serializes membership changes so groups and Peer.groups
+	// always agree.
+	groupsMu sync.Mutex
+	webhook  atomic.Pointer[Webhook]
+	// invokeHandlers maps invocation targets to their handler.
+	invokeHandlers cmap.ConcurrentMap[string, InvokeHandler]
+	// presence holds the trackers of the groups with presence enabled.
+	presence cmap.ConcurrentMap[string, *presence]
+	// history holds the groups that keep history. historyStore is the
+	// default store.
+	history      cmap.ConcurrentMap[string, *groupHistory]
+	historyStore HistoryStore
+	// log records the reliable connections so they survive a restart.
+	log atomic.Pointer[MessageLog]
+	// backplane connects the hub to its peers on other nodes, remote is
+	// what it knows of their connections.
+	backplane atomic.Pointer[hubBackplane]
+	remote    *remoteIndex
+	// transfers holds the recoveries waiting for another node to hand over
+	// the session of their connection.
+	transfers cmap.ConcurrentMap[string, chan *Peer]
+	// onError receives the errors of the hub, see Server.OnError.
+	onError func(err error)
+	events.EventEmmiter[PeerEvent]
+}
+
+func newHub(hubId string) *Hub {
+	return &Hub{
+		hubId:          hubId,
+		groups:         cmap.New[*Group](),
+		peers:          cmap.New[*Peer](),
+		users:          cmap.New[cmap.ConcurrentMap[string, *Peer]](),
+		invokeHandlers: cmap.New[InvokeHandler](),
+		presence:       cmap.New[*presence](),
+		history:        cmap.New[*groupHistory](),
+		historyStore:   NewMemoryHistoryStore(),
+		remote:         newRemoteIndex(),
+		transfers:      cmap.New[chan *Peer](),
+		EventEmmiter:   events.New[PeerEvent](),
+	}
+}
+
+var ErrConnectionNotFound = errors.New("connection not found")
+
+func (h *Hub) report(err error) {
+	if h.onError != nil {
+		h.onError(fmt.Errorf("hub %s: %w", h.hubId, err))
+	}
 }
 
 func (h *Hub) AddPeer(p *Peer) {
 	h.peers.Set(p.PeerId, p)
+	if p.reliable {
+		h.log.Load().logPeer(h.hubId, p)
+	}
+	h.publish(&BackplaneMessage{Type: bpConnected, ConnectionId: p.PeerId, UserId: p.UserId})
+	if p.UserId == "" {
+		return
+	}
+	h.users.Upsert(p.UserId, cmap.ConcurrentMap[string, *Peer]{}, func(exist bool, conns cmap.ConcurrentMap[string, *Peer], _ cmap.ConcurrentMap[string, *Peer]) cmap.ConcurrentMap[string, *Peer] {
+		if !exist {
+			conns = cmap.New[*Peer]()
+		}
+		conns.Set(p.PeerId, p)
+		return conns
+	})
 }
 
 func (h *Hub) RemovePeer(peerId string) {
+	p, ok := h.peers.Get(peerId)
+	if !ok {
+		return
+	}
+	h.removePeerFromAllGroups(p)
 	h.peers.Remove(peerId)
+	if p.reliable {
+		h.log.Load().append(&logRecord{Type: logDied, Hub: h.hubId, ConnectionId: peerId})
+	}
+	h.publish(&BackplaneMessage{Type: bpDisconnected, ConnectionId: peerId})
+	if p.UserId == "" {
+		return
+	}
+	h.users.RemoveCb(p.UserId, func(key string, conns cmap.ConcurrentMap[string, *Peer], exists bool) bool {
+		if !exists {
+			return false
+		}
+		conns.Remove(peerId)
+		return conns.IsEmpty()
+	})
 }
 
-func (h *Hub) JoinGroup(groupId, peerId string) {
-	p, ok := h.peers.Get(peerId)
+// userPeers returns a snapshot of the connections of userId.
+func (h *Hub) userPeers(userId string) []*Peer {
+	conns, ok := h.users.Get(userId)
+	if !ok {
+		return nil
+	}
+	peers := make([]*Peer, 0, conns.Count())
+	for _, p := range conns.Items() {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// UserExists reports whether userId has at least one connection, including
+// connections waiting to be recovered.
+func (h *Hub) UserExists(userId string) bool {
+	return h.users.Has(userId) || h.remote.hasUser(userId)
+}
+
+// ConnectionExists reports whether connectionId is connected or waiting to
+// be recovered.
+func (h *Hub) ConnectionExists(connectionId string) bool {
+	if p, ok := h.peers.Get(connectionId); ok {
+		return p.status.Load() != peerStatusDied
+	}
+	return h.remote.hasConnection(connectionId)
+}
 
-	if ok {
-		pp := p
-		if pp.group != nil && pp.group.groupId == groupId {
-			return
+// AddUserToGroup adds every connection of userId to groupId.
+func (h *Hub) AddUserToGroup(groupId, userId string) {
+	h.addUserToGroup(groupId, userId)
+	h.publish(&BackplaneMessage{Type: bpAddUserToGroup, Group: groupId, UserId: userId})
+}
+
+func (h *Hub) addUserToGroup(groupId, userId string) {
+	for _, p := range h.userPeers(userId) {
+		h.addConnectionToGroup(groupId, p.PeerId)
+	}
+}
+
+// CloseConnection sends a DisconnectedMessage with reason and closes the
+// connection. It cannot be recovered.
+func (h *Hub) CloseConnection(connectionId, reason string) error {
+	p, ok := h.peers.Get(connectionId)
+	if !ok {
+		if !h.remote.hasConnection(connectionId) {
+			return ErrConnectionNotFound
 		}
-		if pp.group != nil {
-			pp.group.peers.Remove(peerId)
+		h.publish(&BackplaneMessage{Type: bpCloseConnection, ConnectionId: connectionId, Reason: reason})
+		return nil
+	}
+	p.abort(reason)
+	return nil
+}
+
+// CloseUserConnections closes every connection of userId.
+func (h *Hub) CloseUserConnections(userId, reason string) {
+	h.closeUserConnections(userId, reason)
+	h.publish(&BackplaneMessage{Type: bpCloseUserConnections, UserId: userId, Reason: reason})
+}
+
+func (h *Hub) closeUserConnections(userId, reason string) {
+	for _, p := range h.userPeers(userId) {
+		p.abort(reason)
+	}
+}
+
+// JoinGroup adds peerId to groupId and replays the history of the group to
+// it, if it keeps one.
+func (h *Hub) JoinGroup(groupId, peerId string) {
+	h.JoinGroupWithHistory(groupId, peerId, HistoryQuery{})
+}
+
+// LeaveGroup removes peerId from groupId, as requested by a LeaveGroupMessage.
+func (h *Hub) LeaveGroup(groupId, peerId string) {
+	h.RemoveConnectionFromGroup(groupId, peerId)
+}
+
+// AddConnectionToGroup adds a connection to a group. Connections waiting to
+// be recovered can be added too; they keep their groups when they recover.
+func (h *Hub) AddConnectionToGroup(groupId, connectionId string) error {
+	if !h.peers.Has(connectionId) && h.remote.hasConnection(connectionId) {
+		h.publish(&BackplaneMessage{Type: bpAddConnectionToGroup, Group: groupId, ConnectionId: connectionId})
+		return nil
+	}
+	return h.addConnectionToGroup(groupId, connectionId)
+}
+
+func (h *Hub) addConnectionToGroup(groupId, connectionId string) error {
+	p, ok := h.peers.Get(connectionId)
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	h.groupsMu.Lock()
+	defer h.groupsMu.Unlock()
+	if p.status.Load() == peerStatusDied {
+		return ErrConnectionNotFound
+	}
+	g, ok := h.groups.Get(groupId)
+	if !ok {
+		g = &Group{groupId: groupId, peers: cmap.New[*Peer](), hub: h}
+		h.groups.Set(groupId, g)
+	}
+	if !g.peers.Has(connectionId) {
+		g.peers.Set(connectionId, p)
+		h.memberJoined(groupId, p)
+	}
+	p.groups.Set(groupId, g)
+	return nil
+}
+
+func (h *Hub) RemoveConnectionFromGroup(groupId, connectionId string) {
+	if !h.peers.Has(connectionId) {
+		h.publish(&BackplaneMessage{Type: bpRemoveConnectionFromGroup, Group: groupId, ConnectionId: connectionId})
+		return
+	}
+	h.removeConnectionFromGroup(groupId, connectionId)
+}
+
+func (h *Hub) removeConnectionFromGroup(groupId, connectionId string) {
+	h.groupsMu.Lock()
+	defer h.groupsMu.Unlock()
+	h.removeFromGroup(groupId, connectionId)
+}
+
+// removeFromGroup drops connectionId from groupId, and the group once it is
+// empty. The caller holds groupsMu.
+func (h *Hub) removeFromGroup(groupId, connectionId string) {
+	if p, ok := h.peers.Get(connectionId); ok {
+		p.groups.Remove(groupId)
+	}
+	g, ok := h.groups.Get(groupId)
+	if !ok {
+		return
+	}
+	if p, ok := g.peers.Pop(connectionId); ok {
+		h.memberLeft(groupId, p)
+	}
+	if g.peers.IsEmpty() {
+		h.groups.Remove(groupId)
+	}
+}
+
+func (h *Hub) RemoveConnectionFromAllGroups(connectionId string) {
+	p, ok := h.peers.Get(connectionId)
+	if !ok {
+		h.publish(&BackplaneMessage{Type: bpRemoveConnectionFromAllGroups, ConnectionId: connectionId})
+		return
+	}
+	h.removePeerFromAllGroups(p)
+}
+
+func (h *Hub) removePeerFromAllGroups(p *Peer) {
+	h.groupsMu.Lock()
+	defer h.groupsMu.Unlock()
+	for _, groupId := range p.groups.Keys() {
+		p.groups.Remove(groupId)
+		if g, ok := h.groups.Get(groupId); ok {
+			if _, ok := g.peers.Pop(p.PeerId); ok {
+				h.memberLeft(groupId, p)
+			}
+			if g.peers.IsEmpty() {
+				h.groups.Remove(groupId)
+			}
 		}
-		g, ok2 := h.groups.Get(groupId)
-		if ok2 {
-			gg := g
-			gg.peers.Set(peerId, p)
-			pp.group = gg
-		} else {
-			gg := &Group{groupId: groupId, peers: cmap.ConcurrentMap[string, *Peer]{}}
-			gg.peers.Set(peerId, p)
-			h.groups.Set(groupId, gg)
-			pp.group = gg
+	}
+}
+
+func (h *Hub) RemoveUserFromGroup(groupId, userId string) {
+	h.removeUserFromGroup(groupId, userId)
+	h.publish(&BackplaneMessage{Type: bpRemoveUserFromGroup, Group: groupId, UserId: userId})
+}
+
+func (h *Hub) removeUserFromGroup(groupId, userId string) {
+	h.groupsMu.Lock()
+	defer h.groupsMu.Unlock()
+	for _, p := range h.userPeers(userId) {
+		h.removeFromGroup(groupId, p.PeerId)
+	}
+}
+
+func (h *Hub) RemoveUserFromAllGroups(userId string) {
+	h.removeUserFromAllGroups(userId)
+	h.publish(&BackplaneMessage{Type: bpRemoveUserFromAllGroups, UserId: userId})
+}
+
+func (h *Hub) removeUserFromAllGroups(userId string) {
+	for _, p := range h.userPeers(userId) {
+		h.removePeerFromAllGroups(p)
+	}
+}
+
+// CloseGroup removes every connection from groupId.
+func (h *Hub) CloseGroup(groupId string) {
+	h.closeGroup(groupId)
+	h.publish(&BackplaneMessage{Type: bpCloseGroup, Group: groupId})
+}
+
+func (h *Hub) closeGroup(groupId string) {
+	h.groupsMu.Lock()
+	defer h.groupsMu.Unlock()
+	g, ok := h.groups.Pop(groupId)
+	if !ok {
+		return
+	}
+	for _, p := range g.peers.Items() {
+		p.groups.Remove(groupId)
+		h.memberLeft(groupId, p)
+	}
+}
+
+// memberJoined and memberLeft are called under groupsMu when p joins or
+// leaves groupId. The other nodes are told in the order of the changes, by
+// the outbox of the backplane rather than under groupsMu.
+func (h *Hub) memberJoined(groupId string, p *Peer) {
+	h.presenceJoined(groupId, p)
+	if p.reliable {
+		h.log.Load().logMembership(logJoin, h.hubId, groupId, p)
+	}
+	h.publishLater(&BackplaneMessage{Type: bpJoined, Group: groupId, ConnectionId: p.PeerId})
+}
+
+func (h *Hub) memberLeft(groupId string, p *Peer) {
+	h.presenceLeft(groupId, p)
+	if p.reliable {
+		h.log.Load().logMembership(logLeave, h.hubId, groupId, p)
+	}
+	h.publishLater(&BackplaneMessage{Type: bpLeft, Group: groupId, ConnectionId: p.PeerId})
+}
+
+func (h *Hub) GroupExists(groupId string) bool {
+	return h.groups.Has(groupId) || h.remote.hasGroup(groupId)
+}
+
+// GroupMembers returns a snapshot of the local connections in groupId.
+func (h *Hub) GroupMembers(groupId string) []*Peer {
+	g, ok := h.groups.Get(groupId)
+	if !ok {
+		return nil
+	}
+	peers := make([]*Peer, 0, g.peers.Count())
+	for _, p := range g.peers.Items() {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// SendToConnection sends data from the server to one connection. Reliable
+// connections get it sequenced, queued while they wait to reconnect.
+func (h *Hub) SendToConnection(connectionId string, data *webpubsub.MessageData) error {
+	p, ok := h.peers.Get(connectionId)
+	if !ok {
+		if !h.remote.hasConnection(connectionId) {
+			return ErrConnectionNotFound
 		}
+		h.publish(&BackplaneMessage{Type: bpSendToConnection, ConnectionId: connectionId, Data: data})
+		return nil
 	}
+	return p.sendDownStreamDataMessage("server", nil, data)
 }
 
-func (h *Hub) LeaveGroup(groupId, peerId string) {
+// SendToUser sends data from the server to every connection of userId.
+func (h *Hub) SendToUser(userId string, data *webpubsub.MessageData) {
+	h.sendToUser(userId, data)
+	h.publish(&BackplaneMessage{Type: bpSendToUser, UserId: userId, Data: data})
+}
+
+func (h *Hub) sendToUser(userId string, data *webpubsub.MessageData) {
+	for _, p := range h.userPeers(userId) {
+		p.sendDownStreamDataMessage("server", nil, data)
+	}
+}
+
+// SendToGroup sends data from the server to every member of groupId except
+// the excluded connections.
+func (h *Hub) SendToGroup(groupId string, data *webpubsub.MessageData, excluded ...string) {
+	h.sendGroup(&BackplaneMessage{Type: bpSendToGroup, Group: groupId, Data: data, Excluded: excluded})
+}
+
+func (h *Hub) sendToGroup(groupId string, data *webpubsub.MessageData, excluded ...string) {
 	g, ok := h.groups.Get(groupId)
-	if ok {
-		g.peers.Remove(peerId)
+	if !ok {
+		return
 	}
+	sendToPeers(g.peers.Items(), data, excluded)
+}
+
+// SendToAll sends data from the server to every connection of the hub except
+// the excluded connections.
+func (h *Hub) SendToAll(data *webpubsub.MessageData, excluded ...string) {
+	h.sendToAll(data, excluded...)
+	h.publish(&BackplaneMessage{Type: bpSendToAll, Data: data, Excluded: excluded})
+}
+
+func (h *Hub) sendToAll(data *webpubsub.MessageData, excluded ...string) {
+	// Items copies the map, so a peer dying while we send cannot deadlock
+	// on the shard locks.
+	sendToPeers(h.peers.Items(), data, excluded)
 }
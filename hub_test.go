@@ -0,0 +1,225 @@
+package reliablesocket
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testConn is a Client connection recording the server messages it gets.
+type testConn struct {
+	*Client
+	id       string
+	messages chan string
+}
+
+func connectTestClient(ctx context.Context, t *testing.T, ts *httptest.Server, userId string) *testConn {
+	t.Helper()
+	c := &testConn{Client: newTestClient(t, ts, userId), messages: make(chan string, 16)}
+	connected := make(chan string, 1)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+	c.OnServerMessage(func(msg *ServerMessage) { c.messages <- msg.Data.Text })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	select {
+	case c.id = <-connected:
+	case <-ctx.Done():
+		t.Fatal("not connected")
+	}
+	return c
+}
+
+// expect checks the connection got exactly want since the last call.
+func (c *testConn) expect(t *testing.T, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-c.messages:
+			if got != w {
+				t.Fatalf("%s got %q, want %q", c.id, got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not get %q", c.id, w)
+		}
+	}
+	select {
+	case got := <-c.messages:
+		t.Fatalf("%s got %q", c.id, got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHubSend(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	hub := s.Hub("chat")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	alice := connectTestClient(ctx, t, ts, "alice")
+	bob := connectTestClient(ctx, t, ts, "bob")
+	carol := connectTestClient(ctx, t, ts, "carol")
+	for _, c := range []*testConn{alice, carol} {
+		if err := c.JoinGroup(ctx, "room"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := hub.SendToConnection(alice.id, textData("to alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.SendToConnection("missing", textData("lost")); !errors.Is(err, ErrConnectionNotFound) {
+		t.Fatalf("got %v, want ErrConnectionNotFound", err)
+	}
+	hub.SendToUser("bob", textData("to bob"))
+	hub.SendToUser("nobody", textData("lost"))
+	hub.SendToGroup("room", textData("to room"), carol.id)
+	hub.SendToGroup("empty", textData("lost"))
+	hub.SendToAll(textData("to all"), bob.id)
+
+	alice.expect(t, "to alice", "to room", "to all")
+	bob.expect(t, "to bob")
+	carol.expect(t, "to all")
+}
+
+func TestHubUsers(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	hub := s.Hub("chat")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	phone := connectTestClient(ctx, t, ts, "alice")
+	laptop := connectTestClient(ctx, t, ts, "alice")
+	bob := connectTestClient(ctx, t, ts, "bob")
+
+	hub.SendToUser("alice", textData("to alice"))
+	phone.expect(t, "to alice")
+	laptop.expect(t, "to alice")
+	bob.expect(t)
+
+	// The user stays until its last connection is gone.
+	phone.Close()
+	for hub.ConnectionExists(phone.id) {
+		if ctx.Err() != nil {
+			t.Fatal("closed connection kept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !hub.UserExists("alice") {
+		t.Fatal("user removed with one connection left")
+	}
+	hub.SendToUser("alice", textData("still there"))
+	laptop.expect(t, "still there")
+
+	disconnected := make(chan string, 1)
+	laptop.OnDisconnected(func(e *DisconnectedEvent) { disconnected <- e.Reason })
+	hub.CloseUserConnections("alice", "signed out")
+	if reason := <-disconnected; reason != "signed out" {
+		t.Fatalf("disconnected with %q", reason)
+	}
+	if hub.ConnectionExists(laptop.id) {
+		t.Fatal("connection kept after CloseUserConnections")
+	}
+	// The client connects again on its own; once it stops the user is gone.
+	laptop.Close()
+	for hub.UserExists("alice") {
+		if ctx.Err() != nil {
+			t.Fatal("user kept after its connections closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !hub.UserExists("bob") {
+		t.Fatal("other user removed")
+	}
+}
+
+func TestHubGroups(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	hub := s.Hub("chat")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	phone := connectTestClient(ctx, t, ts, "alice")
+	laptop := connectTestClient(ctx, t, ts, "alice")
+	bob := connectTestClient(ctx, t, ts, "bob")
+	members := func(groupId string) []string {
+		var ids []string
+		for _, p := range hub.GroupMembers(groupId) {
+			ids = append(ids, p.PeerId)
+		}
+		slices.Sort(ids)
+		return ids
+	}
+	want := func(ids ...string) []string {
+		slices.Sort(ids)
+		return ids
+	}
+
+	if err := hub.AddConnectionToGroup("room", bob.id); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.AddConnectionToGroup("room", "missing"); !errors.Is(err, ErrConnectionNotFound) {
+		t.Fatalf("got %v, want ErrConnectionNotFound", err)
+	}
+	hub.AddUserToGroup("room", "alice")
+	if got := members("room"); !slices.Equal(got, want(phone.id, laptop.id, bob.id)) {
+		t.Fatalf("room members %v", got)
+	}
+	hub.SendToGroup("room", textData("hi"))
+	for _, c := range []*testConn{phone, laptop, bob} {
+		c.expect(t, "hi")
+	}
+
+	hub.RemoveConnectionFromGroup("room", phone.id)
+	if got := members("room"); !slices.Equal(got, want(laptop.id, bob.id)) {
+		t.Fatalf("room members %v", got)
+	}
+	hub.RemoveUserFromGroup("room", "alice")
+	if got := members("room"); !slices.Equal(got, want(bob.id)) {
+		t.Fatalf("room members %v", got)
+	}
+
+	// Groups go away with their last member.
+	hub.AddConnectionToGroup("other", bob.id)
+	hub.RemoveConnectionFromAllGroups(bob.id)
+	if hub.GroupExists("room") || hub.GroupExists("other") {
+		t.Fatal("empty groups kept")
+	}
+	hub.AddUserToGroup("room", "alice")
+	hub.AddUserToGroup("other", "alice")
+	hub.RemoveUserFromAllGroups("alice")
+	if hub.GroupExists("room") || hub.GroupExists("other") {
+		t.Fatal("empty groups kept")
+	}
+
+	hub.AddUserToGroup("closing", "alice")
+	hub.AddUserToGroup("closing", "bob")
+	hub.CloseGroup("closing")
+	if hub.GroupExists("closing") || len(members("closing")) != 0 {
+		t.Fatal("group not closed")
+	}
+	hub.SendToGroup("closing", textData("lost"))
+	for _, c := range []*testConn{phone, laptop, bob} {
+		c.expect(t)
+		if !hub.ConnectionExists(c.id) {
+			t.Fatal("CloseGroup closed a connection")
+		}
+	}
+
+	// A closed connection leaves its groups.
+	hub.AddConnectionToGroup("room", phone.id)
+	phone.Close()
+	for hub.GroupExists("room") {
+		if ctx.Err() != nil {
+			t.Fatal("closed connection kept in its group")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
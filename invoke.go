@@ -0,0 +1,289 @@
+package reliablesocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reliablesocket/proto/webpubsub"
+	"strconv"
+	"time"
+)
+
+// InvokeRequest is an invocation received from a connection.
+type InvokeRequest struct {
+	Peer   *Peer
+	Target string
+	Data   *webpubsub.MessageData
+}
+
+// InvokeHandler answers an invocation. Its context is cancelled when the
+// caller cancels the invocation or the connection dies. Return an
+// *InvokeError to choose the error name the caller sees.
+type InvokeHandler func(ctx context.Context, req *InvokeRequest) (*webpubsub.MessageData, error)
+
+// InvokeError is the error side of an invocation response.
+type InvokeError struct {
+	Name    string
+	Message string
+}
+
+func (e *InvokeError) Error() string {
+	return fmt.Sprintf("invocation failed: %s: %s", e.Name, e.Message)
+}
+
+// HandleInvoke registers handler for invocations of target, replacing any
+// previous one. A nil handler removes it.
+func (h *Hub) HandleInvoke(target string, handler InvokeHandler) {
+	if handler == nil {
+		h.invokeHandlers.Remove(target)
+		return
+	}
+	h.invokeHandlers.Set(target, handler)
+}
+
+// handleInvoke runs the handler of an invocation in its own goroutine and
+// sends its result back.
+func (p *Peer) handleInvoke(x *webpubsub.UpstreamMessage_InvokeMessage) {
+	resp := &webpubsub.DownstreamMessage_InvokeResponseMessage{InvocationId: x.GetInvocationId()}
+	handler, ok := p.hub.invokeHandlers.Get(x.GetTarget())
+	if !ok {
+		resp.Error = &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: "NotFound", Message: "no handler for " + x.GetTarget()}
+		p.sendInvokeResponse(resp)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.invocations.Set(x.GetInvocationId(), cancel)
+	go func() {
+		defer func() {
+			p.invocations.Remove(x.GetInvocationId())
+			cancel()
+		}()
+		data, err := handler(ctx, &InvokeRequest{Peer: p, Target: x.GetTarget(), Data: x.GetData()})
+		if ctx.Err() != nil {
+			// Nobody waits for the response of a cancelled invocation.
+			return
+		}
+		if err != nil {
+			resp.Error = invokeErrorMessage(err)
+		} else {
+			resp.Success = true
+			resp.Data = data
+		}
+		p.sendInvokeResponse(resp)
+	}()
+}
+
+func (p *Peer) cancelInvocation(invocationId string) {
+	if cancel, ok := p.invocations.Pop(invocationId); ok {
+		cancel()
+	}
+}
+
+func (p *Peer) cancelInvocations() {
+	for _, id := range p.invocations.Keys() {
+		p.cancelInvocation(id)
+	}
+}
+
+func (p *Peer) sendInvokeResponse(msg *webpubsub.DownstreamMessage_InvokeResponseMessage) error {
+	return p.sendDownStream(&webpubsub.DownstreamMessage{
+		Message: &webpubsub.DownstreamMessage_InvokeResponseMessage_{InvokeResponseMessage: msg}})
+}
+
+func invokeErrorMessage(err error) *webpubsub.DownstreamMessage_AckMessage_ErrorMessage {
+	var ie *InvokeError
+	if errors.As(err, &ie) {
+		return &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: ie.Name, Message: ie.Message}
+	}
+	return &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: "InternalServerError", Message: err.Error()}
+}
+
+// Invoke calls the server handler registered for target and waits for its
+// response. Cancelling ctx cancels the invocation on the server too. Pending
+// invocations fail with ErrConnectionDropped when the connection drops.
+func (c *Client) Invoke(ctx context.Context, target string, data *webpubsub.MessageData) (MessageData, error) {
+	id := strconv.FormatInt(c.invocationId.Add(1), 10)
+	ch := make(chan *webpubsub.DownstreamMessage_InvokeResponseMessage, 1)
+	c.mu.Lock()
+	c.invocations[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.invocations, id)
+		c.mu.Unlock()
+	}()
+
+	err := c.Send(&webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_InvokeMessage_{
+		InvokeMessage: &webpubsub.UpstreamMessage_InvokeMessage{InvocationId: id, Target: target, Data: data},
+	}})
+	if err != nil {
+		return MessageData{}, err
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return MessageData{}, ErrConnectionDropped
+		}
+		if !resp.GetSuccess() {
+			return MessageData{}, &InvokeError{Name: resp.GetError().GetName(), Message: resp.GetError().GetMessage()}
+		}
+		return newMessageData(resp.GetData()), nil
+	case <-ctx.Done():
+		c.Send(&webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_CancelInvocationMessage_{
+			CancelInvocationMessage: &webpubsub.UpstreamMessage_CancelInvocationMessage{InvocationId: id},
+		}})
+		return MessageData{}, ctx.Err()
+	}
+}
+
+func (c *Client) resolveInvocation(msg *webpubsub.DownstreamMessage_InvokeResponseMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.invocations[msg.GetInvocationId()]; ok {
+		ch <- msg
+		delete(c.invocations, msg.GetInvocationId())
+	}
+}
+
+var (
+	ErrConnectionClosed   = errors.New("connection closed before the invocation completed")
+	ErrInvokeNotSupported = errors.New("connection does not support invocations")
+)
+
+// InvokeConnection calls the handler the client registered for target with
+// Client.Handle and waits for its response. The invocation is queued like
+// any sequenced message, so it survives the connection recovering within
+// the grace window. Cancelling ctx cancels it on the client too.
+func (h *Hub) InvokeConnection(ctx context.Context, connectionId, target string, data *webpubsub.MessageData) (*webpubsub.MessageData, error) {
+	p, ok := h.peers.Get(connectionId)
+	if !ok {
+		return nil, ErrConnectionNotFound
+	}
+	return p.invoke(ctx, target, data)
+}
+
+func (p *Peer) invoke(ctx context.Context, target string, data *webpubsub.MessageData) (*webpubsub.MessageData, error) {
+	if p.simple {
+		return nil, ErrInvokeNotSupported
+	}
+	id := strconv.FormatInt(p.invocationId.Add(1), 10)
+	ch := make(chan *webpubsub.UpstreamMessage_InvokeResponseMessage, 1)
+	p.pending.Set(id, ch)
+	defer p.pending.Remove(id)
+
+	err := p.sendSequenced(&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_InvokeMessage_{
+		InvokeMessage: &webpubsub.DownstreamMessage_InvokeMessage{InvocationId: id, Target: target, Data: data},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ch:
+		if !resp.GetSuccess() {
+			return nil, &InvokeError{Name: resp.GetError().GetName(), Message: resp.GetError().GetMessage()}
+		}
+		return resp.GetData(), nil
+	case <-p.dead:
+		return nil, ErrConnectionClosed
+	case <-ctx.Done():
+		p.sendDownStream(&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_CancelInvocationMessage_{
+			CancelInvocationMessage: &webpubsub.DownstreamMessage_CancelInvocationMessage{InvocationId: id},
+		}})
+		return nil, ctx.Err()
+	}
+}
+
+// ClientInvokeHandler answers an invocation from the service. Its context is
+// cancelled when the service cancels the invocation or the client closes.
+type ClientInvokeHandler func(ctx context.Context, data MessageData) (*webpubsub.MessageData, error)
+
+// Handle registers handler for invocations of target made with
+// Hub.InvokeConnection, replacing any previous one.
+func (c *Client) Handle(target string, handler ClientInvokeHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if handler == nil {
+		delete(c.handlers, target)
+		return
+	}
+	c.handlers[target] = handler
+}
+
+func (c *Client) handleInvoke(x *webpubsub.DownstreamMessage_InvokeMessage) {
+	resp := &webpubsub.UpstreamMessage_InvokeResponseMessage{InvocationId: x.GetInvocationId()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.mu.Lock()
+	handler, ok := c.handlers[x.GetTarget()]
+	if ok {
+		c.running[x.GetInvocationId()] = cancel
+	}
+	c.mu.Unlock()
+	if !ok {
+		resp.Error = &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: "NotFound", Message: "no handler for " + x.GetTarget()}
+		c.sendInvokeResponse(resp)
+		return
+	}
+	data, err := handler(ctx, newMessageData(x.GetData()))
+	c.mu.Lock()
+	delete(c.running, x.GetInvocationId())
+	c.mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		resp.Error = invokeErrorMessage(err)
+	} else {
+		resp.Success = true
+		resp.Data = data
+	}
+	c.sendInvokeResponse(resp)
+}
+
+// sendInvokeResponse sends resp until the service acks it. Responses lost
+// with a dropped connection are sent again once it is recovered; they are
+// given up when the client gets a new connection, as the service forgot the
+// invocation with the old one.
+func (c *Client) sendInvokeResponse(resp *webpubsub.UpstreamMessage_InvokeResponseMessage) {
+	c.mu.Lock()
+	peerId := c.peerId
+	c.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), recoveryTimeout)
+	defer cancel()
+	for {
+		_, err := c.SendWithAck(ctx, &webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_InvokeResponseMessage_{InvokeResponseMessage: resp}})
+		var ackErr *AckError
+		if err == nil || errors.As(err, &ackErr) {
+			return
+		}
+		c.mu.Lock()
+		sameConnection := c.peerId == peerId
+		c.mu.Unlock()
+		if c.isClosed() || !sameConnection || ctx.Err() != nil {
+			c.emitError(fmt.Errorf("invoke response not delivered: %w", err))
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (c *Client) cancelInvocation(invocationId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cancel, ok := c.running[invocationId]; ok {
+		cancel()
+		delete(c.running, invocationId)
+	}
+}
+
+func (c *Client) cancelInvocations() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, cancel := range c.running {
+		cancel()
+		delete(c.running, id)
+	}
+}
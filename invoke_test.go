@@ -0,0 +1,183 @@
+package reliablesocket
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reliablesocket/proto/webpubsub"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestInvoke(t *testing.T) {
+	s := NewServer()
+	hub := s.Hub("chat")
+	hub.HandleInvoke("echo", func(ctx context.Context, req *InvokeRequest) (*webpubsub.MessageData, error) {
+		return textData(req.Peer.UserId + ": " + req.Data.GetTextData()), nil
+	})
+	hub.HandleInvoke("fail", func(ctx context.Context, req *InvokeRequest) (*webpubsub.MessageData, error) {
+		return nil, &InvokeError{Name: "Forbidden", Message: "not allowed"}
+	})
+	cancelled := make(chan struct{})
+	hub.HandleInvoke("block", func(ctx context.Context, req *InvokeRequest) (*webpubsub.MessageData, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	for _, subprotocol := range []string{ProtobufReliableSubprotocol, JSONReliableSubprotocol, MsgpackReliableSubprotocol} {
+		t.Run(subprotocol, func(t *testing.T) {
+			c, err := NewClient(ClientOptions{
+				Endpoint:    "ws" + strings.TrimPrefix(ts.URL, "http"),
+				Hub:         "chat",
+				AccessToken: StaticAccessToken("alice"),
+				Subprotocol: subprotocol,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := c.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			got, err := c.Invoke(ctx, "echo", textData("hi"))
+			if err != nil || got.Text != "alice: hi" {
+				t.Fatalf("echo: got %q, %v", got.Text, err)
+			}
+			var ie *InvokeError
+			if _, err := c.Invoke(ctx, "fail", nil); !errors.As(err, &ie) || ie.Name != "Forbidden" {
+				t.Fatalf("fail: got %v, want Forbidden", err)
+			}
+			if _, err := c.Invoke(ctx, "missing", nil); !errors.As(err, &ie) || ie.Name != "NotFound" {
+				t.Fatalf("missing: got %v, want NotFound", err)
+			}
+		})
+	}
+
+	c := newTestClient(t, ts, "bob")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	short, stop := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer stop()
+	if _, err := c.Invoke(short, "block", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("block: got %v, want deadline exceeded", err)
+	}
+	select {
+	case <-cancelled:
+	case <-ctx.Done():
+		t.Fatal("handler context not cancelled")
+	}
+}
+
+func TestInvokeConnection(t *testing.T) {
+	s := NewServer()
+	hub := s.Hub("chat")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c := newTestClient(t, ts, "alice")
+	release := make(chan struct{})
+	c.Handle("state", func(ctx context.Context, data MessageData) (*webpubsub.MessageData, error) {
+		<-release
+		return textData("state of " + data.Text), nil
+	})
+	c.Handle("fail", func(ctx context.Context, data MessageData) (*webpubsub.MessageData, error) {
+		return nil, errors.New("broken")
+	})
+	connected := make(chan *ConnectedEvent, 1)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	connectionId := (<-connected).ConnectionId
+
+	var ie *InvokeError
+	if _, err := hub.InvokeConnection(ctx, connectionId, "fail", nil); !errors.As(err, &ie) || ie.Name != "InternalServerError" {
+		t.Fatalf("fail: got %v", err)
+	}
+	if _, err := hub.InvokeConnection(ctx, connectionId, "missing", nil); !errors.As(err, &ie) || ie.Name != "NotFound" {
+		t.Fatalf("missing: got %v", err)
+	}
+
+	// Drop the transport while the client is working on the invocation: the
+	// response must still arrive once the connection is recovered.
+	type result struct {
+		data *webpubsub.MessageData
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, err := hub.InvokeConnection(ctx, connectionId, "state", textData("alice"))
+		done <- result{data, err}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	p, _ := hub.peers.Get(connectionId)
+	p.conn.Load().(*websocket.Conn).CloseNow()
+	close(release)
+
+	select {
+	case r := <-done:
+		if r.err != nil || r.data.GetTextData() != "state of alice" {
+			t.Fatalf("state: got %v, %v", r.data, r.err)
+		}
+	case <-ctx.Done():
+		t.Fatal("invocation did not survive the reconnect")
+	}
+}
+
+func TestInvokeResponseNotDelivered(t *testing.T) {
+	s := newFakeService(t)
+	c, err := NewClient(ClientOptions{Endpoint: "ws" + strings.TrimPrefix(s.URL, "http"), Hub: "chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Handle("state", func(ctx context.Context, data MessageData) (*webpubsub.MessageData, error) {
+		return textData("state"), nil
+	})
+	reported := make(chan error, 1)
+	c.OnError(func(err error) { reported <- err })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer s.shutdown()
+
+	// The client closes while it waits for the ack of its response: the
+	// response is given up and reported.
+	conn := s.accept()
+	conn.sendConnected("conn1", "token1")
+	conn.send(&webpubsub.DownstreamMessage{Message: &webpubsub.DownstreamMessage_InvokeMessage_{InvokeMessage: &webpubsub.DownstreamMessage_InvokeMessage{
+		InvocationId: "1",
+		Target:       "state",
+	}}})
+	if resp := conn.read().GetInvokeResponseMessage(); resp.GetInvocationId() != "1" {
+		t.Fatalf("got response %v", resp)
+	}
+	// Reading answers the close handshake.
+	go conn.conn.Read(context.Background())
+	c.Close()
+	select {
+	case err := <-reported:
+		if !errors.Is(err, ErrConnectionDropped) || !strings.HasPrefix(err.Error(), "invoke response not delivered") {
+			t.Fatalf("reported %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("lost response not reported")
+	}
+}
@@ -1,5 +1,131 @@
 package reliablesocket
 
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetUserId is used when the server has no access key: the access token is
+// the user id itself.
 func GetUserId(access_token string) (string, bool) {
 	return access_token, true
 }
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// claimValues accepts a claim given either as a single string or as an
+// array, as Azure Web PubSub tokens do for roles and groups.
+type claimValues []string
+
+func (c *claimValues) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*c = claimValues{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(data, &ss); err != nil {
+		return err
+	}
+	*c = ss
+	return nil
+}
+
+// TokenClaims are the claims of the HS256 JWTs signed with the server access
+// key, both for clients and for the management API.
+type TokenClaims struct {
+	Audience  string      `json:"aud,omitempty"`
+	Subject   string      `json:"sub,omitempty"`
+	IssuedAt  int64       `json:"iat,omitempty"`
+	NotBefore int64       `json:"nbf,omitempty"`
+	ExpiresAt int64       `json:"exp,omitempty"`
+	Roles     claimValues `json:"role,omitempty"`
+	Groups    claimValues `json:"webpubsub.group,omitempty"`
+}
+
+// claimMap lists the claims as the connect event reports them.
+func (c *TokenClaims) claimMap() map[string][]string {
+	m := map[string][]string{}
+	if c.Audience != "" {
+		m["aud"] = []string{c.Audience}
+	}
+	if c.Subject != "" {
+		m["sub"] = []string{c.Subject}
+	}
+	if c.IssuedAt != 0 {
+		m["iat"] = []string{strconv.FormatInt(c.IssuedAt, 10)}
+	}
+	if c.ExpiresAt != 0 {
+		m["exp"] = []string{strconv.FormatInt(c.ExpiresAt, 10)}
+	}
+	if len(c.Roles) > 0 {
+		m["role"] = c.Roles
+	}
+	if len(c.Groups) > 0 {
+		m["webpubsub.group"] = c.Groups
+	}
+	return m
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func SignToken(key string, claims *TokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + signJWT(key, unsigned), nil
+}
+
+// ParseToken verifies the signature and lifetime of token. The audience and
+// expiry are left to the caller: client connections check neither, the
+// management API requires its own URL and an exp claim.
+func ParseToken(key, token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return nil, ErrInvalidToken
+	}
+	sig := signJWT(key, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(sig), []byte(parts[2])) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return nil, errors.New("token not yet valid")
+	}
+	return &claims, nil
+}
+
+func signJWT(key, unsigned string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
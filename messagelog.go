@@ -0,0 +1,565 @@
+package reliablesocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"reliablesocket/proto/webpubsub"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultSegmentSize = 4 << 20
+	defaultMaxSegments = 8
+)
+
+type MessageLogOptions struct {
+	// SegmentSize is the size past which the active segment is sealed and a
+	// new one started. Defaults to 4 MiB.
+	SegmentSize int64
+	// MaxSegments is how many segments are kept before they are compacted
+	// into one. Defaults to 8.
+	MaxSegments int
+	// Sync flushes the records to stable storage, in batches, in the
+	// background. Without it records survive the process crashing, not the
+	// machine.
+	Sync bool
+	// OnError is called with the errors the log works around, such as a
+	// record it could not write: losing durability must not break live
+	// connections.
+	OnError func(err error)
+}
+
+// MessageLog is an append-only log of the state needed to recover reliable
+// connections after a restart: the connections, their groups and the
+// sequenced messages they have not acknowledged yet. It is split in segment
+// files in one directory. Compaction, in the background, rewrites the live
+// state as a single segment and deletes the older ones.
+type MessageLog struct {
+	dir  string
+	opts MessageLogOptions
+
+	// syncs and compactions wake the background goroutines, done stops them.
+	syncs       chan struct{}
+	compactions chan struct{}
+	done        chan struct{}
+	wg          sync.WaitGroup
+	// compactMu runs one compaction at a time, whether Compact or the
+	// background goroutine started it.
+	compactMu sync.Mutex
+
+	mu       sync.Mutex
+	closed   bool
+	segments []int64
+	active   *os.File
+	w        *bufio.Writer
+	size     int64
+	// state is what replaying the log gives, kept up to date to compact
+	// without reading the segments again.
+	state map[string]*loggedPeer
+}
+
+const (
+	// logSnapshot starts a compacted segment, which replaces the state the
+	// segments before it give, should a crash have left them.
+	logSnapshot  = "snapshot"
+	logConnected = "connected"
+	logDied      = "died"
+	logJoin      = "join"
+	logLeave     = "leave"
+	logSent      = "sent"
+	logAcked     = "acked"
+)
+
+type logRecord struct {
+	Type         string   `json:"t"`
+	Hub          string   `json:"h"`
+	ConnectionId string   `json:"c"`
+	UserId       string   `json:"u,omitempty"`
+	Roles        []string `json:"r,omitempty"`
+	Subprotocol  string   `json:"p,omitempty"`
+	Group        string   `json:"g,omitempty"`
+	SequenceId   int64    `json:"s,omitempty"`
+	// Message is the protobuf encoding of a sequenced DownstreamMessage.
+	Message []byte `json:"m,omitempty"`
+}
+
+// loggedPeer is the logged state of a connection.
+type loggedPeer struct {
+	hub          string
+	connectionId string
+	userId       string
+	roles        []string
+	subprotocol  string
+	groups       map[string]bool
+	// sequenceId is the last sequence id sent, unacked the messages sent
+	// after the last acknowledged one.
+	sequenceId int64
+	unacked    []logRecord
+}
+
+func logKey(hub, connectionId string) string {
+	return hub + "/" + connectionId
+}
+
+// OpenMessageLog opens the log in dir, creating it if needed, and replays
+// it. A record torn by a crash at the end of the log is dropped.
+func OpenMessageLog(dir string, opts MessageLogOptions) (*MessageLog, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.MaxSegments <= 0 {
+		opts.MaxSegments = defaultMaxSegments
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	l := &MessageLog{
+		dir:         dir,
+		opts:        opts,
+		syncs:       make(chan struct{}, 1),
+		compactions: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		state:       map[string]*loggedPeer{},
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// An interrupted compaction.
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, ".seg"), 10, 64)
+		if err != nil || !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+		l.segments = append(l.segments, id)
+	}
+	slices.Sort(l.segments)
+	for i, id := range l.segments {
+		if err := l.replay(id, i == len(l.segments)-1); err != nil {
+			return nil, err
+		}
+	}
+	// Start from a compacted segment, which also drops a torn tail.
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+	l.wg.Add(2)
+	go l.syncLoop()
+	go l.compactLoop()
+	return l, nil
+}
+
+func (l *MessageLog) segmentPath(id int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016d.seg", id))
+}
+
+// replay applies the records of a segment. A corrupt record ends the last
+// segment, but is an error in any other.
+func (l *MessageLog) replay(id int64, last bool) error {
+	f, err := os.Open(l.segmentPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		rec, err := readLogRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if last {
+				l.report(fmt.Errorf("dropping the end of segment %d: %w", id, err))
+				return nil
+			}
+			return fmt.Errorf("message log segment %d: %w", id, err)
+		}
+		l.apply(rec)
+	}
+}
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// Records are framed by their length and CRC-32, both little endian.
+func readLogRecord(r io.Reader) (*logRecord, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errCorruptRecord
+		}
+		return nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errCorruptRecord
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, errCorruptRecord
+	}
+	var rec logRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return nil, errCorruptRecord
+	}
+	return &rec, nil
+}
+
+func writeLogRecord(w io.Writer, rec *logRecord) (int64, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return 0, err
+	}
+	return int64(len(header) + len(payload)), nil
+}
+
+// apply updates the state with rec. The caller holds mu, or owns the log.
+func (l *MessageLog) apply(rec *logRecord) {
+	if rec.Type == logSnapshot {
+		l.state = map[string]*loggedPeer{}
+		return
+	}
+	key := logKey(rec.Hub, rec.ConnectionId)
+	if rec.Type == logConnected {
+		// Also how a compacted segment starts over the state of a
+		// connection.
+		l.state[key] = &loggedPeer{
+			hub:          rec.Hub,
+			connectionId: rec.ConnectionId,
+			userId:       rec.UserId,
+			roles:        rec.Roles,
+			subprotocol:  rec.Subprotocol,
+			groups:       map[string]bool{},
+			sequenceId:   rec.SequenceId,
+		}
+		return
+	}
+	lp, ok := l.state[key]
+	if !ok {
+		return
+	}
+	switch rec.Type {
+	case logDied:
+		delete(l.state, key)
+	case logJoin:
+		lp.groups[rec.Group] = true
+	case logLeave:
+		delete(lp.groups, rec.Group)
+	case logSent:
+		lp.sequenceId = max(lp.sequenceId, rec.SequenceId)
+		lp.unacked = append(lp.unacked, *rec)
+	case logAcked:
+		i := 0
+		for i < len(lp.unacked) && lp.unacked[i].SequenceId <= rec.SequenceId {
+			i++
+		}
+		lp.unacked = slices.Clone(lp.unacked[i:])
+	}
+}
+
+// append writes rec to the active segment and applies it. Syncing and
+// compacting are left to the background goroutines, as append runs under
+// the send lock of a connection.
+func (l *MessageLog) append(rec *logRecord) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		return
+	}
+	l.apply(rec)
+	if err := l.write(rec); err != nil {
+		l.report(err)
+	}
+}
+
+func (l *MessageLog) report(err error) {
+	if l.opts.OnError != nil {
+		l.opts.OnError(fmt.Errorf("message log: %w", err))
+	}
+}
+
+func (l *MessageLog) write(rec *logRecord) error {
+	n, err := writeLogRecord(l.w, rec)
+	if err != nil {
+		return err
+	}
+	l.size += n
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if l.opts.Sync {
+		wake(l.syncs)
+	}
+	if l.size < l.opts.SegmentSize {
+		return nil
+	}
+	if err := l.roll(); err != nil {
+		return err
+	}
+	if len(l.segments) > l.opts.MaxSegments {
+		wake(l.compactions)
+	}
+	return nil
+}
+
+func wake(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// syncLoop syncs the active segment once records were written, together
+// with those written while it syncs.
+func (l *MessageLog) syncLoop() {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.syncs:
+		case <-l.done:
+			return
+		}
+		l.mu.Lock()
+		f := l.active
+		l.mu.Unlock()
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			l.report(err)
+		}
+	}
+}
+
+func (l *MessageLog) compactLoop() {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.compactions:
+		case <-l.done:
+			return
+		}
+		if err := l.compact(); err != nil {
+			l.report(err)
+		}
+	}
+}
+
+// roll seals the active segment and starts the next one.
+func (l *MessageLog) roll() error {
+	var id int64
+	if len(l.segments) > 0 {
+		id = l.segments[len(l.segments)-1] + 1
+	}
+	return l.openSegment(id)
+}
+
+// openSegment makes segment id the active one. The caller holds mu.
+func (l *MessageLog) openSegment(id int64) error {
+	f, err := os.OpenFile(l.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if l.active != nil {
+		if l.opts.Sync {
+			l.active.Sync()
+		}
+		l.active.Close()
+	}
+	l.segments = append(l.segments, id)
+	l.active, l.w, l.size = f, bufio.NewWriter(f), 0
+	return nil
+}
+
+// Compact rewrites the log as a single segment holding the live state, and
+// the records appended meanwhile. It waits for a compaction in progress.
+func (l *MessageLog) Compact() error {
+	return l.compact()
+}
+
+// compact writes a snapshot of the state in the segment after the active
+// one, through a temporary file renamed once written, so a crash leaves
+// either the old segments or the new one. Records go on to the segment
+// after the snapshot meanwhile. Only the snapshot is taken under mu.
+func (l *MessageLog) compact() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return os.ErrClosed
+	}
+	var id int64
+	if len(l.segments) > 0 {
+		id = l.segments[len(l.segments)-1] + 1
+	}
+	records := l.snapshot()
+	if l.active != nil {
+		l.w.Flush()
+	}
+	old := slices.Clone(l.segments)
+	l.segments = nil
+	err := l.openSegment(id + 1)
+	l.segments = append(old, l.segments...)
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := l.segmentPath(id)
+	if err := writeSegment(path+".tmp", records); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	for _, seg := range old {
+		os.Remove(l.segmentPath(seg))
+	}
+	l.segments = append([]int64{id}, l.segments[len(old):]...)
+	return nil
+}
+
+func writeSegment(path string, records []logRecord) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, rec := range records {
+		if _, err := writeLogRecord(w, &rec); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// snapshot lists the records rebuilding the state. The caller holds mu.
+func (l *MessageLog) snapshot() []logRecord {
+	records := []logRecord{{Type: logSnapshot}}
+	for _, key := range slices.Sorted(maps.Keys(l.state)) {
+		lp := l.state[key]
+		records = append(records, logRecord{
+			Type:         logConnected,
+			Hub:          lp.hub,
+			ConnectionId: lp.connectionId,
+			UserId:       lp.userId,
+			Roles:        lp.roles,
+			Subprotocol:  lp.subprotocol,
+			SequenceId:   lp.sequenceId,
+		})
+		for _, group := range slices.Sorted(maps.Keys(lp.groups)) {
+			records = append(records, logRecord{Type: logJoin, Hub: lp.hub, ConnectionId: lp.connectionId, Group: group})
+		}
+		records = append(records, lp.unacked...)
+	}
+	return records
+}
+
+// Close waits for a compaction in progress, then flushes and closes the
+// active segment.
+func (l *MessageLog) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mu.Unlock()
+	close(l.done)
+	l.wg.Wait()
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.w.Flush()
+	if l.opts.Sync && err == nil {
+		err = l.active.Sync()
+	}
+	if cerr := l.active.Close(); err == nil {
+		err = cerr
+	}
+	l.active = nil
+	return err
+}
+
+// logPeer records a new reliable connection.
+func (l *MessageLog) logPeer(hub string, p *Peer) {
+	l.append(&logRecord{
+		Type:         logConnected,
+		Hub:          hub,
+		ConnectionId: p.PeerId,
+		UserId:       p.UserId,
+		Roles:        p.Roles,
+		Subprotocol:  p.codec.Subprotocol(),
+		SequenceId:   p.sequenceId,
+	})
+}
+
+func (l *MessageLog) logMembership(typ, hub, groupId string, p *Peer) {
+	l.append(&logRecord{Type: typ, Hub: hub, ConnectionId: p.PeerId, Group: groupId})
+}
+
+// logSent records a sequenced message. The caller holds p.sendMu, so records
+// are in sequence id order.
+func (l *MessageLog) logSent(p *Peer, msg *webpubsub.DownstreamMessage) {
+	if l == nil {
+		return
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		l.report(err)
+		return
+	}
+	l.append(&logRecord{Type: logSent, Hub: p.hub.hubId, ConnectionId: p.PeerId, SequenceId: downstreamSequenceId(msg), Message: data})
+}
+
+// peers returns a copy of the logged connections.
+func (l *MessageLog) peers() []*loggedPeer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	peers := make([]*loggedPeer, 0, len(l.state))
+	for _, key := range slices.Sorted(maps.Keys(l.state)) {
+		lp := *l.state[key]
+		lp.roles = slices.Clone(lp.roles)
+		lp.groups = maps.Clone(lp.groups)
+		lp.unacked = slices.Clone(lp.unacked)
+		peers = append(peers, &lp)
+	}
+	return peers
+}
@@ -0,0 +1,254 @@
+package reliablesocket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// serveOn serves s on addr until the returned server is closed.
+func serveOn(t *testing.T, addr string, s *Server) *http.Server {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: s}
+	go srv.Serve(ln)
+	return srv
+}
+
+func TestMessageLogRestart(t *testing.T) {
+	dir := t.TempDir()
+	log1, err := OpenMessageLog(dir, MessageLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1 := NewServer()
+	s1.UseMessageLog(log1)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	srv1 := serveOn(t, addr, s1)
+
+	c, err := NewClient(ClientOptions{Endpoint: "ws://" + addr, Hub: "chat", AccessToken: StaticAccessToken("alice")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan *ConnectedEvent, 2)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e })
+	messages := make(chan string, 8)
+	c.OnServerMessage(func(msg *ServerMessage) { messages <- msg.Data.Text })
+	c.OnGroupMessage(func(msg *GroupMessage) { messages <- msg.Group + ": " + msg.Data.Text })
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	connectionId := (<-connected).ConnectionId
+	if err := c.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop the first server while the client is disconnected, with messages
+	// it has not received yet.
+	srv1.Close()
+	p, _ := s1.Hub("chat").peers.Get(connectionId)
+	p.conn.Load().(*websocket.Conn).CloseNow()
+	s1.Hub("chat").SendToGroup("room", textData("one"))
+	g, _ := s1.Hub("chat").groups.Get("room")
+	g.Send("", false, textData("two"))
+	if err := log1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	log2, err := OpenMessageLog(dir, MessageLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log2.Close()
+	s2 := NewServer()
+	s2.UseMessageLog(log2)
+	if members := s2.Hub("chat").GroupMembers("room"); len(members) != 1 || members[0].PeerId != connectionId || members[0].UserId != "alice" {
+		t.Fatalf("restored members %v", members)
+	}
+	srv2 := serveOn(t, addr, s2)
+	defer srv2.Close()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-messages:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%q not delivered after the restart", want)
+		}
+	}
+	expect("one")
+	expect("room: two")
+	s2.Hub("chat").SendToGroup("room", textData("three"))
+	expect("three")
+	select {
+	case e := <-connected:
+		t.Fatalf("got a new connection %s, want %s recovered", e.ConnectionId, connectionId)
+	default:
+	}
+}
+
+func TestMessageLogCompaction(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenMessageLog(dir, MessageLogOptions{SegmentSize: 512, MaxSegments: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.append(&logRecord{Type: logConnected, Hub: "chat", ConnectionId: "c", UserId: "u", Subprotocol: ProtobufReliableSubprotocol})
+	l.append(&logRecord{Type: logJoin, Hub: "chat", ConnectionId: "c", Group: "g"})
+	for i := int64(1); i <= 100; i++ {
+		l.append(&logRecord{Type: logSent, Hub: "chat", ConnectionId: "c", SequenceId: i, Message: []byte("payload")})
+		if i < 100 {
+			l.append(&logRecord{Type: logAcked, Hub: "chat", ConnectionId: "c", SequenceId: i})
+		}
+	}
+	l.append(&logRecord{Type: logConnected, Hub: "chat", ConnectionId: "d"})
+	l.append(&logRecord{Type: logDied, Hub: "chat", ConnectionId: "d"})
+	// Compaction runs in the background: the snapshot and the segments
+	// written since are left.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, _ := os.ReadDir(dir)
+		if len(entries) <= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d segments left, want them compacted", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record torn by a crash is dropped.
+	entries, _ := os.ReadDir(dir)
+	f, _ := os.OpenFile(dir+"/"+entries[len(entries)-1].Name(), os.O_APPEND|os.O_WRONLY, 0)
+	f.Write([]byte{42, 0, 0, 0, 1, 2})
+	f.Close()
+
+	var reported []error
+	l, err = OpenMessageLog(dir, MessageLogOptions{OnError: func(err error) { reported = append(reported, err) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if len(reported) != 1 {
+		t.Fatalf("reported %v, want the torn record", reported)
+	}
+	peers := l.peers()
+	if len(peers) != 1 || peers[0].userId != "u" || !peers[0].groups["g"] || peers[0].sequenceId != 100 || len(peers[0].unacked) != 1 {
+		t.Fatalf("replayed %+v", peers)
+	}
+}
+
+func TestMessageLogSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenMessageLog(dir, MessageLogOptions{Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.append(&logRecord{Type: logConnected, Hub: "chat", ConnectionId: "c"})
+	l.append(&logRecord{Type: logJoin, Hub: "chat", ConnectionId: "c", Group: "g"})
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// peers returns copies.
+	l.peers()[0].groups["h"] = true
+	if groups := l.peers()[0].groups; len(groups) != 1 {
+		t.Fatalf("groups %v", groups)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash after a compaction renamed its segment may leave the
+	// segments it replaced, with connections since dead.
+	f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%016d.seg", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLogRecord(f, &logRecord{Type: logConnected, Hub: "chat", ConnectionId: "dead"})
+	f.Close()
+	l, err = OpenMessageLog(dir, MessageLogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if peers := l.peers(); len(peers) != 1 || peers[0].connectionId != "c" {
+		t.Fatalf("replayed %+v", peers)
+	}
+}
+
+func TestMessageLogConcurrentCompaction(t *testing.T) {
+	dir := t.TempDir()
+	var mu sync.Mutex
+	var reported []error
+	opts := MessageLogOptions{SegmentSize: 256, MaxSegments: 2, OnError: func(err error) {
+		mu.Lock()
+		reported = append(reported, err)
+		mu.Unlock()
+	}}
+	l, err := OpenMessageLog(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.append(&logRecord{Type: logConnected, Hub: "chat", ConnectionId: "c"})
+
+	// Compact calls run alongside the background compaction the appends
+	// trigger.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := l.Compact(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	for i := int64(1); i <= 200; i++ {
+		l.append(&logRecord{Type: logSent, Hub: "chat", ConnectionId: "c", SequenceId: i, Message: []byte("payload")})
+	}
+	wg.Wait()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 0 {
+		t.Fatalf("reported %v", reported)
+	}
+
+	l, err = OpenMessageLog(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if peers := l.peers(); len(peers) != 1 || peers[0].sequenceId != 200 || len(peers[0].unacked) != 200 {
+		t.Fatalf("replayed %d peers", len(peers))
+	}
+	if len(reported) != 0 {
+		t.Fatalf("reported %v", reported)
+	}
+}
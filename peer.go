@@ -2,20 +2,36 @@ package reliablesocket
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reliablesocket/aesutil"
 	"reliablesocket/events"
 	"reliablesocket/proto/webpubsub"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
+	cmap "github.com/orcaman/concurrent-map/v2"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 )
 
 const reconnectionKey = "reconnectionKey"
 
+var errNotConnected = errors.New("not connected")
+
+var errPeerDied = errors.New("connection closed")
+
+// writeTimeout bounds every write to a connection. A client that stops
+// reading has its connection closed rather than stall its senders.
+const writeTimeout = 10 * time.Second
+
+// maxUnackedMessages is how many sequenced messages a reliable peer may leave
+// unacknowledged before its connection is closed for good.
+const maxUnackedMessages = 1000
+
 const peerStatusAlive = 0
 const peerStatusWaitReconnect = 1
 const peerStatusDied = 2
@@ -26,98 +42,249 @@ type PeerEvent struct {
 	LeaveGroupMessage  *webpubsub.UpstreamMessage_LeaveGroupMessage
 	SendToGroupMessage *webpubsub.UpstreamMessage_SendToGroupMessage
 	SequenceAckMessage *webpubsub.UpstreamMessage_SequenceAckMessage
+	// Data is a raw frame received from a simple WebSocket client.
+	Data *webpubsub.MessageData
+	// Reason is why a peer died, if known.
+	Reason string
+	// Migrated is set when a peer died because another node resumed it.
+	Migrated bool
+	Peer     *Peer
 }
 type Peer struct {
 	PeerId string
+	UserId string
+	// Roles are granted when the connection is accepted.
+	Roles  []string
 	status *atomic.Int32
 	conn   *atomic.Value
 	events.EventEmmiter[PeerEvent]
-	group *Group
-	hub   *Hub
-	recov chan struct{}
+	groups cmap.ConcurrentMap[string, *Group]
+	hub    *Hub
+	// recovMu orders recoveries and the connection drops noticed by the read
+	// loop. recov is closed once a peer waiting to reconnect is recovered.
+	recovMu sync.Mutex
+	recov   chan struct{}
+	// codec is nil for simple peers, which negotiated no subprotocol and
+	// exchange raw frames. Only reliable peers can be recovered.
+	codec    Codec
+	reliable bool
+	simple   bool
+
+	// sendMu guards the sequenced messages: outbox holds those queued but
+	// not written yet, unacked those a reliable peer has not acknowledged
+	// yet, to be replayed after recovery. Only the memory is touched under
+	// sendMu; writeMu keeps the writes in sequence id order on the wire.
+	sendMu     sync.Mutex
+	sequenceId int64
+	outbox     []*webpubsub.DownstreamMessage
+	unacked    []*webpubsub.DownstreamMessage
+	writeMu    sync.Mutex
+
+	// invocations cancels the running invocations by invocation id.
+	invocations cmap.ConcurrentMap[string, context.CancelFunc]
+	// pending holds the invocations sent to the client, waiting for their
+	// response.
+	pending      cmap.ConcurrentMap[string, chan *webpubsub.UpstreamMessage_InvokeResponseMessage]
+	invocationId atomic.Int64
+	// dead is closed once the peer died, migrated set if it died because
+	// another node resumed it.
+	dead     chan struct{}
+	migrated atomic.Bool
+
+	// userEvents holds the user events waiting for the webhook, handled in
+	// order by a single worker started with the first of them.
+	userEventsOnce sync.Once
+	userEvents     chan userEvent
 }
 
 func NewPeer(id, userId string, conn *websocket.Conn, hub *Hub) *Peer {
+	p := newPeer(id, userId, nil, conn, hub)
+	p.start()
+	return p
+}
+
+// newPeer sets up a peer without reading from or writing to conn yet, so it
+// can join its initial groups before the client is told it is connected.
+func newPeer(id, userId string, roles []string, conn *websocket.Conn, hub *Hub) *Peer {
+	p := allocPeer(id, userId, roles, hub)
+	if c, ok := CodecFor(conn.Subprotocol()); ok {
+		p.codec = c
+		p.reliable = c.Reliable()
+	} else {
+		p.simple = true
+	}
+	p.conn.Store(conn)
+	return p
+}
+
+// restoredPeer sets up a reliable peer read back from a MessageLog. It has no
+// connection until the client recovers it.
+func restoredPeer(id, userId string, roles []string, codec Codec, hub *Hub) *Peer {
+	p := allocPeer(id, userId, roles, hub)
+	p.codec = codec
+	p.reliable = true
+	return p
+}
+
+func allocPeer(id, userId string, roles []string, hub *Hub) *Peer {
 	p := &Peer{
 		PeerId:       id,
+		UserId:       userId,
+		Roles:        roles,
 		conn:         &atomic.Value{},
 		status:       &atomic.Int32{},
 		EventEmmiter: events.New[PeerEvent](),
+		groups:       cmap.New[*Group](),
+		invocations:  cmap.New[context.CancelFunc](),
+		pending:      cmap.New[chan *webpubsub.UpstreamMessage_InvokeResponseMessage](),
+		dead:         make(chan struct{}),
 		hub:          hub,
-		recov:        make(chan struct{}),
 	}
-	p.conn.Store(conn)
-	go p.readLoop()
-	plaintext := fmt.Sprintf("%s:%d", p.PeerId, time.Now().Unix())
-	reconnectionToken, _ := aesutil.EncryptToHex(aesutil.AES_GCM, reconnectionKey, []byte(plaintext))
+	p.On("died", func(PeerEvent) {
+		close(p.dead)
+		p.cancelInvocations()
+	})
+	return p
+}
+
+func (p *Peer) start() {
+	go p.readLoop(p.conn.Load().(*websocket.Conn))
+	if p.simple {
+		return
+	}
+	var reconnectionToken string
+	if p.reliable {
+		plaintext := fmt.Sprintf("%s:%d", p.PeerId, time.Now().Unix())
+		reconnectionToken, _ = aesutil.EncryptToHex(aesutil.AES_GCM, reconnectionKey, []byte(plaintext))
+	}
 
 	p.sendDownStreamSystemMessage(&webpubsub.DownstreamMessage_SystemMessage{
 		Message: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage_{ConnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_ConnectedMessage{
-			ConnectionId:      id,
-			UserId:            userId,
+			ConnectionId:      p.PeerId,
+			UserId:            p.UserId,
 			ReconnectionToken: reconnectionToken,
 		}},
 	})
-	return p
 }
 func (p *Peer) Close() {
-	if p.status.Load() != peerStatusAlive {
+	p.recovMu.Lock()
+	defer p.recovMu.Unlock()
+	p.waitReconnect()
+}
+
+// waitReconnect moves an alive reliable peer to wait for its client to
+// recover it, and kills any other. The caller holds recovMu.
+func (p *Peer) waitReconnect() {
+	if !p.reliable {
+		// Nothing is kept for connections that cannot be recovered.
+		if p.status.CompareAndSwap(peerStatusAlive, peerStatusDied) {
+			p.emit("died", PeerEvent{Reason: "connection closed"})
+		}
 		return
 	}
-	if p.status.Load() == peerStatusAlive {
-		p.status.CompareAndSwap(peerStatusAlive, peerStatusWaitReconnect)
-		p.Emit("waitreconnect", PeerEvent{})
-		go func() {
-			select {
-			case <-time.After(time.Second * 30):
-				p.status.CompareAndSwap(peerStatusWaitReconnect, peerStatusDied)
-				p.Emit("died", PeerEvent{})
-				fmt.Println("died")
-			case <-p.recov:
-				p.recov = make(chan struct{})
-				p.status.CompareAndSwap(peerStatusWaitReconnect, peerStatusAlive)
-				go p.readLoop()
-				p.Emit("alive", PeerEvent{})
-				fmt.Println("reconnected")
+	if !p.status.CompareAndSwap(peerStatusAlive, peerStatusWaitReconnect) {
+		return
+	}
+	recov := make(chan struct{})
+	p.recov = recov
+	p.emit("waitreconnect", PeerEvent{})
+	go func() {
+		select {
+		case <-time.After(time.Second * 30):
+			if p.status.CompareAndSwap(peerStatusWaitReconnect, peerStatusDied) {
+				p.emit("died", PeerEvent{Reason: "connection not recovered"})
 			}
-		}()
+		case <-recov:
+		}
+	}()
+}
+
+// recover resumes p on conn, the connection its client recovered, and
+// reports whether it could. The previous connection may not have been seen
+// dropping yet: it is closed first.
+func (p *Peer) recover(conn *websocket.Conn) bool {
+	p.recovMu.Lock()
+	defer p.recovMu.Unlock()
+	if p.status.Load() == peerStatusAlive {
+		if old, ok := p.conn.Load().(*websocket.Conn); ok {
+			old.CloseNow()
+		}
+		p.waitReconnect()
+	}
+	p.writeMu.Lock()
+	p.sendMu.Lock()
+	if !p.status.CompareAndSwap(peerStatusWaitReconnect, peerStatusAlive) {
+		p.sendMu.Unlock()
+		p.writeMu.Unlock()
+		return false
 	}
+	p.conn.Store(conn)
+	close(p.recov)
+	// The queued messages are unacked too, and replayed with them.
+	p.outbox = nil
+	unacked := slices.Clone(p.unacked)
+	p.sendMu.Unlock()
+	p.resend(unacked)
+	p.writeMu.Unlock()
+	p.flush()
+	go p.readLoop(conn)
+	p.emit("alive", PeerEvent{})
+	return true
 }
-func (p *Peer) readLoop() {
-	var e error
-	defer func() {
-		if e != nil {
-			fmt.Println(e)
+
+// connClosed handles the end of conn, unless a recovery already replaced it.
+func (p *Peer) connClosed(conn *websocket.Conn, err error) {
+	p.recovMu.Lock()
+	defer p.recovMu.Unlock()
+	if p.conn.Load() != conn {
+		return
+	}
+	// A client that closes normally has stopped and will not recover.
+	if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+		if p.status.CompareAndSwap(peerStatusAlive, peerStatusDied) {
+			p.emit("died", PeerEvent{Reason: "connection closed by client"})
 		}
-		p.Close()
-	}()
+		return
+	}
+	p.waitReconnect()
+}
+
+// readLoop reads from conn until it fails or the peer is no longer alive.
+func (p *Peer) readLoop(conn *websocket.Conn) {
+	var e error
+	defer func() { p.connClosed(conn, e) }()
 	for {
 		if p.status.Load() != peerStatusAlive {
 			return
 		}
-		connA := p.conn.Load()
-		conn := connA.(*websocket.Conn)
 		msgType, data, err := conn.Read(context.Background())
 		if err != nil {
 			e = err
 			return
 		}
-		if msgType == websocket.MessageBinary {
-			var m webpubsub.UpstreamMessage
-			if err := proto.Unmarshal(data, &m); err != nil {
+		if p.simple {
+			msg := rawMessageData(msgType, data)
+			p.emit("message", PeerEvent{Data: msg})
+			p.queueUserEvent("message", 0, msg)
+			continue
+		}
+		if msgType == p.codec.FrameType() {
+			m, err := p.codec.DecodeUpstream(data)
+			if err != nil {
 				e = err
 				return
 			}
-			fmt.Println(&m)
 			if x := m.GetEventMessage(); x != nil {
-				p.Emit("event", PeerEvent{EventMessage: x})
-				fmt.Println(x)
+				p.emit("event", PeerEvent{EventMessage: x})
+				p.queueUserEvent(x.GetEvent(), x.GetAckId(), x.GetData())
 			}
 			if x := m.GetJoinGroupMessage(); x != nil {
-				p.Emit("joingroup", PeerEvent{JoinGroupMessage: x})
-				fmt.Println(x)
-				group := x.GetGroup()
-				p.hub.JoinGroup(group, p.PeerId)
+				p.emit("joingroup", PeerEvent{JoinGroupMessage: x})
+				q := HistoryQuery{AfterSequenceId: x.GetHistoryAfterSequenceId()}
+				if x.HistorySince != nil {
+					q.Since = time.UnixMilli(x.GetHistorySince())
+				}
+				p.hub.JoinGroupWithHistory(x.GetGroup(), p.PeerId, q)
 
 				if x.GetAckId() != 0 {
 					p.sendDownStreamAckMessage(&webpubsub.DownstreamMessage_AckMessage{
@@ -127,8 +294,7 @@ func (p *Peer) readLoop() {
 				}
 			}
 			if x := m.GetLeaveGroupMessage(); x != nil {
-				p.Emit("leavegroup", PeerEvent{LeaveGroupMessage: x})
-				fmt.Println(x)
+				p.emit("leavegroup", PeerEvent{LeaveGroupMessage: x})
 				p.hub.LeaveGroup(x.GetGroup(), p.PeerId)
 
 				if x.GetAckId() != 0 {
@@ -139,15 +305,33 @@ func (p *Peer) readLoop() {
 				}
 			}
 			if x := m.GetSendToGroupMessage(); x != nil {
-				p.Emit("sendtogroup", PeerEvent{SendToGroupMessage: x})
-				fmt.Println(x)
-				if p.group != nil && p.group.groupId == x.Group {
+				p.emit("sendtogroup", PeerEvent{SendToGroupMessage: x})
+				if g, ok := p.groups.Get(x.Group); ok {
 					var noecho bool
 					if x.NoEcho != nil {
 						noecho = *x.NoEcho
 					}
-					p.group.Send(p.PeerId, noecho, x.Data)
+					g.Send(p.PeerId, noecho, x.Data)
+				}
+				if x.GetAckId() != 0 {
+					p.sendDownStreamAckMessage(&webpubsub.DownstreamMessage_AckMessage{
+						AckId:   x.GetAckId(),
+						Success: true,
+					})
+				}
+			}
+			if x := m.GetInvokeMessage(); x != nil {
+				p.handleInvoke(x)
+			}
+			if x := m.GetCancelInvocationMessage(); x != nil {
+				p.cancelInvocation(x.GetInvocationId())
+			}
+			if x := m.GetInvokeResponseMessage(); x != nil {
+				if ch, ok := p.pending.Pop(x.GetInvocationId()); ok {
+					ch <- x
 				}
+				// Responses are acked even when nobody waits any more, so
+				// the client stops resending them.
 				if x.GetAckId() != 0 {
 					p.sendDownStreamAckMessage(&webpubsub.DownstreamMessage_AckMessage{
 						AckId:   x.GetAckId(),
@@ -156,25 +340,33 @@ func (p *Peer) readLoop() {
 				}
 			}
 			if x := m.GetSequenceAckMessage(); x != nil {
-				p.Emit("sequenceack", PeerEvent{SequenceAckMessage: x})
-				fmt.Println(x)
+				p.emit("sequenceack", PeerEvent{SequenceAckMessage: x})
+				p.ackSequence(x.GetSequenceId())
 			}
 		}
 	}
 }
+
+// emit fires evt on the peer and on its hub.
+func (p *Peer) emit(evt events.EventName, arg PeerEvent) {
+	arg.Peer = p
+	p.Emit(evt, arg)
+	p.hub.Emit(evt, arg)
+}
+
 func (p *Peer) sendTextMessage(text string) error {
 	msg2 := &webpubsub.MessageData{Data: &webpubsub.MessageData_TextData{TextData: text}}
-	return p.sendDownStreamDataMessage(msg2)
+	return p.sendDownStreamDataMessage("server", nil, msg2)
 }
 
 func (p *Peer) sendJSONMessage(msg string) error {
 	msg2 := &webpubsub.MessageData{Data: &webpubsub.MessageData_JsonData{JsonData: msg}}
-	return p.sendDownStreamDataMessage(msg2)
+	return p.sendDownStreamDataMessage("server", nil, msg2)
 }
 
 func (p *Peer) sendBinaryMessge(msg []byte) error {
 	msg2 := &webpubsub.MessageData{Data: &webpubsub.MessageData_BinaryData{BinaryData: msg}}
-	return p.sendDownStreamDataMessage(msg2)
+	return p.sendDownStreamDataMessage("server", nil, msg2)
 }
 
 func (p *Peer) sendProtobufMessage(msg proto.Message) error {
@@ -183,42 +375,237 @@ func (p *Peer) sendProtobufMessage(msg proto.Message) error {
 		return err
 	}
 	msg2 := &webpubsub.MessageData{Data: &webpubsub.MessageData_ProtobufData{ProtobufData: mm}}
-	return p.sendDownStreamDataMessage(msg2)
+	return p.sendDownStreamDataMessage("server", nil, msg2)
 }
 
 func (p *Peer) sendDownStreamSystemMessage(msg *webpubsub.DownstreamMessage_SystemMessage) error {
 	msg2 := &webpubsub.DownstreamMessage{
 		Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: msg}}
-	data, err := proto.Marshal(msg2)
-	if err != nil {
-		return err
-	}
-	return p.sendToPeer(data)
+	return p.sendDownStream(msg2)
 
 }
 func (p *Peer) sendDownStreamAckMessage(msg *webpubsub.DownstreamMessage_AckMessage) error {
 	msg2 := &webpubsub.DownstreamMessage{
 		Message: &webpubsub.DownstreamMessage_AckMessage_{AckMessage: msg}}
-	data, err := proto.Marshal(msg2)
-	if err != nil {
+	return p.sendDownStream(msg2)
+
+}
+func (p *Peer) sendDownStreamDataMessage(from string, group *string, msg *webpubsub.MessageData) error {
+	dataMessage := &webpubsub.DownstreamMessage_DataMessage{
+		From:  from,
+		Group: group,
+		Data:  msg}
+	msg2 := &webpubsub.DownstreamMessage{
+		Message: &webpubsub.DownstreamMessage_DataMessage_{DataMessage: dataMessage}}
+	return p.sendSequenced(msg2)
+}
+
+// queueGroupMessage queues data published to group, numbered by the group
+// history m if the group keeps one. The caller flushes p.
+func (p *Peer) queueGroupMessage(group string, data *webpubsub.MessageData, m *HistoryMessage, history bool) error {
+	dataMessage := &webpubsub.DownstreamMessage_DataMessage{
+		From:    "group",
+		Group:   &group,
+		Data:    data,
+		History: history}
+	if m != nil {
+		dataMessage.GroupSequenceId = proto.Int64(m.SequenceId)
+		dataMessage.Timestamp = proto.Int64(m.Time.UnixMilli())
+	}
+	return p.queue(&webpubsub.DownstreamMessage{
+		Message: &webpubsub.DownstreamMessage_DataMessage_{DataMessage: dataMessage}})
+}
+
+// sendSequenced sends a data or invoke message after those already queued.
+func (p *Peer) sendSequenced(msg *webpubsub.DownstreamMessage) error {
+	if err := p.queue(msg); err != nil {
 		return err
 	}
-	return p.sendToPeer(data)
+	return p.flush()
+}
 
+// queue numbers msg and adds it to the messages to write. Reliable peers
+// keep it until it is acknowledged so it can be replayed after recovery.
+// Nothing is written: callers holding locks flush p once they released them.
+func (p *Peer) queue(msg *webpubsub.DownstreamMessage) error {
+	p.sendMu.Lock()
+	if p.status.Load() == peerStatusDied {
+		p.sendMu.Unlock()
+		return errPeerDied
+	}
+	if p.reliable && len(p.unacked) >= maxUnackedMessages {
+		// abort emits "died", whose handlers take the hub locks.
+		p.sendMu.Unlock()
+		p.abort("too many unacknowledged messages")
+		return errors.New("too many unacknowledged messages")
+	}
+	defer p.sendMu.Unlock()
+	if p.reliable {
+		p.sequenceId++
+		sequenceId := p.sequenceId
+		switch x := msg.GetMessage().(type) {
+		case *webpubsub.DownstreamMessage_DataMessage_:
+			x.DataMessage.SequenceId = &sequenceId
+		case *webpubsub.DownstreamMessage_InvokeMessage_:
+			x.InvokeMessage.SequenceId = &sequenceId
+		}
+		p.unacked = append(p.unacked, msg)
+		p.hub.log.Load().logSent(p, msg)
+	}
+	p.outbox = append(p.outbox, msg)
+	return nil
 }
-func (p *Peer) sendDownStreamDataMessage(msg *webpubsub.MessageData) error {
-	msg2 := &webpubsub.DownstreamMessage{
-		Message: &webpubsub.DownstreamMessage_DataMessage_{DataMessage: &webpubsub.DownstreamMessage_DataMessage{
-			Data: msg}}}
-	data, err := proto.Marshal(msg2)
+
+// queueSystemMessage adds msg to the messages to write, after those already
+// queued. System messages are not sequenced, nor replayed after recovery.
+func (p *Peer) queueSystemMessage(msg *webpubsub.DownstreamMessage_SystemMessage) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	if p.status.Load() == peerStatusDied {
+		return errPeerDied
+	}
+	p.outbox = append(p.outbox, &webpubsub.DownstreamMessage{
+		Message: &webpubsub.DownstreamMessage_SystemMessage_{SystemMessage: msg}})
+	return nil
+}
+
+// flush writes the queued messages in order, including those other
+// goroutines queue meanwhile.
+func (p *Peer) flush() error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	for {
+		p.sendMu.Lock()
+		batch := p.outbox
+		p.outbox = nil
+		alive := p.status.Load() == peerStatusAlive
+		p.sendMu.Unlock()
+		if len(batch) == 0 || !alive {
+			// Reliable peers replay them once recovered.
+			return nil
+		}
+		for _, msg := range batch {
+			if err := p.sendDownStream(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flushEach flushes every peer.
+func flushEach(peers []*Peer) {
+	sendEach(peers, func(p *Peer) { p.flush() })
+}
+
+// replayRoom returns how many messages may be replayed to p, so a replay
+// leaves half the unacked budget to live messages.
+func (p *Peer) replayRoom() int {
+	if !p.reliable {
+		return maxUnackedMessages / 2
+	}
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	return max(maxUnackedMessages/2-len(p.unacked), 0)
+}
+
+func downstreamSequenceId(msg *webpubsub.DownstreamMessage) int64 {
+	if x := msg.GetInvokeMessage(); x != nil {
+		return x.GetSequenceId()
+	}
+	return msg.GetDataMessage().GetSequenceId()
+}
+
+// ackSequence forgets every queued message up to sequenceId.
+func (p *Peer) ackSequence(sequenceId int64) {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	i := 0
+	for i < len(p.unacked) && downstreamSequenceId(p.unacked[i]) <= sequenceId {
+		i++
+	}
+	p.unacked = p.unacked[i:]
+	p.hub.log.Load().append(&logRecord{Type: logAcked, Hub: p.hub.hubId, ConnectionId: p.PeerId, SequenceId: sequenceId})
+}
+
+// resend replays the unacked messages on a recovered connection. The caller
+// holds writeMu.
+func (p *Peer) resend(unacked []*webpubsub.DownstreamMessage) {
+	for _, msg := range unacked {
+		// The read loop notices the connection failing.
+		if p.sendDownStream(msg) != nil {
+			return
+		}
+	}
+}
+
+// abort closes the connection for good, it can no longer be recovered.
+func (p *Peer) abort(reason string) {
+	if p.status.Swap(peerStatusDied) == peerStatusDied {
+		return
+	}
+	if !p.simple {
+		p.sendDownStreamSystemMessage(&webpubsub.DownstreamMessage_SystemMessage{
+			Message: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage_{DisconnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage{
+				Reason: reason,
+			}},
+		})
+	}
+	if conn, ok := p.conn.Load().(*websocket.Conn); ok {
+		conn.Close(websocket.StatusPolicyViolation, reason)
+	}
+	p.emit("died", PeerEvent{Reason: reason})
+}
+func (p *Peer) sendDownStream(msg *webpubsub.DownstreamMessage) error {
+	if p.simple {
+		// Simple clients only get the payload of data messages.
+		if x := msg.GetDataMessage(); x != nil {
+			msgType, data, err := rawFrame(x.GetData())
+			if err != nil {
+				return err
+			}
+			return writeFrame(p.conn.Load().(*websocket.Conn), msgType, data)
+		}
+		return nil
+	}
+	data, err := p.codec.EncodeDownstream(msg)
 	if err != nil {
 		return err
 	}
 	return p.sendToPeer(data)
-
 }
 func (p *Peer) sendToPeer(data []byte) error {
-	pp := p.conn.Load()
-	ppp := pp.(*websocket.Conn)
-	return ppp.Write(context.Background(), websocket.MessageBinary, data)
+	conn, ok := p.conn.Load().(*websocket.Conn)
+	if !ok {
+		// Restored from a MessageLog and not recovered yet.
+		return errNotConnected
+	}
+	return writeFrame(conn, p.codec.FrameType(), data)
+}
+
+func writeFrame(conn *websocket.Conn, msgType websocket.MessageType, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	return conn.Write(ctx, msgType, data)
+}
+
+func rawMessageData(msgType websocket.MessageType, data []byte) *webpubsub.MessageData {
+	if msgType == websocket.MessageText {
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_TextData{TextData: string(data)}}
+	}
+	return &webpubsub.MessageData{Data: &webpubsub.MessageData_BinaryData{BinaryData: data}}
+}
+
+func rawFrame(d *webpubsub.MessageData) (websocket.MessageType, []byte, error) {
+	switch x := d.GetData().(type) {
+	case *webpubsub.MessageData_TextData:
+		return websocket.MessageText, []byte(x.TextData), nil
+	case *webpubsub.MessageData_JsonData:
+		return websocket.MessageText, []byte(x.JsonData), nil
+	case *webpubsub.MessageData_BinaryData:
+		return websocket.MessageBinary, x.BinaryData, nil
+	case *webpubsub.MessageData_ProtobufData:
+		data, err := proto.Marshal(x.ProtobufData)
+		return websocket.MessageBinary, data, err
+	}
+	return websocket.MessageBinary, nil, nil
 }
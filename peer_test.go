@@ -0,0 +1,74 @@
+package reliablesocket
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestUnackedLimit(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	hub := s.Hub("chat")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The client reads everything but never acknowledges.
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/client/hubs/chat?access_token=alice", &websocket.DialOptions{Subprotocols: []string{JSONReliableSubprotocol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+	var p *Peer
+	for p == nil {
+		for _, peer := range hub.peers.Items() {
+			p = peer
+		}
+		if ctx.Err() != nil {
+			t.Fatal("not connected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	died := make(chan PeerEvent, 1)
+	p.On("died", func(e PeerEvent) { died <- e })
+
+	for i := 0; i < maxUnackedMessages; i++ {
+		if err := p.sendTextMessage("hi"); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if err := p.sendTextMessage("one too many"); err == nil {
+		t.Fatal("sent more than maxUnackedMessages unacknowledged")
+	}
+	if e := <-died; e.Reason != "too many unacknowledged messages" {
+		t.Fatalf("died with %q", e.Reason)
+	}
+	if _, ok := hub.peers.Get(p.PeerId); ok {
+		t.Fatal("peer still in the hub")
+	}
+	if err := <-closed; websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Fatalf("connection closed with %v, want 1008", err)
+	}
+	// Died peers queue nothing more.
+	if err := p.sendTextMessage("late"); !errors.Is(err, errPeerDied) {
+		t.Fatalf("got %v, want errPeerDied", err)
+	}
+	if len(p.unacked) != maxUnackedMessages {
+		t.Fatalf("%d messages queued, want %d", len(p.unacked), maxUnackedMessages)
+	}
+}
@@ -0,0 +1,252 @@
+package reliablesocket
+
+import (
+	"maps"
+	"reliablesocket/proto/webpubsub"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+)
+
+const defaultPresenceDebounce = 5 * time.Second
+
+type PresenceOptions struct {
+	// Debounce delays the leave notification of a user whose last
+	// connection left the group, so that a quick reconnect or rejoin goes
+	// unnoticed. Defaults to 5s; negative notifies immediately.
+	Debounce time.Duration
+}
+
+// PresenceUser is a user present in a group. Connections without a user id
+// are reported as users whose id is their connection id.
+type PresenceUser struct {
+	UserId string
+	// ConnectionIds is empty while the leave of the user is debounced.
+	ConnectionIds []string
+	JoinedAt      time.Time
+	Metadata      map[string]string
+}
+
+// presence tracks the users of a group. It is updated under Hub.groupsMu, so
+// notifications are queued on outbox, which delivers them in order once
+// groupsMu is released.
+type presence struct {
+	hub      *Hub
+	groupId  string
+	debounce time.Duration
+	mu       sync.Mutex
+	users    map[string]*presenceUser
+	outbox   *mailbox[presenceNotification]
+}
+
+type presenceUser struct {
+	userId      string
+	connections map[string]bool
+	joinedAt    time.Time
+	metadata    map[string]string
+	// leaving is the pending leave notification of a user without
+	// connections.
+	leaving *time.Timer
+}
+
+type presenceNotification struct {
+	key string
+	msg *webpubsub.DownstreamMessage_SystemMessage_PresenceMessage
+}
+
+// presenceKey identifies the user of p in a presence list.
+func presenceKey(p *Peer) string {
+	if p.UserId != "" {
+		return p.UserId
+	}
+	return p.PeerId
+}
+
+// EnablePresence makes the members of groupId get a presence system message
+// whenever a user joins or leaves it, including when a connection dies
+// without being recovered. It is a no-op if presence is already enabled.
+func (h *Hub) EnablePresence(groupId string, opts PresenceOptions) {
+	if opts.Debounce == 0 {
+		opts.Debounce = defaultPresenceDebounce
+	}
+	h.groupsMu.Lock()
+	defer h.groupsMu.Unlock()
+	if h.presence.Has(groupId) {
+		return
+	}
+	t := &presence{
+		hub:      h,
+		groupId:  groupId,
+		debounce: opts.Debounce,
+		users:    map[string]*presenceUser{},
+	}
+	t.outbox = newMailbox(t.deliver)
+	// Current members are present without being announced.
+	if g, ok := h.groups.Get(groupId); ok {
+		for _, p := range g.peers.Items() {
+			t.add(p)
+		}
+	}
+	h.presence.Set(groupId, t)
+}
+
+// DisablePresence stops tracking the presence of groupId.
+func (h *Hub) DisablePresence(groupId string) {
+	h.groupsMu.Lock()
+	defer h.groupsMu.Unlock()
+	if t, ok := h.presence.Pop(groupId); ok {
+		t.stop()
+	}
+}
+
+// GetPresence returns the users present in groupId, or nil if presence is
+// not enabled for it.
+func (h *Hub) GetPresence(groupId string) []PresenceUser {
+	t, ok := h.presence.Get(groupId)
+	if !ok {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	users := make([]PresenceUser, 0, len(t.users))
+	for _, u := range t.users {
+		users = append(users, PresenceUser{
+			UserId:        u.userId,
+			ConnectionIds: slices.Sorted(maps.Keys(u.connections)),
+			JoinedAt:      u.joinedAt,
+			Metadata:      maps.Clone(u.metadata),
+		})
+	}
+	slices.SortFunc(users, func(a, b PresenceUser) int { return a.JoinedAt.Compare(b.JoinedAt) })
+	return users
+}
+
+// SetPresenceMetadata replaces the metadata GetPresence reports for userId
+// in groupId. It fails if the user is not present there.
+func (h *Hub) SetPresenceMetadata(groupId, userId string, metadata map[string]string) error {
+	t, ok := h.presence.Get(groupId)
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.users[userId]
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	u.metadata = maps.Clone(metadata)
+	return nil
+}
+
+func (h *Hub) presenceJoined(groupId string, p *Peer) {
+	if t, ok := h.presence.Get(groupId); ok {
+		t.join(p)
+	}
+}
+
+func (h *Hub) presenceLeft(groupId string, p *Peer) {
+	if t, ok := h.presence.Get(groupId); ok {
+		t.leave(p)
+	}
+}
+
+// add records p and reports whether its user just became present. The caller
+// holds t.mu.
+func (t *presence) add(p *Peer) bool {
+	key := presenceKey(p)
+	u, ok := t.users[key]
+	if !ok {
+		u = &presenceUser{userId: key, connections: map[string]bool{}, joinedAt: time.Now()}
+		t.users[key] = u
+	}
+	if u.leaving != nil {
+		// Back before the leave was announced.
+		u.leaving.Stop()
+		u.leaving = nil
+	}
+	u.connections[p.PeerId] = true
+	return !ok
+}
+
+func (t *presence) join(p *Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.add(p) {
+		t.notify(PresenceJoin, p)
+	}
+}
+
+func (t *presence) leave(p *Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := presenceKey(p)
+	u, ok := t.users[key]
+	if !ok || !u.connections[p.PeerId] {
+		return
+	}
+	delete(u.connections, p.PeerId)
+	if len(u.connections) > 0 {
+		return
+	}
+	if t.debounce < 0 {
+		delete(t.users, key)
+		t.notify(PresenceLeave, p)
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(t.debounce, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if u.leaving != timer {
+			return
+		}
+		delete(t.users, key)
+		t.notify(PresenceLeave, p)
+	})
+	u.leaving = timer
+}
+
+// notify queues a notification without waiting for it to be delivered. The
+// caller holds t.mu, which keeps the queue in the order of the membership
+// changes.
+func (t *presence) notify(event string, p *Peer) {
+	n := presenceNotification{key: presenceKey(p), msg: &webpubsub.DownstreamMessage_SystemMessage_PresenceMessage{
+		Group:        t.groupId,
+		Event:        event,
+		UserId:       p.UserId,
+		ConnectionId: p.PeerId,
+	}}
+	t.outbox.put(n)
+}
+
+// deliver queues a notification on the outbox of the members of the group,
+// except the connections of the user it is about, and flushes them.
+func (t *presence) deliver(n presenceNotification) {
+	msg := &webpubsub.DownstreamMessage_SystemMessage{
+		Message: &webpubsub.DownstreamMessage_SystemMessage_PresenceMessage_{PresenceMessage: n.msg},
+	}
+	var members []*Peer
+	for _, p := range t.hub.GroupMembers(t.groupId) {
+		if presenceKey(p) != n.key && p.queueSystemMessage(msg) == nil {
+			members = append(members, p)
+		}
+	}
+	flushEach(members)
+}
+
+func (t *presence) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, u := range t.users {
+		if u.leaving != nil {
+			u.leaving.Stop()
+			u.leaving = nil
+		}
+	}
+	t.outbox.close()
+}
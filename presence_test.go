@@ -0,0 +1,147 @@
+package reliablesocket
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func nextPresence(t *testing.T, events chan *PresenceEvent) *PresenceEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no presence event")
+	}
+	return nil
+}
+
+func TestPresence(t *testing.T) {
+	s := NewServer()
+	hub := s.Hub("chat")
+	hub.EnablePresence("room", PresenceOptions{Debounce: 200 * time.Millisecond})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	alice := newTestClient(t, ts, "alice")
+	events := make(chan *PresenceEvent, 8)
+	alice.OnPresence(func(e *PresenceEvent) { events <- e })
+	if err := alice.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := alice.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+
+	bob := newTestClient(t, ts, "bob")
+	connected := make(chan *ConnectedEvent, 1)
+	bob.OnConnected(func(e *ConnectedEvent) { connected <- e })
+	if err := bob.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	bobId := (<-connected).ConnectionId
+	if err := bob.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextPresence(t, events); e.Event != PresenceJoin || e.UserId != "bob" || e.Group != "room" {
+		t.Fatalf("got %+v, want bob joining room", e)
+	}
+
+	if err := hub.SetPresenceMetadata("room", "bob", map[string]string{"status": "busy"}); err != nil {
+		t.Fatal(err)
+	}
+	users := hub.GetPresence("room")
+	if len(users) != 2 || users[0].UserId != "alice" || users[1].UserId != "bob" || users[1].Metadata["status"] != "busy" {
+		t.Fatalf("presence %+v", users)
+	}
+
+	// Leaving and joining again within the debounce window goes unnoticed.
+	if err := bob.LeaveGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected %+v", e)
+	case <-time.After(400 * time.Millisecond):
+	}
+
+	// A dropped connection stays present while it is recovered, and leaves
+	// once it dies.
+	p, _ := hub.peers.Get(bobId)
+	dropped := p.conn.Load().(*websocket.Conn)
+	dropped.CloseNow()
+	for p.conn.Load().(*websocket.Conn) == dropped {
+		if ctx.Err() != nil {
+			t.Fatal("not recovered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if users := hub.GetPresence("room"); len(users) != 2 {
+		t.Fatalf("presence %+v", users)
+	}
+	bob.Close()
+	if e := nextPresence(t, events); e.Event != PresenceLeave || e.UserId != "bob" || e.ConnectionId != bobId {
+		t.Fatalf("got %+v, want bob leaving", e)
+	}
+	if users := hub.GetPresence("room"); len(users) != 1 || users[0].UserId != "alice" {
+		t.Fatalf("presence %+v", users)
+	}
+}
+
+func TestPresenceOrder(t *testing.T) {
+	s := NewServer()
+	hub := s.Hub("chat")
+	hub.EnablePresence("room", PresenceOptions{Debounce: -1})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	alice := newTestClient(t, ts, "alice")
+	events := make(chan *PresenceEvent, 16)
+	alice.OnPresence(func(e *PresenceEvent) { events <- e })
+	if err := alice.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	if err := alice.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+	bob := newTestClient(t, ts, "bob")
+	connected := make(chan *ConnectedEvent, 1)
+	bob.OnConnected(func(e *ConnectedEvent) { connected <- e })
+	if err := bob.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+	bobId := (<-connected).ConnectionId
+
+	// The changes are made faster than they are delivered.
+	const changes = 200
+	go func() {
+		for i := 0; i < changes/2; i++ {
+			hub.AddConnectionToGroup("room", bobId)
+			hub.RemoveConnectionFromGroup("room", bobId)
+		}
+	}()
+	for i := 0; i < changes; i++ {
+		want := PresenceJoin
+		if i%2 == 1 {
+			want = PresenceLeave
+		}
+		if e := nextPresence(t, events); e.Event != want || e.UserId != "bob" {
+			t.Fatalf("change %d: got %+v, want bob %s", i, e, want)
+		}
+	}
+}
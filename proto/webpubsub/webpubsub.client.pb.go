@@ -31,6 +31,9 @@ type UpstreamMessage struct {
 	//	*UpstreamMessage_JoinGroupMessage_
 	//	*UpstreamMessage_LeaveGroupMessage_
 	//	*UpstreamMessage_SequenceAckMessage_
+	//	*UpstreamMessage_InvokeMessage_
+	//	*UpstreamMessage_CancelInvocationMessage_
+	//	*UpstreamMessage_InvokeResponseMessage_
 	Message       isUpstreamMessage_Message `protobuf_oneof:"message"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -118,6 +121,33 @@ func (x *UpstreamMessage) GetSequenceAckMessage() *UpstreamMessage_SequenceAckMe
 	return nil
 }
 
+func (x *UpstreamMessage) GetInvokeMessage() *UpstreamMessage_InvokeMessage {
+	if x != nil {
+		if x, ok := x.Message.(*UpstreamMessage_InvokeMessage_); ok {
+			return x.InvokeMessage
+		}
+	}
+	return nil
+}
+
+func (x *UpstreamMessage) GetCancelInvocationMessage() *UpstreamMessage_CancelInvocationMessage {
+	if x != nil {
+		if x, ok := x.Message.(*UpstreamMessage_CancelInvocationMessage_); ok {
+			return x.CancelInvocationMessage
+		}
+	}
+	return nil
+}
+
+func (x *UpstreamMessage) GetInvokeResponseMessage() *UpstreamMessage_InvokeResponseMessage {
+	if x != nil {
+		if x, ok := x.Message.(*UpstreamMessage_InvokeResponseMessage_); ok {
+			return x.InvokeResponseMessage
+		}
+	}
+	return nil
+}
+
 type isUpstreamMessage_Message interface {
 	isUpstreamMessage_Message()
 }
@@ -142,6 +172,18 @@ type UpstreamMessage_SequenceAckMessage_ struct {
 	SequenceAckMessage *UpstreamMessage_SequenceAckMessage `protobuf:"bytes,8,opt,name=sequence_ack_message,json=sequenceAckMessage,proto3,oneof"`
 }
 
+type UpstreamMessage_InvokeMessage_ struct {
+	InvokeMessage *UpstreamMessage_InvokeMessage `protobuf:"bytes,9,opt,name=invoke_message,json=invokeMessage,proto3,oneof"`
+}
+
+type UpstreamMessage_CancelInvocationMessage_ struct {
+	CancelInvocationMessage *UpstreamMessage_CancelInvocationMessage `protobuf:"bytes,10,opt,name=cancel_invocation_message,json=cancelInvocationMessage,proto3,oneof"`
+}
+
+type UpstreamMessage_InvokeResponseMessage_ struct {
+	InvokeResponseMessage *UpstreamMessage_InvokeResponseMessage `protobuf:"bytes,11,opt,name=invoke_response_message,json=invokeResponseMessage,proto3,oneof"`
+}
+
 func (*UpstreamMessage_SendToGroupMessage_) isUpstreamMessage_Message() {}
 
 func (*UpstreamMessage_EventMessage_) isUpstreamMessage_Message() {}
@@ -152,6 +194,12 @@ func (*UpstreamMessage_LeaveGroupMessage_) isUpstreamMessage_Message() {}
 
 func (*UpstreamMessage_SequenceAckMessage_) isUpstreamMessage_Message() {}
 
+func (*UpstreamMessage_InvokeMessage_) isUpstreamMessage_Message() {}
+
+func (*UpstreamMessage_CancelInvocationMessage_) isUpstreamMessage_Message() {}
+
+func (*UpstreamMessage_InvokeResponseMessage_) isUpstreamMessage_Message() {}
+
 type DownstreamMessage struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
 	// Types that are valid to be assigned to Message:
@@ -159,6 +207,9 @@ type DownstreamMessage struct {
 	//	*DownstreamMessage_AckMessage_
 	//	*DownstreamMessage_DataMessage_
 	//	*DownstreamMessage_SystemMessage_
+	//	*DownstreamMessage_InvokeResponseMessage_
+	//	*DownstreamMessage_InvokeMessage_
+	//	*DownstreamMessage_CancelInvocationMessage_
 	Message       isDownstreamMessage_Message `protobuf_oneof:"message"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -228,6 +279,33 @@ func (x *DownstreamMessage) GetSystemMessage() *DownstreamMessage_SystemMessage
 	return nil
 }
 
+func (x *DownstreamMessage) GetInvokeResponseMessage() *DownstreamMessage_InvokeResponseMessage {
+	if x != nil {
+		if x, ok := x.Message.(*DownstreamMessage_InvokeResponseMessage_); ok {
+			return x.InvokeResponseMessage
+		}
+	}
+	return nil
+}
+
+func (x *DownstreamMessage) GetInvokeMessage() *DownstreamMessage_InvokeMessage {
+	if x != nil {
+		if x, ok := x.Message.(*DownstreamMessage_InvokeMessage_); ok {
+			return x.InvokeMessage
+		}
+	}
+	return nil
+}
+
+func (x *DownstreamMessage) GetCancelInvocationMessage() *DownstreamMessage_CancelInvocationMessage {
+	if x != nil {
+		if x, ok := x.Message.(*DownstreamMessage_CancelInvocationMessage_); ok {
+			return x.CancelInvocationMessage
+		}
+	}
+	return nil
+}
+
 type isDownstreamMessage_Message interface {
 	isDownstreamMessage_Message()
 }
@@ -244,12 +322,30 @@ type DownstreamMessage_SystemMessage_ struct {
 	SystemMessage *DownstreamMessage_SystemMessage `protobuf:"bytes,3,opt,name=system_message,json=systemMessage,proto3,oneof"`
 }
 
+type DownstreamMessage_InvokeResponseMessage_ struct {
+	InvokeResponseMessage *DownstreamMessage_InvokeResponseMessage `protobuf:"bytes,4,opt,name=invoke_response_message,json=invokeResponseMessage,proto3,oneof"`
+}
+
+type DownstreamMessage_InvokeMessage_ struct {
+	InvokeMessage *DownstreamMessage_InvokeMessage `protobuf:"bytes,5,opt,name=invoke_message,json=invokeMessage,proto3,oneof"`
+}
+
+type DownstreamMessage_CancelInvocationMessage_ struct {
+	CancelInvocationMessage *DownstreamMessage_CancelInvocationMessage `protobuf:"bytes,6,opt,name=cancel_invocation_message,json=cancelInvocationMessage,proto3,oneof"`
+}
+
 func (*DownstreamMessage_AckMessage_) isDownstreamMessage_Message() {}
 
 func (*DownstreamMessage_DataMessage_) isDownstreamMessage_Message() {}
 
 func (*DownstreamMessage_SystemMessage_) isDownstreamMessage_Message() {}
 
+func (*DownstreamMessage_InvokeResponseMessage_) isDownstreamMessage_Message() {}
+
+func (*DownstreamMessage_InvokeMessage_) isDownstreamMessage_Message() {}
+
+func (*DownstreamMessage_CancelInvocationMessage_) isDownstreamMessage_Message() {}
+
 type MessageData struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
 	// Types that are valid to be assigned to Data:
@@ -493,11 +589,13 @@ func (x *UpstreamMessage_EventMessage) GetAckId() int64 {
 }
 
 type UpstreamMessage_JoinGroupMessage struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Group         string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
-	AckId         *int64                 `protobuf:"varint,2,opt,name=ack_id,json=ackId,proto3,oneof" json:"ack_id,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state                  protoimpl.MessageState `protogen:"open.v1"`
+	Group                  string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
+	AckId                  *int64                 `protobuf:"varint,2,opt,name=ack_id,json=ackId,proto3,oneof" json:"ack_id,omitempty"`
+	HistoryAfterSequenceId *int64                 `protobuf:"varint,3,opt,name=history_after_sequence_id,json=historyAfterSequenceId,proto3,oneof" json:"history_after_sequence_id,omitempty"`
+	HistorySince           *int64                 `protobuf:"varint,4,opt,name=history_since,json=historySince,proto3,oneof" json:"history_since,omitempty"`
+	unknownFields          protoimpl.UnknownFields
+	sizeCache              protoimpl.SizeCache
 }
 
 func (x *UpstreamMessage_JoinGroupMessage) Reset() {
@@ -544,6 +642,20 @@ func (x *UpstreamMessage_JoinGroupMessage) GetAckId() int64 {
 	return 0
 }
 
+func (x *UpstreamMessage_JoinGroupMessage) GetHistoryAfterSequenceId() int64 {
+	if x != nil && x.HistoryAfterSequenceId != nil {
+		return *x.HistoryAfterSequenceId
+	}
+	return 0
+}
+
+func (x *UpstreamMessage_JoinGroupMessage) GetHistorySince() int64 {
+	if x != nil && x.HistorySince != nil {
+		return *x.HistorySince
+	}
+	return 0
+}
+
 type UpstreamMessage_LeaveGroupMessage struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Group         string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
@@ -640,6 +752,186 @@ func (x *UpstreamMessage_SequenceAckMessage) GetSequenceId() int64 {
 	return 0
 }
 
+type UpstreamMessage_InvokeMessage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	InvocationId  string                 `protobuf:"bytes,1,opt,name=invocation_id,json=invocationId,proto3" json:"invocation_id,omitempty"`
+	Target        string                 `protobuf:"bytes,2,opt,name=target,proto3" json:"target,omitempty"`
+	Data          *MessageData           `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpstreamMessage_InvokeMessage) Reset() {
+	*x = UpstreamMessage_InvokeMessage{}
+	mi := &file_webpubsub_client_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpstreamMessage_InvokeMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpstreamMessage_InvokeMessage) ProtoMessage() {}
+
+func (x *UpstreamMessage_InvokeMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_webpubsub_client_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpstreamMessage_InvokeMessage.ProtoReflect.Descriptor instead.
+func (*UpstreamMessage_InvokeMessage) Descriptor() ([]byte, []int) {
+	return file_webpubsub_client_proto_rawDescGZIP(), []int{0, 5}
+}
+
+func (x *UpstreamMessage_InvokeMessage) GetInvocationId() string {
+	if x != nil {
+		return x.InvocationId
+	}
+	return ""
+}
+
+func (x *UpstreamMessage_InvokeMessage) GetTarget() string {
+	if x != nil {
+		return x.Target
+	}
+	return ""
+}
+
+func (x *UpstreamMessage_InvokeMessage) GetData() *MessageData {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type UpstreamMessage_CancelInvocationMessage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	InvocationId  string                 `protobuf:"bytes,1,opt,name=invocation_id,json=invocationId,proto3" json:"invocation_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpstreamMessage_CancelInvocationMessage) Reset() {
+	*x = UpstreamMessage_CancelInvocationMessage{}
+	mi := &file_webpubsub_client_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpstreamMessage_CancelInvocationMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpstreamMessage_CancelInvocationMessage) ProtoMessage() {}
+
+func (x *UpstreamMessage_CancelInvocationMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_webpubsub_client_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpstreamMessage_CancelInvocationMessage.ProtoReflect.Descriptor instead.
+func (*UpstreamMessage_CancelInvocationMessage) Descriptor() ([]byte, []int) {
+	return file_webpubsub_client_proto_rawDescGZIP(), []int{0, 6}
+}
+
+func (x *UpstreamMessage_CancelInvocationMessage) GetInvocationId() string {
+	if x != nil {
+		return x.InvocationId
+	}
+	return ""
+}
+
+type UpstreamMessage_InvokeResponseMessage struct {
+	state         protoimpl.MessageState                     `protogen:"open.v1"`
+	InvocationId  string                                     `protobuf:"bytes,1,opt,name=invocation_id,json=invocationId,proto3" json:"invocation_id,omitempty"`
+	Success       bool                                       `protobuf:"varint,2,opt,name=success,proto3" json:"success,omitempty"`
+	Data          *MessageData                               `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	Error         *DownstreamMessage_AckMessage_ErrorMessage `protobuf:"bytes,4,opt,name=error,proto3,oneof" json:"error,omitempty"`
+	AckId         *int64                                     `protobuf:"varint,5,opt,name=ack_id,json=ackId,proto3,oneof" json:"ack_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpstreamMessage_InvokeResponseMessage) Reset() {
+	*x = UpstreamMessage_InvokeResponseMessage{}
+	mi := &file_webpubsub_client_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpstreamMessage_InvokeResponseMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpstreamMessage_InvokeResponseMessage) ProtoMessage() {}
+
+func (x *UpstreamMessage_InvokeResponseMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_webpubsub_client_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpstreamMessage_InvokeResponseMessage.ProtoReflect.Descriptor instead.
+func (*UpstreamMessage_InvokeResponseMessage) Descriptor() ([]byte, []int) {
+	return file_webpubsub_client_proto_rawDescGZIP(), []int{0, 7}
+}
+
+func (x *UpstreamMessage_InvokeResponseMessage) GetInvocationId() string {
+	if x != nil {
+		return x.InvocationId
+	}
+	return ""
+}
+
+func (x *UpstreamMessage_InvokeResponseMessage) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *UpstreamMessage_InvokeResponseMessage) GetData() *MessageData {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *UpstreamMessage_InvokeResponseMessage) GetError() *DownstreamMessage_AckMessage_ErrorMessage {
+	if x != nil {
+		return x.Error
+	}
+	return nil
+}
+
+func (x *UpstreamMessage_InvokeResponseMessage) GetAckId() int64 {
+	if x != nil && x.AckId != nil {
+		return *x.AckId
+	}
+	return 0
+}
+
 type DownstreamMessage_AckMessage struct {
 	state         protoimpl.MessageState                     `protogen:"open.v1"`
 	AckId         int64                                      `protobuf:"varint,1,opt,name=ack_id,json=ackId,proto3" json:"ack_id,omitempty"`
@@ -651,7 +943,7 @@ type DownstreamMessage_AckMessage struct {
 
 func (x *DownstreamMessage_AckMessage) Reset() {
 	*x = DownstreamMessage_AckMessage{}
-	mi := &file_webpubsub_client_proto_msgTypes[8]
+	mi := &file_webpubsub_client_proto_msgTypes[11]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -663,7 +955,7 @@ func (x *DownstreamMessage_AckMessage) String() string {
 func (*DownstreamMessage_AckMessage) ProtoMessage() {}
 
 func (x *DownstreamMessage_AckMessage) ProtoReflect() protoreflect.Message {
-	mi := &file_webpubsub_client_proto_msgTypes[8]
+	mi := &file_webpubsub_client_proto_msgTypes[11]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -701,18 +993,21 @@ func (x *DownstreamMessage_AckMessage) GetError() *DownstreamMessage_AckMessage_
 }
 
 type DownstreamMessage_DataMessage struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	From          string                 `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"`
-	Group         *string                `protobuf:"bytes,2,opt,name=group,proto3,oneof" json:"group,omitempty"`
-	Data          *MessageData           `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
-	SequenceId    *int64                 `protobuf:"varint,4,opt,name=sequence_id,json=sequenceId,proto3,oneof" json:"sequence_id,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	From            string                 `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"`
+	Group           *string                `protobuf:"bytes,2,opt,name=group,proto3,oneof" json:"group,omitempty"`
+	Data            *MessageData           `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	SequenceId      *int64                 `protobuf:"varint,4,opt,name=sequence_id,json=sequenceId,proto3,oneof" json:"sequence_id,omitempty"`
+	GroupSequenceId *int64                 `protobuf:"varint,5,opt,name=group_sequence_id,json=groupSequenceId,proto3,oneof" json:"group_sequence_id,omitempty"`
+	Timestamp       *int64                 `protobuf:"varint,6,opt,name=timestamp,proto3,oneof" json:"timestamp,omitempty"`
+	History         bool                   `protobuf:"varint,7,opt,name=history,proto3" json:"history,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
 }
 
 func (x *DownstreamMessage_DataMessage) Reset() {
 	*x = DownstreamMessage_DataMessage{}
-	mi := &file_webpubsub_client_proto_msgTypes[9]
+	mi := &file_webpubsub_client_proto_msgTypes[12]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -724,7 +1019,7 @@ func (x *DownstreamMessage_DataMessage) String() string {
 func (*DownstreamMessage_DataMessage) ProtoMessage() {}
 
 func (x *DownstreamMessage_DataMessage) ProtoReflect() protoreflect.Message {
-	mi := &file_webpubsub_client_proto_msgTypes[9]
+	mi := &file_webpubsub_client_proto_msgTypes[12]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -768,12 +1063,34 @@ func (x *DownstreamMessage_DataMessage) GetSequenceId() int64 {
 	return 0
 }
 
+func (x *DownstreamMessage_DataMessage) GetGroupSequenceId() int64 {
+	if x != nil && x.GroupSequenceId != nil {
+		return *x.GroupSequenceId
+	}
+	return 0
+}
+
+func (x *DownstreamMessage_DataMessage) GetTimestamp() int64 {
+	if x != nil && x.Timestamp != nil {
+		return *x.Timestamp
+	}
+	return 0
+}
+
+func (x *DownstreamMessage_DataMessage) GetHistory() bool {
+	if x != nil {
+		return x.History
+	}
+	return false
+}
+
 type DownstreamMessage_SystemMessage struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
 	// Types that are valid to be assigned to Message:
 	//
 	//	*DownstreamMessage_SystemMessage_ConnectedMessage_
 	//	*DownstreamMessage_SystemMessage_DisconnectedMessage_
+	//	*DownstreamMessage_SystemMessage_PresenceMessage_
 	Message       isDownstreamMessage_SystemMessage_Message `protobuf_oneof:"message"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -781,7 +1098,7 @@ type DownstreamMessage_SystemMessage struct {
 
 func (x *DownstreamMessage_SystemMessage) Reset() {
 	*x = DownstreamMessage_SystemMessage{}
-	mi := &file_webpubsub_client_proto_msgTypes[10]
+	mi := &file_webpubsub_client_proto_msgTypes[13]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -793,7 +1110,7 @@ func (x *DownstreamMessage_SystemMessage) String() string {
 func (*DownstreamMessage_SystemMessage) ProtoMessage() {}
 
 func (x *DownstreamMessage_SystemMessage) ProtoReflect() protoreflect.Message {
-	mi := &file_webpubsub_client_proto_msgTypes[10]
+	mi := &file_webpubsub_client_proto_msgTypes[13]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -834,6 +1151,15 @@ func (x *DownstreamMessage_SystemMessage) GetDisconnectedMessage() *DownstreamMe
 	return nil
 }
 
+func (x *DownstreamMessage_SystemMessage) GetPresenceMessage() *DownstreamMessage_SystemMessage_PresenceMessage {
+	if x != nil {
+		if x, ok := x.Message.(*DownstreamMessage_SystemMessage_PresenceMessage_); ok {
+			return x.PresenceMessage
+		}
+	}
+	return nil
+}
+
 type isDownstreamMessage_SystemMessage_Message interface {
 	isDownstreamMessage_SystemMessage_Message()
 }
@@ -846,12 +1172,199 @@ type DownstreamMessage_SystemMessage_DisconnectedMessage_ struct {
 	DisconnectedMessage *DownstreamMessage_SystemMessage_DisconnectedMessage `protobuf:"bytes,2,opt,name=disconnected_message,json=disconnectedMessage,proto3,oneof"`
 }
 
+type DownstreamMessage_SystemMessage_PresenceMessage_ struct {
+	PresenceMessage *DownstreamMessage_SystemMessage_PresenceMessage `protobuf:"bytes,3,opt,name=presence_message,json=presenceMessage,proto3,oneof"`
+}
+
 func (*DownstreamMessage_SystemMessage_ConnectedMessage_) isDownstreamMessage_SystemMessage_Message() {
 }
 
 func (*DownstreamMessage_SystemMessage_DisconnectedMessage_) isDownstreamMessage_SystemMessage_Message() {
 }
 
+func (*DownstreamMessage_SystemMessage_PresenceMessage_) isDownstreamMessage_SystemMessage_Message() {
+}
+
+type DownstreamMessage_InvokeResponseMessage struct {
+	state         protoimpl.MessageState                     `protogen:"open.v1"`
+	InvocationId  string                                     `protobuf:"bytes,1,opt,name=invocation_id,json=invocationId,proto3" json:"invocation_id,omitempty"`
+	Success       bool                                       `protobuf:"varint,2,opt,name=success,proto3" json:"success,omitempty"`
+	Data          *MessageData                               `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	Error         *DownstreamMessage_AckMessage_ErrorMessage `protobuf:"bytes,4,opt,name=error,proto3,oneof" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DownstreamMessage_InvokeResponseMessage) Reset() {
+	*x = DownstreamMessage_InvokeResponseMessage{}
+	mi := &file_webpubsub_client_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DownstreamMessage_InvokeResponseMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DownstreamMessage_InvokeResponseMessage) ProtoMessage() {}
+
+func (x *DownstreamMessage_InvokeResponseMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_webpubsub_client_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DownstreamMessage_InvokeResponseMessage.ProtoReflect.Descriptor instead.
+func (*DownstreamMessage_InvokeResponseMessage) Descriptor() ([]byte, []int) {
+	return file_webpubsub_client_proto_rawDescGZIP(), []int{1, 3}
+}
+
+func (x *DownstreamMessage_InvokeResponseMessage) GetInvocationId() string {
+	if x != nil {
+		return x.InvocationId
+	}
+	return ""
+}
+
+func (x *DownstreamMessage_InvokeResponseMessage) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *DownstreamMessage_InvokeResponseMessage) GetData() *MessageData {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *DownstreamMessage_InvokeResponseMessage) GetError() *DownstreamMessage_AckMessage_ErrorMessage {
+	if x != nil {
+		return x.Error
+	}
+	return nil
+}
+
+type DownstreamMessage_InvokeMessage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	InvocationId  string                 `protobuf:"bytes,1,opt,name=invocation_id,json=invocationId,proto3" json:"invocation_id,omitempty"`
+	Target        string                 `protobuf:"bytes,2,opt,name=target,proto3" json:"target,omitempty"`
+	Data          *MessageData           `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	SequenceId    *int64                 `protobuf:"varint,4,opt,name=sequence_id,json=sequenceId,proto3,oneof" json:"sequence_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DownstreamMessage_InvokeMessage) Reset() {
+	*x = DownstreamMessage_InvokeMessage{}
+	mi := &file_webpubsub_client_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DownstreamMessage_InvokeMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DownstreamMessage_InvokeMessage) ProtoMessage() {}
+
+func (x *DownstreamMessage_InvokeMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_webpubsub_client_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DownstreamMessage_InvokeMessage.ProtoReflect.Descriptor instead.
+func (*DownstreamMessage_InvokeMessage) Descriptor() ([]byte, []int) {
+	return file_webpubsub_client_proto_rawDescGZIP(), []int{1, 4}
+}
+
+func (x *DownstreamMessage_InvokeMessage) GetInvocationId() string {
+	if x != nil {
+		return x.InvocationId
+	}
+	return ""
+}
+
+func (x *DownstreamMessage_InvokeMessage) GetTarget() string {
+	if x != nil {
+		return x.Target
+	}
+	return ""
+}
+
+func (x *DownstreamMessage_InvokeMessage) GetData() *MessageData {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *DownstreamMessage_InvokeMessage) GetSequenceId() int64 {
+	if x != nil && x.SequenceId != nil {
+		return *x.SequenceId
+	}
+	return 0
+}
+
+type DownstreamMessage_CancelInvocationMessage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	InvocationId  string                 `protobuf:"bytes,1,opt,name=invocation_id,json=invocationId,proto3" json:"invocation_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DownstreamMessage_CancelInvocationMessage) Reset() {
+	*x = DownstreamMessage_CancelInvocationMessage{}
+	mi := &file_webpubsub_client_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DownstreamMessage_CancelInvocationMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DownstreamMessage_CancelInvocationMessage) ProtoMessage() {}
+
+func (x *DownstreamMessage_CancelInvocationMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_webpubsub_client_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DownstreamMessage_CancelInvocationMessage.ProtoReflect.Descriptor instead.
+func (*DownstreamMessage_CancelInvocationMessage) Descriptor() ([]byte, []int) {
+	return file_webpubsub_client_proto_rawDescGZIP(), []int{1, 5}
+}
+
+func (x *DownstreamMessage_CancelInvocationMessage) GetInvocationId() string {
+	if x != nil {
+		return x.InvocationId
+	}
+	return ""
+}
+
 type DownstreamMessage_AckMessage_ErrorMessage struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
@@ -862,7 +1375,7 @@ type DownstreamMessage_AckMessage_ErrorMessage struct {
 
 func (x *DownstreamMessage_AckMessage_ErrorMessage) Reset() {
 	*x = DownstreamMessage_AckMessage_ErrorMessage{}
-	mi := &file_webpubsub_client_proto_msgTypes[11]
+	mi := &file_webpubsub_client_proto_msgTypes[17]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -874,7 +1387,7 @@ func (x *DownstreamMessage_AckMessage_ErrorMessage) String() string {
 func (*DownstreamMessage_AckMessage_ErrorMessage) ProtoMessage() {}
 
 func (x *DownstreamMessage_AckMessage_ErrorMessage) ProtoReflect() protoreflect.Message {
-	mi := &file_webpubsub_client_proto_msgTypes[11]
+	mi := &file_webpubsub_client_proto_msgTypes[17]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -915,7 +1428,7 @@ type DownstreamMessage_SystemMessage_ConnectedMessage struct {
 
 func (x *DownstreamMessage_SystemMessage_ConnectedMessage) Reset() {
 	*x = DownstreamMessage_SystemMessage_ConnectedMessage{}
-	mi := &file_webpubsub_client_proto_msgTypes[12]
+	mi := &file_webpubsub_client_proto_msgTypes[18]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -927,7 +1440,7 @@ func (x *DownstreamMessage_SystemMessage_ConnectedMessage) String() string {
 func (*DownstreamMessage_SystemMessage_ConnectedMessage) ProtoMessage() {}
 
 func (x *DownstreamMessage_SystemMessage_ConnectedMessage) ProtoReflect() protoreflect.Message {
-	mi := &file_webpubsub_client_proto_msgTypes[12]
+	mi := &file_webpubsub_client_proto_msgTypes[18]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -973,7 +1486,7 @@ type DownstreamMessage_SystemMessage_DisconnectedMessage struct {
 
 func (x *DownstreamMessage_SystemMessage_DisconnectedMessage) Reset() {
 	*x = DownstreamMessage_SystemMessage_DisconnectedMessage{}
-	mi := &file_webpubsub_client_proto_msgTypes[13]
+	mi := &file_webpubsub_client_proto_msgTypes[19]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -985,7 +1498,7 @@ func (x *DownstreamMessage_SystemMessage_DisconnectedMessage) String() string {
 func (*DownstreamMessage_SystemMessage_DisconnectedMessage) ProtoMessage() {}
 
 func (x *DownstreamMessage_SystemMessage_DisconnectedMessage) ProtoReflect() protoreflect.Message {
-	mi := &file_webpubsub_client_proto_msgTypes[13]
+	mi := &file_webpubsub_client_proto_msgTypes[19]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -1008,17 +1521,89 @@ func (x *DownstreamMessage_SystemMessage_DisconnectedMessage) GetReason() string
 	return ""
 }
 
+type DownstreamMessage_SystemMessage_PresenceMessage struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Group         string                 `protobuf:"bytes,1,opt,name=group,proto3" json:"group,omitempty"`
+	Event         string                 `protobuf:"bytes,2,opt,name=event,proto3" json:"event,omitempty"`
+	UserId        string                 `protobuf:"bytes,3,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`
+	ConnectionId  string                 `protobuf:"bytes,4,opt,name=connection_id,json=connectionId,proto3" json:"connection_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DownstreamMessage_SystemMessage_PresenceMessage) Reset() {
+	*x = DownstreamMessage_SystemMessage_PresenceMessage{}
+	mi := &file_webpubsub_client_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DownstreamMessage_SystemMessage_PresenceMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DownstreamMessage_SystemMessage_PresenceMessage) ProtoMessage() {}
+
+func (x *DownstreamMessage_SystemMessage_PresenceMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_webpubsub_client_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DownstreamMessage_SystemMessage_PresenceMessage.ProtoReflect.Descriptor instead.
+func (*DownstreamMessage_SystemMessage_PresenceMessage) Descriptor() ([]byte, []int) {
+	return file_webpubsub_client_proto_rawDescGZIP(), []int{1, 2, 2}
+}
+
+func (x *DownstreamMessage_SystemMessage_PresenceMessage) GetGroup() string {
+	if x != nil {
+		return x.Group
+	}
+	return ""
+}
+
+func (x *DownstreamMessage_SystemMessage_PresenceMessage) GetEvent() string {
+	if x != nil {
+		return x.Event
+	}
+	return ""
+}
+
+func (x *DownstreamMessage_SystemMessage_PresenceMessage) GetUserId() string {
+	if x != nil {
+		return x.UserId
+	}
+	return ""
+}
+
+func (x *DownstreamMessage_SystemMessage_PresenceMessage) GetConnectionId() string {
+	if x != nil {
+		return x.ConnectionId
+	}
+	return ""
+}
+
 var File_webpubsub_client_proto protoreflect.FileDescriptor
 
 const file_webpubsub_client_proto_rawDesc = "" +
 	"\n" +
-	"\x16webpubsub.client.proto\x12\x0fazure.webpubsub\x1a\x19google/protobuf/any.proto\"\x97\b\n" +
+	"\x16webpubsub.client.proto\x12\x0fazure.webpubsub\x1a\x19google/protobuf/any.proto\"\xc8\x0f\n" +
 	"\x0fUpstreamMessage\x12h\n" +
 	"\x15send_to_group_message\x18\x01 \x01(\v23.azure.webpubsub.UpstreamMessage.SendToGroupMessageH\x00R\x12sendToGroupMessage\x12T\n" +
 	"\revent_message\x18\x05 \x01(\v2-.azure.webpubsub.UpstreamMessage.EventMessageH\x00R\feventMessage\x12a\n" +
 	"\x12join_group_message\x18\x06 \x01(\v21.azure.webpubsub.UpstreamMessage.JoinGroupMessageH\x00R\x10joinGroupMessage\x12d\n" +
 	"\x13leave_group_message\x18\a \x01(\v22.azure.webpubsub.UpstreamMessage.LeaveGroupMessageH\x00R\x11leaveGroupMessage\x12g\n" +
-	"\x14sequence_ack_message\x18\b \x01(\v23.azure.webpubsub.UpstreamMessage.SequenceAckMessageH\x00R\x12sequenceAckMessage\x1a\xad\x01\n" +
+	"\x14sequence_ack_message\x18\b \x01(\v23.azure.webpubsub.UpstreamMessage.SequenceAckMessageH\x00R\x12sequenceAckMessage\x12W\n" +
+	"\x0einvoke_message\x18\t \x01(\v2..azure.webpubsub.UpstreamMessage.InvokeMessageH\x00R\rinvokeMessage\x12v\n" +
+	"\x19cancel_invocation_message\x18\n" +
+	" \x01(\v28.azure.webpubsub.UpstreamMessage.CancelInvocationMessageH\x00R\x17cancelInvocationMessage\x12p\n" +
+	"\x17invoke_response_message\x18\v \x01(\v26.azure.webpubsub.UpstreamMessage.InvokeResponseMessageH\x00R\x15invokeResponseMessage\x1a\xad\x01\n" +
 	"\x12SendToGroupMessage\x12\x14\n" +
 	"\x05group\x18\x01 \x01(\tR\x05group\x12\x1a\n" +
 	"\x06ack_id\x18\x02 \x01(\x03H\x00R\x05ackId\x88\x01\x01\x120\n" +
@@ -1031,24 +1616,45 @@ const file_webpubsub_client_proto_rawDesc = "" +
 	"\x05event\x18\x01 \x01(\tR\x05event\x120\n" +
 	"\x04data\x18\x02 \x01(\v2\x1c.azure.webpubsub.MessageDataR\x04data\x12\x1a\n" +
 	"\x06ack_id\x18\x03 \x01(\x03H\x00R\x05ackId\x88\x01\x01B\t\n" +
-	"\a_ack_id\x1aO\n" +
+	"\a_ack_id\x1a\xe9\x01\n" +
 	"\x10JoinGroupMessage\x12\x14\n" +
 	"\x05group\x18\x01 \x01(\tR\x05group\x12\x1a\n" +
-	"\x06ack_id\x18\x02 \x01(\x03H\x00R\x05ackId\x88\x01\x01B\t\n" +
-	"\a_ack_id\x1aP\n" +
+	"\x06ack_id\x18\x02 \x01(\x03H\x00R\x05ackId\x88\x01\x01\x12>\n" +
+	"\x19history_after_sequence_id\x18\x03 \x01(\x03H\x01R\x16historyAfterSequenceId\x88\x01\x01\x12(\n" +
+	"\rhistory_since\x18\x04 \x01(\x03H\x02R\fhistorySince\x88\x01\x01B\t\n" +
+	"\a_ack_idB\x1c\n" +
+	"\x1a_history_after_sequence_idB\x10\n" +
+	"\x0e_history_since\x1aP\n" +
 	"\x11LeaveGroupMessage\x12\x14\n" +
 	"\x05group\x18\x01 \x01(\tR\x05group\x12\x1a\n" +
 	"\x06ack_id\x18\x02 \x01(\x03H\x00R\x05ackId\x88\x01\x01B\t\n" +
 	"\a_ack_id\x1a5\n" +
 	"\x12SequenceAckMessage\x12\x1f\n" +
 	"\vsequence_id\x18\x01 \x01(\x03R\n" +
-	"sequenceIdB\t\n" +
-	"\amessage\"\xea\b\n" +
+	"sequenceId\x1a~\n" +
+	"\rInvokeMessage\x12#\n" +
+	"\rinvocation_id\x18\x01 \x01(\tR\finvocationId\x12\x16\n" +
+	"\x06target\x18\x02 \x01(\tR\x06target\x120\n" +
+	"\x04data\x18\x03 \x01(\v2\x1c.azure.webpubsub.MessageDataR\x04data\x1a>\n" +
+	"\x17CancelInvocationMessage\x12#\n" +
+	"\rinvocation_id\x18\x01 \x01(\tR\finvocationId\x1a\x90\x02\n" +
+	"\x15InvokeResponseMessage\x12#\n" +
+	"\rinvocation_id\x18\x01 \x01(\tR\finvocationId\x12\x18\n" +
+	"\asuccess\x18\x02 \x01(\bR\asuccess\x120\n" +
+	"\x04data\x18\x03 \x01(\v2\x1c.azure.webpubsub.MessageDataR\x04data\x12U\n" +
+	"\x05error\x18\x04 \x01(\v2:.azure.webpubsub.DownstreamMessage.AckMessage.ErrorMessageH\x00R\x05error\x88\x01\x01\x12\x1a\n" +
+	"\x06ack_id\x18\x05 \x01(\x03H\x01R\x05ackId\x88\x01\x01B\b\n" +
+	"\x06_errorB\t\n" +
+	"\a_ack_idB\t\n" +
+	"\amessage\"\x94\x12\n" +
 	"\x11DownstreamMessage\x12P\n" +
 	"\vack_message\x18\x01 \x01(\v2-.azure.webpubsub.DownstreamMessage.AckMessageH\x00R\n" +
 	"ackMessage\x12S\n" +
 	"\fdata_message\x18\x02 \x01(\v2..azure.webpubsub.DownstreamMessage.DataMessageH\x00R\vdataMessage\x12Y\n" +
-	"\x0esystem_message\x18\x03 \x01(\v20.azure.webpubsub.DownstreamMessage.SystemMessageH\x00R\rsystemMessage\x1a\xdc\x01\n" +
+	"\x0esystem_message\x18\x03 \x01(\v20.azure.webpubsub.DownstreamMessage.SystemMessageH\x00R\rsystemMessage\x12r\n" +
+	"\x17invoke_response_message\x18\x04 \x01(\v28.azure.webpubsub.DownstreamMessage.InvokeResponseMessageH\x00R\x15invokeResponseMessage\x12Y\n" +
+	"\x0einvoke_message\x18\x05 \x01(\v20.azure.webpubsub.DownstreamMessage.InvokeMessageH\x00R\rinvokeMessage\x12x\n" +
+	"\x19cancel_invocation_message\x18\x06 \x01(\v2:.azure.webpubsub.DownstreamMessage.CancelInvocationMessageH\x00R\x17cancelInvocationMessage\x1a\xdc\x01\n" +
 	"\n" +
 	"AckMessage\x12\x15\n" +
 	"\x06ack_id\x18\x01 \x01(\x03R\x05ackId\x12\x18\n" +
@@ -1057,25 +1663,52 @@ const file_webpubsub_client_proto_rawDesc = "" +
 	"\fErrorMessage\x12\x12\n" +
 	"\x04name\x18\x01 \x01(\tR\x04name\x12\x18\n" +
 	"\amessage\x18\x02 \x01(\tR\amessageB\b\n" +
-	"\x06_error\x1a\xae\x01\n" +
+	"\x06_error\x1a\xc0\x02\n" +
 	"\vDataMessage\x12\x12\n" +
 	"\x04from\x18\x01 \x01(\tR\x04from\x12\x19\n" +
 	"\x05group\x18\x02 \x01(\tH\x00R\x05group\x88\x01\x01\x120\n" +
 	"\x04data\x18\x03 \x01(\v2\x1c.azure.webpubsub.MessageDataR\x04data\x12$\n" +
 	"\vsequence_id\x18\x04 \x01(\x03H\x01R\n" +
-	"sequenceId\x88\x01\x01B\b\n" +
+	"sequenceId\x88\x01\x01\x12/\n" +
+	"\x11group_sequence_id\x18\x05 \x01(\x03H\x02R\x0fgroupSequenceId\x88\x01\x01\x12!\n" +
+	"\ttimestamp\x18\x06 \x01(\x03H\x03R\ttimestamp\x88\x01\x01\x12\x18\n" +
+	"\ahistory\x18\a \x01(\bR\ahistoryB\b\n" +
 	"\x06_groupB\x0e\n" +
-	"\f_sequence_id\x1a\xb7\x03\n" +
+	"\f_sequence_idB\x14\n" +
+	"\x12_group_sequence_idB\f\n" +
+	"\n" +
+	"_timestamp\x1a\xa3\x05\n" +
 	"\rSystemMessage\x12p\n" +
 	"\x11connected_message\x18\x01 \x01(\v2A.azure.webpubsub.DownstreamMessage.SystemMessage.ConnectedMessageH\x00R\x10connectedMessage\x12y\n" +
-	"\x14disconnected_message\x18\x02 \x01(\v2D.azure.webpubsub.DownstreamMessage.SystemMessage.DisconnectedMessageH\x00R\x13disconnectedMessage\x1a\x7f\n" +
+	"\x14disconnected_message\x18\x02 \x01(\v2D.azure.webpubsub.DownstreamMessage.SystemMessage.DisconnectedMessageH\x00R\x13disconnectedMessage\x12m\n" +
+	"\x10presence_message\x18\x03 \x01(\v2@.azure.webpubsub.DownstreamMessage.SystemMessage.PresenceMessageH\x00R\x0fpresenceMessage\x1a\x7f\n" +
 	"\x10ConnectedMessage\x12#\n" +
 	"\rconnection_id\x18\x01 \x01(\tR\fconnectionId\x12\x17\n" +
 	"\auser_id\x18\x02 \x01(\tR\x06userId\x12-\n" +
 	"\x12reconnection_token\x18\x03 \x01(\tR\x11reconnectionToken\x1a-\n" +
 	"\x13DisconnectedMessage\x12\x16\n" +
-	"\x06reason\x18\x02 \x01(\tR\x06reasonB\t\n" +
-	"\amessageB\t\n" +
+	"\x06reason\x18\x02 \x01(\tR\x06reason\x1a{\n" +
+	"\x0fPresenceMessage\x12\x14\n" +
+	"\x05group\x18\x01 \x01(\tR\x05group\x12\x14\n" +
+	"\x05event\x18\x02 \x01(\tR\x05event\x12\x17\n" +
+	"\auser_id\x18\x03 \x01(\tR\x06userId\x12#\n" +
+	"\rconnection_id\x18\x04 \x01(\tR\fconnectionIdB\t\n" +
+	"\amessage\x1a\xe9\x01\n" +
+	"\x15InvokeResponseMessage\x12#\n" +
+	"\rinvocation_id\x18\x01 \x01(\tR\finvocationId\x12\x18\n" +
+	"\asuccess\x18\x02 \x01(\bR\asuccess\x120\n" +
+	"\x04data\x18\x03 \x01(\v2\x1c.azure.webpubsub.MessageDataR\x04data\x12U\n" +
+	"\x05error\x18\x04 \x01(\v2:.azure.webpubsub.DownstreamMessage.AckMessage.ErrorMessageH\x00R\x05error\x88\x01\x01B\b\n" +
+	"\x06_error\x1a\xb4\x01\n" +
+	"\rInvokeMessage\x12#\n" +
+	"\rinvocation_id\x18\x01 \x01(\tR\finvocationId\x12\x16\n" +
+	"\x06target\x18\x02 \x01(\tR\x06target\x120\n" +
+	"\x04data\x18\x03 \x01(\v2\x1c.azure.webpubsub.MessageDataR\x04data\x12$\n" +
+	"\vsequence_id\x18\x04 \x01(\x03H\x00R\n" +
+	"sequenceId\x88\x01\x01B\x0e\n" +
+	"\f_sequence_id\x1a>\n" +
+	"\x17CancelInvocationMessage\x12#\n" +
+	"\rinvocation_id\x18\x01 \x01(\tR\finvocationIdB\t\n" +
 	"\amessage\"\xb3\x01\n" +
 	"\vMessageData\x12\x1d\n" +
 	"\ttext_data\x18\x01 \x01(\tH\x00R\btextData\x12!\n" +
@@ -1097,7 +1730,7 @@ func file_webpubsub_client_proto_rawDescGZIP() []byte {
 	return file_webpubsub_client_proto_rawDescData
 }
 
-var file_webpubsub_client_proto_msgTypes = make([]protoimpl.MessageInfo, 14)
+var file_webpubsub_client_proto_msgTypes = make([]protoimpl.MessageInfo, 21)
 var file_webpubsub_client_proto_goTypes = []any{
 	(*UpstreamMessage)(nil),                                     // 0: azure.webpubsub.UpstreamMessage
 	(*DownstreamMessage)(nil),                                   // 1: azure.webpubsub.DownstreamMessage
@@ -1107,13 +1740,20 @@ var file_webpubsub_client_proto_goTypes = []any{
 	(*UpstreamMessage_JoinGroupMessage)(nil),                    // 5: azure.webpubsub.UpstreamMessage.JoinGroupMessage
 	(*UpstreamMessage_LeaveGroupMessage)(nil),                   // 6: azure.webpubsub.UpstreamMessage.LeaveGroupMessage
 	(*UpstreamMessage_SequenceAckMessage)(nil),                  // 7: azure.webpubsub.UpstreamMessage.SequenceAckMessage
-	(*DownstreamMessage_AckMessage)(nil),                        // 8: azure.webpubsub.DownstreamMessage.AckMessage
-	(*DownstreamMessage_DataMessage)(nil),                       // 9: azure.webpubsub.DownstreamMessage.DataMessage
-	(*DownstreamMessage_SystemMessage)(nil),                     // 10: azure.webpubsub.DownstreamMessage.SystemMessage
-	(*DownstreamMessage_AckMessage_ErrorMessage)(nil),           // 11: azure.webpubsub.DownstreamMessage.AckMessage.ErrorMessage
-	(*DownstreamMessage_SystemMessage_ConnectedMessage)(nil),    // 12: azure.webpubsub.DownstreamMessage.SystemMessage.ConnectedMessage
-	(*DownstreamMessage_SystemMessage_DisconnectedMessage)(nil), // 13: azure.webpubsub.DownstreamMessage.SystemMessage.DisconnectedMessage
-	(*anypb.Any)(nil),                                           // 14: google.protobuf.Any
+	(*UpstreamMessage_InvokeMessage)(nil),                       // 8: azure.webpubsub.UpstreamMessage.InvokeMessage
+	(*UpstreamMessage_CancelInvocationMessage)(nil),             // 9: azure.webpubsub.UpstreamMessage.CancelInvocationMessage
+	(*UpstreamMessage_InvokeResponseMessage)(nil),               // 10: azure.webpubsub.UpstreamMessage.InvokeResponseMessage
+	(*DownstreamMessage_AckMessage)(nil),                        // 11: azure.webpubsub.DownstreamMessage.AckMessage
+	(*DownstreamMessage_DataMessage)(nil),                       // 12: azure.webpubsub.DownstreamMessage.DataMessage
+	(*DownstreamMessage_SystemMessage)(nil),                     // 13: azure.webpubsub.DownstreamMessage.SystemMessage
+	(*DownstreamMessage_InvokeResponseMessage)(nil),             // 14: azure.webpubsub.DownstreamMessage.InvokeResponseMessage
+	(*DownstreamMessage_InvokeMessage)(nil),                     // 15: azure.webpubsub.DownstreamMessage.InvokeMessage
+	(*DownstreamMessage_CancelInvocationMessage)(nil),           // 16: azure.webpubsub.DownstreamMessage.CancelInvocationMessage
+	(*DownstreamMessage_AckMessage_ErrorMessage)(nil),           // 17: azure.webpubsub.DownstreamMessage.AckMessage.ErrorMessage
+	(*DownstreamMessage_SystemMessage_ConnectedMessage)(nil),    // 18: azure.webpubsub.DownstreamMessage.SystemMessage.ConnectedMessage
+	(*DownstreamMessage_SystemMessage_DisconnectedMessage)(nil), // 19: azure.webpubsub.DownstreamMessage.SystemMessage.DisconnectedMessage
+	(*DownstreamMessage_SystemMessage_PresenceMessage)(nil),     // 20: azure.webpubsub.DownstreamMessage.SystemMessage.PresenceMessage
+	(*anypb.Any)(nil),                                           // 21: google.protobuf.Any
 }
 var file_webpubsub_client_proto_depIdxs = []int32{
 	3,  // 0: azure.webpubsub.UpstreamMessage.send_to_group_message:type_name -> azure.webpubsub.UpstreamMessage.SendToGroupMessage
@@ -1121,21 +1761,34 @@ var file_webpubsub_client_proto_depIdxs = []int32{
 	5,  // 2: azure.webpubsub.UpstreamMessage.join_group_message:type_name -> azure.webpubsub.UpstreamMessage.JoinGroupMessage
 	6,  // 3: azure.webpubsub.UpstreamMessage.leave_group_message:type_name -> azure.webpubsub.UpstreamMessage.LeaveGroupMessage
 	7,  // 4: azure.webpubsub.UpstreamMessage.sequence_ack_message:type_name -> azure.webpubsub.UpstreamMessage.SequenceAckMessage
-	8,  // 5: azure.webpubsub.DownstreamMessage.ack_message:type_name -> azure.webpubsub.DownstreamMessage.AckMessage
-	9,  // 6: azure.webpubsub.DownstreamMessage.data_message:type_name -> azure.webpubsub.DownstreamMessage.DataMessage
-	10, // 7: azure.webpubsub.DownstreamMessage.system_message:type_name -> azure.webpubsub.DownstreamMessage.SystemMessage
-	14, // 8: azure.webpubsub.MessageData.protobuf_data:type_name -> google.protobuf.Any
-	2,  // 9: azure.webpubsub.UpstreamMessage.SendToGroupMessage.data:type_name -> azure.webpubsub.MessageData
-	2,  // 10: azure.webpubsub.UpstreamMessage.EventMessage.data:type_name -> azure.webpubsub.MessageData
-	11, // 11: azure.webpubsub.DownstreamMessage.AckMessage.error:type_name -> azure.webpubsub.DownstreamMessage.AckMessage.ErrorMessage
-	2,  // 12: azure.webpubsub.DownstreamMessage.DataMessage.data:type_name -> azure.webpubsub.MessageData
-	12, // 13: azure.webpubsub.DownstreamMessage.SystemMessage.connected_message:type_name -> azure.webpubsub.DownstreamMessage.SystemMessage.ConnectedMessage
-	13, // 14: azure.webpubsub.DownstreamMessage.SystemMessage.disconnected_message:type_name -> azure.webpubsub.DownstreamMessage.SystemMessage.DisconnectedMessage
-	15, // [15:15] is the sub-list for method output_type
-	15, // [15:15] is the sub-list for method input_type
-	15, // [15:15] is the sub-list for extension type_name
-	15, // [15:15] is the sub-list for extension extendee
-	0,  // [0:15] is the sub-list for field type_name
+	8,  // 5: azure.webpubsub.UpstreamMessage.invoke_message:type_name -> azure.webpubsub.UpstreamMessage.InvokeMessage
+	9,  // 6: azure.webpubsub.UpstreamMessage.cancel_invocation_message:type_name -> azure.webpubsub.UpstreamMessage.CancelInvocationMessage
+	10, // 7: azure.webpubsub.UpstreamMessage.invoke_response_message:type_name -> azure.webpubsub.UpstreamMessage.InvokeResponseMessage
+	11, // 8: azure.webpubsub.DownstreamMessage.ack_message:type_name -> azure.webpubsub.DownstreamMessage.AckMessage
+	12, // 9: azure.webpubsub.DownstreamMessage.data_message:type_name -> azure.webpubsub.DownstreamMessage.DataMessage
+	13, // 10: azure.webpubsub.DownstreamMessage.system_message:type_name -> azure.webpubsub.DownstreamMessage.SystemMessage
+	14, // 11: azure.webpubsub.DownstreamMessage.invoke_response_message:type_name -> azure.webpubsub.DownstreamMessage.InvokeResponseMessage
+	15, // 12: azure.webpubsub.DownstreamMessage.invoke_message:type_name -> azure.webpubsub.DownstreamMessage.InvokeMessage
+	16, // 13: azure.webpubsub.DownstreamMessage.cancel_invocation_message:type_name -> azure.webpubsub.DownstreamMessage.CancelInvocationMessage
+	21, // 14: azure.webpubsub.MessageData.protobuf_data:type_name -> google.protobuf.Any
+	2,  // 15: azure.webpubsub.UpstreamMessage.SendToGroupMessage.data:type_name -> azure.webpubsub.MessageData
+	2,  // 16: azure.webpubsub.UpstreamMessage.EventMessage.data:type_name -> azure.webpubsub.MessageData
+	2,  // 17: azure.webpubsub.UpstreamMessage.InvokeMessage.data:type_name -> azure.webpubsub.MessageData
+	2,  // 18: azure.webpubsub.UpstreamMessage.InvokeResponseMessage.data:type_name -> azure.webpubsub.MessageData
+	17, // 19: azure.webpubsub.UpstreamMessage.InvokeResponseMessage.error:type_name -> azure.webpubsub.DownstreamMessage.AckMessage.ErrorMessage
+	17, // 20: azure.webpubsub.DownstreamMessage.AckMessage.error:type_name -> azure.webpubsub.DownstreamMessage.AckMessage.ErrorMessage
+	2,  // 21: azure.webpubsub.DownstreamMessage.DataMessage.data:type_name -> azure.webpubsub.MessageData
+	18, // 22: azure.webpubsub.DownstreamMessage.SystemMessage.connected_message:type_name -> azure.webpubsub.DownstreamMessage.SystemMessage.ConnectedMessage
+	19, // 23: azure.webpubsub.DownstreamMessage.SystemMessage.disconnected_message:type_name -> azure.webpubsub.DownstreamMessage.SystemMessage.DisconnectedMessage
+	20, // 24: azure.webpubsub.DownstreamMessage.SystemMessage.presence_message:type_name -> azure.webpubsub.DownstreamMessage.SystemMessage.PresenceMessage
+	2,  // 25: azure.webpubsub.DownstreamMessage.InvokeResponseMessage.data:type_name -> azure.webpubsub.MessageData
+	17, // 26: azure.webpubsub.DownstreamMessage.InvokeResponseMessage.error:type_name -> azure.webpubsub.DownstreamMessage.AckMessage.ErrorMessage
+	2,  // 27: azure.webpubsub.DownstreamMessage.InvokeMessage.data:type_name -> azure.webpubsub.MessageData
+	28, // [28:28] is the sub-list for method output_type
+	28, // [28:28] is the sub-list for method input_type
+	28, // [28:28] is the sub-list for extension type_name
+	28, // [28:28] is the sub-list for extension extendee
+	0,  // [0:28] is the sub-list for field type_name
 }
 
 func init() { file_webpubsub_client_proto_init() }
@@ -1149,11 +1802,17 @@ func file_webpubsub_client_proto_init() {
 		(*UpstreamMessage_JoinGroupMessage_)(nil),
 		(*UpstreamMessage_LeaveGroupMessage_)(nil),
 		(*UpstreamMessage_SequenceAckMessage_)(nil),
+		(*UpstreamMessage_InvokeMessage_)(nil),
+		(*UpstreamMessage_CancelInvocationMessage_)(nil),
+		(*UpstreamMessage_InvokeResponseMessage_)(nil),
 	}
 	file_webpubsub_client_proto_msgTypes[1].OneofWrappers = []any{
 		(*DownstreamMessage_AckMessage_)(nil),
 		(*DownstreamMessage_DataMessage_)(nil),
 		(*DownstreamMessage_SystemMessage_)(nil),
+		(*DownstreamMessage_InvokeResponseMessage_)(nil),
+		(*DownstreamMessage_InvokeMessage_)(nil),
+		(*DownstreamMessage_CancelInvocationMessage_)(nil),
 	}
 	file_webpubsub_client_proto_msgTypes[2].OneofWrappers = []any{
 		(*MessageData_TextData)(nil),
@@ -1165,19 +1824,23 @@ func file_webpubsub_client_proto_init() {
 	file_webpubsub_client_proto_msgTypes[4].OneofWrappers = []any{}
 	file_webpubsub_client_proto_msgTypes[5].OneofWrappers = []any{}
 	file_webpubsub_client_proto_msgTypes[6].OneofWrappers = []any{}
-	file_webpubsub_client_proto_msgTypes[8].OneofWrappers = []any{}
-	file_webpubsub_client_proto_msgTypes[9].OneofWrappers = []any{}
-	file_webpubsub_client_proto_msgTypes[10].OneofWrappers = []any{
+	file_webpubsub_client_proto_msgTypes[10].OneofWrappers = []any{}
+	file_webpubsub_client_proto_msgTypes[11].OneofWrappers = []any{}
+	file_webpubsub_client_proto_msgTypes[12].OneofWrappers = []any{}
+	file_webpubsub_client_proto_msgTypes[13].OneofWrappers = []any{
 		(*DownstreamMessage_SystemMessage_ConnectedMessage_)(nil),
 		(*DownstreamMessage_SystemMessage_DisconnectedMessage_)(nil),
+		(*DownstreamMessage_SystemMessage_PresenceMessage_)(nil),
 	}
+	file_webpubsub_client_proto_msgTypes[14].OneofWrappers = []any{}
+	file_webpubsub_client_proto_msgTypes[15].OneofWrappers = []any{}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_webpubsub_client_proto_rawDesc), len(file_webpubsub_client_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   14,
+			NumMessages:   21,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
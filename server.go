@@ -1,92 +1,345 @@
 package reliablesocket
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"reliablesocket/aesutil"
+	"reliablesocket/proto/webpubsub"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
 	cmap "github.com/orcaman/concurrent-map/v2"
 	"github.com/rs/xid"
+	"google.golang.org/protobuf/proto"
 )
 
-var hub = &Hub{
-	hubId:  "testhub",
-	groups: cmap.ConcurrentMap[string, *Group]{},
-	peers:  cmap.ConcurrentMap[string, *Peer]{},
+type Server struct {
+	// AccessKey signs client access tokens and management API tokens. When
+	// empty the management API is disabled and the access token of a client
+	// is its user id.
+	AccessKey string
+	// OnConnect, when set, authorizes every new connection before the
+	// WebSocket upgrade. It may rename the user, grant roles, add initial
+	// groups and select the subprotocol. An error rejects the connection with
+	// 401, or with the status of a *ConnectError such as 403.
+	OnConnect func(ctx context.Context, req ConnectRequest) (ConnectResponse, error)
+	// OnError is called with the errors the server works around, such as a
+	// backplane it could not publish to: they must not break live
+	// connections.
+	OnError func(err error)
+	// ShardGroups assigns every group to an owner node by consistent hashing
+	// over the nodes of the backplane. Group messages go through the owner,
+	// which records their history and sends them to the nodes with members
+	// only, instead of every node. The history of a group is then recorded
+	// by whichever node owns it, so share the HistoryStore between nodes.
+	// Group history requires it on a backplane. Set it on every node,
+	// before UseBackplane.
+	ShardGroups bool
+	// NodeTimeout is how long the other nodes of the backplane go without
+	// hearing from this one before they drop it as crashed, with its
+	// connections and, from the ring, its groups. Nodes announce themselves
+	// every third of it. Defaults to 15s; set it on every node, before
+	// UseBackplane.
+	NodeTimeout time.Duration
+	hubs        cmap.ConcurrentMap[string, *Hub]
+	mux         *http.ServeMux
+	log         *MessageLog
+	// node identifies this server on the backplane.
+	node      string
+	backplane Backplane
+	// httpServer is the server started by ListenAndServe. draining is set
+	// once Shutdown started, connections and recoveries are then refused.
+	httpServer atomic.Pointer[http.Server]
+	draining   atomic.Bool
 }
 
-func Start() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /client/", startWs)
-	mux.HandleFunc("GET /client/hubs/{hubId}", startWs)
-	http.ListenAndServe("0.0.0.0:1234", mux)
+func NewServer() *Server {
+	s := &Server{
+		hubs: cmap.New[*Hub](),
+		mux:  http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET /client/", s.startWs)
+	s.mux.HandleFunc("GET /client/hubs/{hubId}", s.startWs)
+	s.registerAPI()
+	return s
 }
 
-func startWs(w http.ResponseWriter, r *http.Request) {
-	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		Subprotocols:         []string{},
-		InsecureSkipVerify:   false,
-		OriginPatterns:       []string{},
-		CompressionMode:      0,
-		CompressionThreshold: 0,
+// Hub returns the hub hubId, creating it on first use. Applications use it
+// to listen to peer events and manage groups.
+func (s *Server) Hub(hubId string) *Hub {
+	if h, ok := s.hubs.Get(hubId); ok {
+		return h
+	}
+	created := false
+	h := s.hubs.Upsert(hubId, nil, func(exist bool, h *Hub, _ *Hub) *Hub {
+		if exist {
+			return h
+		}
+		created = true
+		h = newHub(hubId)
+		h.log.Store(s.log)
+		h.onError = s.report
+		return h
 	})
+	// Subscribing may block, so not under the lock of the map.
+	if created && s.backplane != nil {
+		if err := h.attachBackplane(s.node, s.backplane, s.ShardGroups, s.NodeTimeout); err != nil {
+			h.report(fmt.Errorf("backplane: %w", err))
+		}
+	}
+	return h
+}
 
-	if err != nil {
-		panic(err)
+// UseBackplane connects the hubs of this server to those of the other
+// servers using b, so that messages and group operations reach every node.
+// Call it before serving.
+func (s *Server) UseBackplane(b Backplane) error {
+	s.node = xid.New().String()
+	s.backplane = b
+	for _, h := range s.hubs.Items() {
+		if err := h.attachBackplane(s.node, b, s.ShardGroups, s.NodeTimeout); err != nil {
+			return err
+		}
 	}
-	hubId := r.PathValue("hubId")
-	if hubId == "" {
-		hubId = r.URL.Query().Get("hubId")
+	return nil
+}
+
+func (s *Server) report(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
 	}
-	accessToken := r.URL.Query().Get("access_token")
-	awps_connection_id := r.URL.Query().Get("awps_connection_id")
-	awps_reconnection_token := r.URL.Query().Get("awps_reconnection_token")
-	fmt.Println(accessToken, awps_connection_id, awps_reconnection_token)
-	if accessToken != "" {
-		userId, valid := GetUserId(accessToken)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s}
+	s.httpServer.Store(srv)
+	return srv.ListenAndServe()
+}
+
+var defaultServer = NewServer()
+
+func Start() {
+	defaultServer.ListenAndServe("0.0.0.0:1234")
+}
+
+func (s *Server) parseAccessToken(token string) (*TokenClaims, error) {
+	if s.AccessKey == "" {
+		userId, valid := GetUserId(token)
 		if !valid {
-			panic("accessToken not valid")
+			return nil, ErrInvalidToken
 		}
-		id := xid.New()
-		p := NewPeer(id.String(), userId, conn, hub)
-		hub.AddPeer(p)
-		p.On("died", func(arg PeerEvent) {
-			fmt.Println("remove ", p.PeerId)
-			hub.RemovePeer(p.PeerId)
-		})
+		return &TokenClaims{Subject: userId}, nil
+	}
+	return ParseToken(s.AccessKey, token)
+}
+
+// connectWs accepts a new connection. Rejections happen before the upgrade,
+// as HTTP errors.
+func (s *Server) connectWs(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	claims, err := s.parseAccessToken(r.URL.Query().Get("access_token"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	if awps_connection_id != "" && awps_reconnection_token != "" {
-		pidtext, err := aesutil.DecryptFromHex(aesutil.AES_GCM, reconnectionKey, awps_reconnection_token)
+	req := &ConnectRequest{
+		Hub:          hub.hubId,
+		ConnectionId: xid.New().String(),
+		Claims:       claims.claimMap(),
+		Query:        r.URL.Query(),
+		Headers:      r.Header,
+		Subprotocols: requestedSubprotocols(r),
+	}
+	resp := &ConnectResponse{UserId: claims.Subject, Roles: claims.Roles, Groups: claims.Groups}
+	if s.OnConnect != nil {
+		r2, err := s.OnConnect(r.Context(), *req)
 		if err != nil {
-			panic(err)
+			writeConnectError(w, err)
+			return
 		}
-		pidsp := strings.Split(string(pidtext), ":")
-		if len(pidsp) != 2 {
-			panic("token error")
+		resp.merge(&r2)
+	}
+	wh := hub.webhook.Load()
+	if wh != nil && wh.handlesSystemEvent(SystemEventConnect) {
+		r2, err := wh.connect(r.Context(), req)
+		if err != nil {
+			writeConnectError(w, err)
+			return
 		}
-		pid := pidsp[0]
-		t := pidsp[1]
-		if pid != awps_connection_id {
-			panic("pid wrong")
+		resp.merge(r2)
+	}
+	subprotocols := Subprotocols()
+	if resp.Subprotocol != "" {
+		if !slices.Contains(req.Subprotocols, resp.Subprotocol) {
+			http.Error(w, "subprotocol "+resp.Subprotocol+" was not requested", http.StatusInternalServerError)
+			return
 		}
-		tt, err := strconv.Atoi(t)
-		if err != nil {
-			panic(err)
+		subprotocols = []string{resp.Subprotocol}
+	}
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols: subprotocols,
+	})
+	if err != nil {
+		return
+	}
+	p := newPeer(req.ConnectionId, resp.UserId, resp.Roles, conn, hub)
+	hub.AddPeer(p)
+	for _, group := range resp.Groups {
+		hub.AddConnectionToGroup(group, p.PeerId)
+	}
+	watchPeer(hub, p)
+	p.start()
+	if wh := hub.webhook.Load(); wh != nil && wh.handlesSystemEvent(SystemEventConnected) {
+		go wh.connected(context.Background(), p)
+	}
+}
+
+// watchPeer removes p from hub once it dies.
+func watchPeer(hub *Hub, p *Peer) {
+	p.On("died", func(arg PeerEvent) {
+		hub.RemovePeer(p.PeerId)
+		if arg.Migrated {
+			return
+		}
+		if wh := hub.webhook.Load(); wh != nil && wh.handlesSystemEvent(SystemEventDisconnected) {
+			go wh.disconnected(context.Background(), p, arg.Reason)
 		}
-		if tt < int(time.Now().Unix()-3600*24*7) {
-			panic("token expired")
+	})
+}
+
+// UseMessageLog restores the reliable connections recorded in l, which wait
+// to be recovered with their reconnection token as if their connection had
+// just dropped, and records them in l from then on. Call it before serving.
+func (s *Server) UseMessageLog(l *MessageLog) {
+	for _, lp := range l.peers() {
+		codec, ok := CodecFor(lp.subprotocol)
+		if !ok || !codec.Reliable() {
+			continue
 		}
-		p, ok := hub.peers.Get(awps_connection_id)
-		if !ok {
-			panic("peer not exist")
+		hub := s.Hub(lp.hub)
+		p := restoredPeer(lp.connectionId, lp.userId, lp.roles, codec, hub)
+		p.sequenceId = lp.sequenceId
+		for _, rec := range lp.unacked {
+			msg := &webpubsub.DownstreamMessage{}
+			if err := proto.Unmarshal(rec.Message, msg); err != nil {
+				l.report(err)
+				continue
+			}
+			p.unacked = append(p.unacked, msg)
 		}
+		hub.AddPeer(p)
+		for group := range lp.groups {
+			hub.AddConnectionToGroup(group, p.PeerId)
+		}
+		watchPeer(hub, p)
+		p.Close()
+	}
+	s.log = l
+	for _, hub := range s.hubs.Items() {
+		hub.log.Store(l)
+	}
+}
+
+func writeConnectError(w http.ResponseWriter, err error) {
+	var ce *ConnectError
+	if errors.As(err, &ce) {
+		http.Error(w, ce.Message, ce.StatusCode)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+func requestedSubprotocols(r *http.Request) []string {
+	var subprotocols []string
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				subprotocols = append(subprotocols, p)
+			}
+		}
+	}
+	return subprotocols
+}
 
-		p.conn.Store(conn)
-		close(p.recov)
+func (s *Server) startWs(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	hubId := r.PathValue("hubId")
+	if hubId == "" {
+		hubId = r.URL.Query().Get("hub")
+	}
+	if hubId == "" {
+		hubId = r.URL.Query().Get("hubId")
+	}
+	if hubId == "" {
+		http.Error(w, "hub is required", http.StatusBadRequest)
+		return
+	}
+	hub := s.Hub(hubId)
+	awps_connection_id := r.URL.Query().Get("awps_connection_id")
+	awps_reconnection_token := r.URL.Query().Get("awps_reconnection_token")
+	if awps_connection_id == "" || awps_reconnection_token == "" {
+		s.connectWs(w, r, hub)
+		return
+	}
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols: Subprotocols(),
+	})
+	if err != nil {
+		return
+	}
+	// A failed recovery is reported with 1008 so the client stops
+	// recovering and makes a new connection instead.
+	pidtext, err := aesutil.DecryptFromHex(aesutil.AES_GCM, reconnectionKey, awps_reconnection_token)
+	if err != nil {
+		conn.Close(websocket.StatusPolicyViolation, "invalid reconnection token")
+		return
+	}
+	pidsp := strings.Split(string(pidtext), ":")
+	if len(pidsp) != 2 {
+		conn.Close(websocket.StatusPolicyViolation, "invalid reconnection token")
+		return
+	}
+	pid := pidsp[0]
+	t := pidsp[1]
+	if pid != awps_connection_id {
+		conn.Close(websocket.StatusPolicyViolation, "invalid reconnection token")
+		return
+	}
+	tt, err := strconv.Atoi(t)
+	if err != nil {
+		conn.Close(websocket.StatusPolicyViolation, "invalid reconnection token")
+		return
+	}
+	if tt < int(time.Now().Unix()-3600*24*7) {
+		conn.Close(websocket.StatusPolicyViolation, "reconnection token expired")
+		return
+	}
+	// The connection may have been served by another node.
+	p, ok := hub.peers.Get(awps_connection_id)
+	if !ok {
+		p, ok = hub.takeSession(awps_connection_id)
+	}
+	if !ok || p.status.Load() == peerStatusDied {
+		conn.Close(websocket.StatusPolicyViolation, "connection not exist")
+		return
+	}
+	if !p.reliable || !strings.EqualFold(conn.Subprotocol(), p.codec.Subprotocol()) {
+		conn.Close(websocket.StatusPolicyViolation, "connection not recoverable")
+		return
+	}
+	if !p.recover(conn) {
+		conn.Close(websocket.StatusPolicyViolation, "connection not exist")
 	}
 }
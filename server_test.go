@@ -0,0 +1,255 @@
+package reliablesocket
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"reliablesocket/proto/webpubsub"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestRecovery(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	hub := s.Hub("chat")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cl := newTestClient(t, ts, "alice")
+	connected := make(chan string, 2)
+	messages := make(chan string, 8)
+	cl.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+	cl.OnServerMessage(func(msg *ServerMessage) { messages <- msg.Data.Text })
+	cl.OnError(func(err error) { t.Errorf("client error: %v", err) })
+	if err := cl.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	id := <-connected
+
+	// Messages sent while the connection is down are replayed once the
+	// client recovers it.
+	p, _ := hub.peers.Get(id)
+	dropped := p.conn.Load().(*websocket.Conn)
+	dropped.CloseNow()
+	hub.SendToConnection(id, textData("during"))
+	for p.conn.Load().(*websocket.Conn) == dropped {
+		if ctx.Err() != nil {
+			t.Fatal("not recovered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	hub.SendToConnection(id, textData("after"))
+	for _, want := range []string{"during", "after"} {
+		select {
+		case got := <-messages:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%q not received", want)
+		}
+	}
+	select {
+	case id := <-connected:
+		t.Fatalf("connected again as %s", id)
+	case m := <-messages:
+		t.Fatalf("got %q again", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A client may recover a connection the server has not seen drop yet,
+	// again and again.
+	endpoint := "ws" + strings.TrimPrefix(ts.URL, "http") + "/client/hubs/chat?"
+	codec, _ := CodecFor(JSONReliableSubprotocol)
+	dial := func(query url.Values) *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.Dial(ctx, endpoint+query.Encode(), &websocket.DialOptions{Subprotocols: []string{JSONReliableSubprotocol}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	read := func(conn *websocket.Conn) (string, error) {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			return "", err
+		}
+		msg, err := codec.DecodeDownstream(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x := msg.GetSystemMessage().GetConnectedMessage(); x != nil {
+			return x.GetConnectionId() + " " + x.GetReconnectionToken(), nil
+		}
+		return msg.GetDataMessage().GetData().GetTextData(), nil
+	}
+	conn := dial(url.Values{"access_token": {"bob"}})
+	defer conn.CloseNow()
+	connectedMessage, err := read(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobId, token, _ := strings.Cut(connectedMessage, " ")
+	for i := 0; i < 2; i++ {
+		recovered := dial(url.Values{"awps_connection_id": {bobId}, "awps_reconnection_token": {token}})
+		defer recovered.CloseNow()
+		if _, err := read(conn); err == nil {
+			t.Fatalf("recovery %d: previous connection still open", i)
+		}
+		if err := hub.SendToConnection(bobId, textData(fmt.Sprintf("recovery %d", i))); err != nil {
+			t.Fatal(err)
+		}
+		// Nothing was acknowledged: the earlier messages are replayed first.
+		for j := 0; j <= i; j++ {
+			want := fmt.Sprintf("recovery %d", j)
+			if got, err := read(recovered); err != nil || got != want {
+				t.Fatalf("got %q, %v, want %q", got, err, want)
+			}
+		}
+		conn = recovered
+	}
+	if p, ok := hub.peers.Get(bobId); !ok || p.status.Load() != peerStatusAlive {
+		t.Fatal("peer not alive after its recoveries")
+	}
+}
+
+// waitPeer returns the only peer of hub once it is connected.
+func waitPeer(ctx context.Context, t *testing.T, hub *Hub) *Peer {
+	t.Helper()
+	for {
+		for _, p := range hub.peers.Items() {
+			return p
+		}
+		if ctx.Err() != nil {
+			t.Fatal("not connected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNonReliableSubprotocol(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	hub := s.Hub("chat")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	codec, _ := CodecFor(JSONSubprotocol)
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/client/hubs/chat?access_token=alice", &websocket.DialOptions{Subprotocols: []string{JSONSubprotocol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+	read := func() *webpubsub.DownstreamMessage {
+		t.Helper()
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := codec.DecodeDownstream(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	// No reconnection token and no sequence ids: nothing is kept for the
+	// connection.
+	connected := read().GetSystemMessage().GetConnectedMessage()
+	if connected.GetConnectionId() == "" || connected.GetReconnectionToken() != "" {
+		t.Fatalf("connected with %v", connected)
+	}
+	id := connected.GetConnectionId()
+	hub.SendToConnection(id, textData("hi"))
+	if msg := read().GetDataMessage(); msg.GetData().GetTextData() != "hi" || msg.SequenceId != nil {
+		t.Fatalf("got %v", msg)
+	}
+	p, _ := hub.peers.Get(id)
+	if len(p.unacked) != 0 {
+		t.Fatalf("%d messages kept for a non-reliable peer", len(p.unacked))
+	}
+	conn.CloseNow()
+	for hub.ConnectionExists(id) {
+		if ctx.Err() != nil {
+			t.Fatal("connection kept after it dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A Client on a non-reliable subprotocol makes a new connection instead
+	// of recovering.
+	c, err := NewClient(ClientOptions{
+		Endpoint:    "ws" + strings.TrimPrefix(ts.URL, "http"),
+		Hub:         "chat",
+		AccessToken: StaticAccessToken("bob"),
+		Subprotocol: JSONSubprotocol,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(chan string, 2)
+	c.OnConnected(func(e *ConnectedEvent) { ids <- e.ConnectionId })
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	first := <-ids
+	p, _ = hub.peers.Get(first)
+	p.conn.Load().(*websocket.Conn).CloseNow()
+	select {
+	case second := <-ids:
+		if second == first {
+			t.Fatal("connected with the same id")
+		}
+	case <-ctx.Done():
+		t.Fatal("not connected again")
+	}
+}
+
+func TestSimpleClient(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	hub := s.Hub("chat")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/client/hubs/chat?access_token=alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+	p := waitPeer(ctx, t, hub)
+	received := make(chan *webpubsub.MessageData, 2)
+	p.On("message", func(e PeerEvent) { received <- e.Data })
+
+	// Simple clients get no system messages, only the payload of data
+	// messages as raw frames.
+	hub.SendToConnection(p.PeerId, textData("text"))
+	hub.SendToConnection(p.PeerId, &webpubsub.MessageData{Data: &webpubsub.MessageData_BinaryData{BinaryData: []byte{1, 2}}})
+	for _, want := range []struct {
+		typ  websocket.MessageType
+		data string
+	}{{websocket.MessageText, "text"}, {websocket.MessageBinary, "\x01\x02"}} {
+		typ, data, err := conn.Read(ctx)
+		if err != nil || typ != want.typ || string(data) != want.data {
+			t.Fatalf("got %v %q, %v, want %v %q", typ, data, err, want.typ, want.data)
+		}
+	}
+
+	// Their frames are raw messages.
+	conn.Write(ctx, websocket.MessageText, []byte("ping"))
+	conn.Write(ctx, websocket.MessageBinary, []byte{3})
+	if d := <-received; d.GetTextData() != "ping" {
+		t.Fatalf("got %v", d)
+	}
+	if d := <-received; string(d.GetBinaryData()) != "\x03" {
+		t.Fatalf("got %v", d)
+	}
+}
@@ -0,0 +1,140 @@
+package reliablesocket
+
+import (
+	"fmt"
+	"reliablesocket/proto/webpubsub"
+	"time"
+
+	"github.com/coder/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// sessionTransferTimeout is how long a recovery on a node that does not
+// have the connection waits for another node to hand its session over.
+const sessionTransferTimeout = 5 * time.Second
+
+// SessionState is what a node needs to resume a reliable connection that
+// another node was serving.
+type SessionState struct {
+	UserId      string   `json:"userId,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Subprotocol string   `json:"subprotocol"`
+	Groups      []string `json:"groups,omitempty"`
+	// SequenceId is the last sequence id sent. Unacked holds the protobuf
+	// encoding of the sequenced messages not acknowledged yet.
+	SequenceId int64    `json:"sequenceId,omitempty"`
+	Unacked    [][]byte `json:"unacked,omitempty"`
+}
+
+// detach ends p on this node so another node can resume it, and returns its
+// session, or nil if p already died. The peer dies as migrated: it leaves
+// its groups but no disconnected event is sent.
+func (p *Peer) detach() *SessionState {
+	if !p.reliable || p.status.Swap(peerStatusDied) == peerStatusDied {
+		return nil
+	}
+	p.migrated.Store(true)
+	groups := p.groups.Keys()
+	if conn, ok := p.conn.Load().(*websocket.Conn); ok {
+		conn.CloseNow()
+	}
+	p.emit("died", PeerEvent{Reason: "connection migrated", Migrated: true})
+
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	s := &SessionState{
+		UserId:      p.UserId,
+		Roles:       p.Roles,
+		Subprotocol: p.codec.Subprotocol(),
+		Groups:      groups,
+		SequenceId:  p.sequenceId,
+	}
+	for _, msg := range p.unacked {
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			p.hub.report(fmt.Errorf("session: %w", err))
+			continue
+		}
+		s.Unacked = append(s.Unacked, data)
+	}
+	return s
+}
+
+// resumeSession sets up connectionId from a session handed over by another
+// node. Like a restored peer, it waits to be recovered.
+func (h *Hub) resumeSession(connectionId string, s *SessionState) *Peer {
+	codec, ok := CodecFor(s.Subprotocol)
+	if !ok || !codec.Reliable() {
+		return nil
+	}
+	p := restoredPeer(connectionId, s.UserId, s.Roles, codec, h)
+	p.sequenceId = s.SequenceId
+	for _, data := range s.Unacked {
+		msg := &webpubsub.DownstreamMessage{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			h.report(fmt.Errorf("session: %w", err))
+			continue
+		}
+		p.unacked = append(p.unacked, msg)
+	}
+	h.AddPeer(p)
+	if l := h.log.Load(); l != nil {
+		for _, msg := range p.unacked {
+			l.logSent(p, msg)
+		}
+	}
+	for _, group := range s.Groups {
+		h.AddConnectionToGroup(group, p.PeerId)
+	}
+	watchPeer(h, p)
+	p.Close()
+	return p
+}
+
+// takeSession asks the other nodes for the session of connectionId, whose
+// client is recovering on this node, and waits for it to be resumed here.
+func (h *Hub) takeSession(connectionId string) (*Peer, bool) {
+	if h.backplane.Load() == nil {
+		return nil, false
+	}
+	resumed := make(chan *Peer, 1)
+	if !h.transfers.SetIfAbsent(connectionId, resumed) {
+		return nil, false
+	}
+	defer h.transfers.Remove(connectionId)
+	h.publish(&BackplaneMessage{Type: bpTakeSession, ConnectionId: connectionId})
+	select {
+	case p := <-resumed:
+		return p, p != nil
+	case <-time.After(sessionTransferTimeout):
+		// A session arriving later is still resumed, and can be recovered
+		// here on the next attempt.
+		return nil, false
+	}
+}
+
+// handOverSession answers a bpTakeSession of node for a local connection.
+func (h *Hub) handOverSession(node, connectionId string) {
+	p, ok := h.peers.Get(connectionId)
+	if !ok {
+		return
+	}
+	s := p.detach()
+	if s == nil {
+		return
+	}
+	h.publish(&BackplaneMessage{Type: bpSession, Target: node, ConnectionId: connectionId, Session: s})
+}
+
+// sessionHandedOver resumes a session another node handed over. It runs on
+// the backplane goroutine, so the messages published after the hand over
+// find the connection in its groups.
+func (h *Hub) sessionHandedOver(connectionId string, s *SessionState) {
+	p := h.resumeSession(connectionId, s)
+	if resumed, ok := h.transfers.Get(connectionId); ok {
+		select {
+		case resumed <- p:
+		default:
+		}
+	}
+}
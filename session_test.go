@@ -0,0 +1,158 @@
+package reliablesocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// testCluster runs servers sharing a MemoryBackplane behind one endpoint,
+// which sends every request to the node set with route.
+type testCluster struct {
+	backplane *MemoryBackplane
+	configure []func(s *Server)
+	mu        sync.Mutex
+	servers   []*Server
+	front     *httptest.Server
+	target    atomic.Int32
+}
+
+// newTestCluster starts nodes servers, set up by configure before they join
+// the backplane.
+func newTestCluster(t *testing.T, nodes int, configure ...func(s *Server)) *testCluster {
+	c := &testCluster{backplane: NewMemoryBackplane(), configure: configure}
+	for i := 0; i < nodes; i++ {
+		c.add(t)
+	}
+	c.front = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(c.target.Load())
+		if i < 0 {
+			http.Error(w, "no node available", http.StatusServiceUnavailable)
+			return
+		}
+		c.server(i).ServeHTTP(w, r)
+	}))
+	t.Cleanup(c.front.Close)
+	return c
+}
+
+// add starts one more node and returns its index.
+func (c *testCluster) add(t *testing.T) int {
+	s := NewServer()
+	for _, configure := range c.configure {
+		configure(s)
+	}
+	if err := s.UseBackplane(c.backplane); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.servers = append(c.servers, s)
+	return len(c.servers) - 1
+}
+
+func (c *testCluster) server(i int) *Server {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.servers[i]
+}
+
+// route sends the next requests to node i, or fails them if i is negative.
+func (c *testCluster) route(i int) {
+	c.target.Store(int32(i))
+}
+
+func (c *testCluster) hub(i int) *Hub {
+	return c.server(i).Hub("chat")
+}
+
+func TestCrossNodeRecovery(t *testing.T) {
+	c := newTestCluster(t, 3)
+	alice := newTestClient(t, c.front, "alice")
+	connected := make(chan string, 2)
+	alice.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+	messages := make(chan string, 8)
+	alice.OnServerMessage(func(msg *ServerMessage) { messages <- msg.Data.Text })
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := alice.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	connectionId := <-connected
+	if err := alice.JoinGroup(ctx, "room"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the connection while no node is reachable, and queue a message
+	// on the node that served it.
+	c.route(-1)
+	p, _ := c.hub(0).peers.Get(connectionId)
+	p.conn.Load().(*websocket.Conn).CloseNow()
+	for p.status.Load() != peerStatusWaitReconnect {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.hub(0).SendToGroup("room", textData("one"))
+	c.route(1)
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-messages:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%q not delivered", want)
+		}
+	}
+	expect("one")
+	if c.hub(0).peers.Has(connectionId) {
+		t.Fatal("the first node still has the connection")
+	}
+	if members := c.hub(1).GroupMembers("room"); len(members) != 1 || members[0].PeerId != connectionId {
+		t.Fatalf("members on the second node %v", members)
+	}
+	c.hub(2).SendToGroup("room", textData("two"))
+	expect("two")
+	for !c.hub(0).remote.hasConnection(connectionId) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.hub(0).SendToConnection(connectionId, textData("three")); err != nil {
+		t.Fatal(err)
+	}
+	expect("three")
+	select {
+	case id := <-connected:
+		t.Fatalf("got a new connection %s, want %s recovered", id, connectionId)
+	default:
+	}
+}
+
+func TestResumeSessionCorruptMessage(t *testing.T) {
+	s := NewServer()
+	reported := make(chan error, 1)
+	s.OnError = func(err error) { reported <- err }
+	hub := s.Hub("chat")
+	p := hub.resumeSession("c1", &SessionState{
+		Subprotocol: ProtobufReliableSubprotocol,
+		SequenceId:  1,
+		Unacked:     [][]byte{{0xff}},
+	})
+	if p == nil {
+		t.Fatal("session not resumed")
+	}
+	if err := <-reported; !strings.HasPrefix(err.Error(), "hub chat: session: ") {
+		t.Fatalf("reported %v", err)
+	}
+	if len(p.unacked) != 0 {
+		t.Fatalf("unacked %v, want the corrupt message dropped", p.unacked)
+	}
+}
@@ -0,0 +1,237 @@
+package reliablesocket
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"reliablesocket/proto/webpubsub"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ringReplicas is how many points every node has on the hash ring, to spread
+// the groups evenly.
+const ringReplicas = 64
+
+// deliverBatch is how many connections one goroutine sends a broadcast to.
+const deliverBatch = 1024
+
+// hashRing assigns groups to the nodes of a hub by consistent hashing, so
+// that a node joining or leaving only moves the groups it takes or had.
+type hashRing struct {
+	mu     sync.RWMutex
+	nodes  map[string]bool
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+func newHashRing() *hashRing {
+	return &hashRing{nodes: map[string]bool{}}
+}
+
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// fnv alone clusters keys differing in their last bytes.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// add puts node on the ring and reports whether it was not there yet.
+func (r *hashRing) add(node string) bool {
+	r.mu.RLock()
+	ok := r.nodes[node]
+	r.mu.RUnlock()
+	if ok {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.nodes[node] {
+		return false
+	}
+	r.nodes[node] = true
+	for i := 0; i < ringReplicas; i++ {
+		r.points = append(r.points, ringPoint{hash: ringHash(node + "#" + strconv.Itoa(i)), node: node})
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		if a.hash != b.hash {
+			return cmp.Compare(a.hash, b.hash)
+		}
+		return strings.Compare(a.node, b.node)
+	})
+	return true
+}
+
+func (r *hashRing) remove(node string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.nodes[node] {
+		return false
+	}
+	delete(r.nodes, node)
+	r.points = slices.DeleteFunc(r.points, func(p ringPoint) bool { return p.node == node })
+	return true
+}
+
+// owner returns the node owning key, the first one clockwise from its hash.
+func (r *hashRing) owner(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint64) int { return cmp.Compare(p.hash, h) })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+func (r *hashRing) size() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.nodes)
+}
+
+// nodeChannel is the backplane channel of the hub hubId on node, for the
+// group messages only that node needs.
+func nodeChannel(hubId, node string) string {
+	return hubId + "@" + node
+}
+
+// groupOwner returns the node owning groupId, or "" if groups are not
+// sharded.
+func (h *Hub) groupOwner(groupId string) string {
+	b := h.backplane.Load()
+	if b == nil || b.ring == nil {
+		return ""
+	}
+	return b.ring.owner(groupId)
+}
+
+// sendGroup sends a group message from this node. With sharded groups it
+// goes through the owner of the group, which numbers it and fans it out.
+func (h *Hub) sendGroup(m *BackplaneMessage) {
+	b := h.backplane.Load()
+	if owner := h.groupOwner(m.Group); owner != "" && owner != b.node {
+		m.Forwarded = true
+		h.publishTo(owner, m)
+		return
+	}
+	h.fanOut(m)
+}
+
+// fanOut records a group message in the history of the group, if it keeps
+// one, delivers it to the local members and publishes it for the other
+// nodes: to all of them, or, with sharded groups, to those with members.
+func (h *Hub) fanOut(m *BackplaneMessage) {
+	m.Forwarded = false
+	gh, ok := h.history.Get(m.Group)
+	if !ok || m.Type != bpGroupMessage {
+		h.deliverGroup(m, nil)
+		h.publishGroup(m)
+		return
+	}
+	// Recording, queueing and publishing under gh.mu keeps the messages of
+	// the group in history order for every member, on every node, and for
+	// the connections joining. They are written once it is released.
+	gh.mu.Lock()
+	hm, err := gh.record(m.Group, m.Data)
+	if err != nil {
+		h.report(fmt.Errorf("history not recorded: %w", err))
+	} else {
+		m.SequenceId = hm.SequenceId
+		m.Timestamp = hm.Time.UnixMilli()
+	}
+	queued := h.queueGroup(m, hm)
+	h.publishGroup(m)
+	gh.mu.Unlock()
+	flushEach(queued)
+}
+
+// publishGroup publishes a group message for the other nodes: to all of
+// them, or, with sharded groups, to those with members.
+func (h *Hub) publishGroup(m *BackplaneMessage) {
+	b := h.backplane.Load()
+	if b == nil {
+		return
+	}
+	if b.ring == nil {
+		h.publish(m)
+		return
+	}
+	for _, node := range h.remote.groupNodes(m.Group) {
+		c := *m
+		h.publishTo(node, &c)
+	}
+}
+
+// deliverGroup sends a group message to the local members of its group.
+func (h *Hub) deliverGroup(m *BackplaneMessage, hm *HistoryMessage) {
+	if m.Type == bpSendToGroup {
+		h.sendToGroup(m.Group, m.Data, m.Excluded...)
+		return
+	}
+	flushEach(h.queueGroup(m, hm))
+}
+
+// queueGroup queues a bpGroupMessage for the local members of its group and
+// returns them.
+func (h *Hub) queueGroup(m *BackplaneMessage, hm *HistoryMessage) []*Peer {
+	g, ok := h.groups.Get(m.Group)
+	if !ok {
+		return nil
+	}
+	if hm == nil && m.SequenceId != 0 {
+		hm = &HistoryMessage{SequenceId: m.SequenceId, Time: time.UnixMilli(m.Timestamp), Data: m.Data}
+	}
+	return g.queue(m.ConnectionId, m.NoEcho, m.Data, hm)
+}
+
+// sendEach calls send for every peer, spreading large lists over several
+// goroutines. It returns once every peer was sent to, which keeps the
+// messages of one sender in order.
+func sendEach(peers []*Peer, send func(p *Peer)) {
+	if len(peers) <= deliverBatch {
+		for _, p := range peers {
+			send(p)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < len(peers); i += deliverBatch {
+		batch := peers[i:min(i+deliverBatch, len(peers))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, p := range batch {
+				send(p)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// sendToPeers sends data from the server to peers, except the excluded
+// connections.
+func sendToPeers(peers map[string]*Peer, data *webpubsub.MessageData, excluded []string) {
+	list := make([]*Peer, 0, len(peers))
+	for peerId, p := range peers {
+		if !slices.Contains(excluded, peerId) {
+			list = append(list, p)
+		}
+	}
+	sendEach(list, func(p *Peer) { p.sendDownStreamDataMessage("server", nil, data) })
+}
@@ -0,0 +1,290 @@
+package reliablesocket
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardedGroups(t *testing.T) {
+	c := newTestCluster(t, 3, func(s *Server) { s.ShardGroups = true })
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	eventually := func(what string, cond func() bool) {
+		t.Helper()
+		for !cond() {
+			select {
+			case <-ctx.Done():
+				t.Fatal(what)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	nodes := func() []int {
+		var live []int
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, s := range c.servers {
+			if !s.draining.Load() {
+				live = append(live, i)
+			}
+		}
+		return live
+	}
+	ringsAre := func(size int) func() bool {
+		return func() bool {
+			for _, i := range nodes() {
+				if c.hub(i).backplane.Load().ring.size() != size {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	// owners returns the index of the owner of every group, which every node
+	// must agree on.
+	var groups []string
+	for i := 0; i < 64; i++ {
+		groups = append(groups, fmt.Sprintf("g%d", i))
+	}
+	owners := func() map[string]int {
+		index := map[string]int{}
+		for _, i := range nodes() {
+			index[c.server(i).node] = i
+		}
+		owners := map[string]int{}
+		for _, g := range groups {
+			owner := c.hub(0).groupOwner(g)
+			for _, i := range nodes() {
+				if got := c.hub(i).groupOwner(g); got != owner {
+					t.Fatalf("node %d sees %s as the owner of %s, node 0 %s", i, got, g, owner)
+				}
+			}
+			owners[g] = index[owner]
+		}
+		return owners
+	}
+
+	var clients []*Client
+	var received []chan string
+	for i := 0; i < 3; i++ {
+		c.hub(i)
+		c.route(i)
+		cl := newTestClient(t, c.front, fmt.Sprintf("u%d", i))
+		messages := make(chan string, 1024)
+		cl.OnGroupMessage(func(msg *GroupMessage) { messages <- msg.Group + " " + msg.Data.Text })
+		if err := cl.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer cl.Close()
+		for _, g := range groups {
+			if err := cl.JoinGroup(ctx, g); err != nil {
+				t.Fatal(err)
+			}
+		}
+		clients = append(clients, cl)
+		received = append(received, messages)
+	}
+	eventually("nodes not on every ring", ringsAre(3))
+	spread := map[int]int{}
+	for _, owner := range owners() {
+		spread[owner]++
+	}
+	if len(spread) != 3 {
+		t.Fatalf("groups owned by %v, want spread over the 3 nodes", spread)
+	}
+	// Owners send to the nodes with members only, the first three, once
+	// they know them.
+	deliveryLists := func() bool {
+		for g, owner := range owners() {
+			want := 3
+			if owner < 3 {
+				want--
+			}
+			if len(c.hub(owner).remote.groupNodes(g)) != want {
+				return false
+			}
+		}
+		return true
+	}
+	eventually("delivery lists incomplete", deliveryLists)
+
+	// sendRound has every client send to every group, and checks every
+	// other client gets each message exactly once.
+	sendRound := func(round string) {
+		t.Helper()
+		for i, cl := range clients {
+			for _, g := range groups {
+				if err := cl.SendToGroup(ctx, g, textData(fmt.Sprintf("%s u%d", round, i)), true); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for i, messages := range received {
+			got := map[string]int{}
+			for len(got) < 2*len(groups) {
+				select {
+				case m := <-messages:
+					got[m]++
+				case <-ctx.Done():
+					t.Fatalf("u%d got %d messages of round %s, want %d", i, len(got), round, 2*len(groups))
+				}
+			}
+			for m, n := range got {
+				if n != 1 {
+					t.Fatalf("u%d got %q %d times", i, m, n)
+				}
+			}
+		}
+		select {
+		case m := <-received[0]:
+			t.Fatalf("u0 got %q once more", m)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	sendRound("first")
+
+	// A node joining takes some groups over.
+	n := c.add(t)
+	c.hub(n)
+	eventually("new node not on every ring", ringsAre(4))
+	moved := 0
+	for _, owner := range owners() {
+		if owner == n {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no group moved to the new node")
+	}
+	eventually("delivery lists of the new node incomplete", deliveryLists)
+	sendRound("second")
+
+	// And gives them back when it leaves.
+	if _, err := c.server(n).Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	eventually("node left on some ring", ringsAre(3))
+	for g, owner := range owners() {
+		if owner == n {
+			t.Fatalf("%s still owned by the node that left", g)
+		}
+	}
+	sendRound("third")
+}
+
+func TestSendEach(t *testing.T) {
+	peers := make([]*Peer, 2*deliverBatch+10)
+	for i := range peers {
+		peers[i] = &Peer{}
+	}
+	var sent atomic.Int32
+	seen := make(map[*Peer]*atomic.Int32, len(peers))
+	for _, p := range peers {
+		seen[p] = &atomic.Int32{}
+	}
+	sendEach(peers, func(p *Peer) {
+		sent.Add(1)
+		seen[p].Add(1)
+	})
+	if int(sent.Load()) != len(peers) {
+		t.Fatalf("sent %d, want %d", sent.Load(), len(peers))
+	}
+	for _, n := range seen {
+		if n.Load() != 1 {
+			t.Fatalf("sent %d times to a peer", n.Load())
+		}
+	}
+}
+
+func TestShardedGroupsNodeCrash(t *testing.T) {
+	c := newTestCluster(t, 3, func(s *Server) {
+		s.ShardGroups = true
+		s.NodeTimeout = 300 * time.Millisecond
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	eventually := func(what string, cond func() bool) {
+		t.Helper()
+		for !cond() {
+			select {
+			case <-ctx.Done():
+				t.Fatal(what)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	var ids []string
+	var received []chan string
+	for i := 0; i < 3; i++ {
+		c.hub(i)
+		c.route(i)
+		cl := newTestClient(t, c.front, fmt.Sprintf("u%d", i))
+		connected := make(chan string, 1)
+		cl.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+		messages := make(chan string, 16)
+		cl.OnServerMessage(func(msg *ServerMessage) { messages <- msg.Data.Text })
+		if err := cl.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer cl.Close()
+		ids = append(ids, <-connected)
+		received = append(received, messages)
+	}
+	eventually("nodes not on every ring", func() bool {
+		for i := 0; i < 3; i++ {
+			if c.hub(i).backplane.Load().ring.size() != 3 {
+				return false
+			}
+		}
+		return true
+	})
+	// A group owned by the node about to crash.
+	crashed := c.server(2).node
+	group := ""
+	for i := 0; group == ""; i++ {
+		if g := fmt.Sprintf("g%d", i); c.hub(0).groupOwner(g) == crashed {
+			group = g
+		}
+	}
+
+	// The node stops without leaving the backplane, and its heartbeat with it.
+	if b := c.hub(2).backplane.Swap(nil); b != nil {
+		b.unsubscribe()
+	}
+	for i := 0; i < 2; i++ {
+		eventually("crashed node still on a ring", func() bool {
+			return c.hub(i).backplane.Load().ring.size() == 2
+		})
+		eventually("connection of the crashed node still known", func() bool {
+			return !c.hub(i).remote.hasConnection(ids[2])
+		})
+	}
+	owner := c.hub(0).groupOwner(group)
+	if owner == crashed || owner != c.hub(1).groupOwner(group) {
+		t.Fatalf("%s owned by %s on node 0 and %s on node 1", group, owner, c.hub(1).groupOwner(group))
+	}
+
+	// The survivors deliver the group through its new owner.
+	for i := 0; i < 2; i++ {
+		if err := c.hub(i).AddConnectionToGroup(group, ids[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually("delivery list incomplete", func() bool {
+		return len(c.hub(0).remote.groupNodes(group)) == 1 && len(c.hub(1).remote.groupNodes(group)) == 1
+	})
+	c.hub(0).SendToGroup(group, textData("hi"))
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-received[i]:
+			if got != "hi" {
+				t.Fatalf("u%d got %q", i, got)
+			}
+		case <-ctx.Done():
+			t.Fatalf("u%d got nothing", i)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package reliablesocket
+
+import (
+	"context"
+	"reliablesocket/proto/webpubsub"
+	"sync"
+
+	"github.com/coder/websocket"
+)
+
+const shutdownReason = "server shutting down, reconnect"
+
+// ShutdownReport counts what became of the reliable sessions of a server
+// that shut down, and of its other connections.
+type ShutdownReport struct {
+	// Migrated sessions were resumed by another node of the backplane.
+	Migrated int
+	// Persisted sessions are kept in the message log, for the next server
+	// using it to restore.
+	Persisted int
+	// Lost sessions and connections cannot be recovered.
+	Lost int
+}
+
+// Shutdown drains the server. It stops accepting connections and
+// recoveries, tells every client to reconnect and closes its connection once
+// the messages being sent are written. With a backplane it then waits, until
+// ctx is done, for the clients to recover on other nodes, which take the
+// sessions over. The sessions left are kept in the message log if there is
+// one, or lost. It returns ctx.Err() if ctx was done before every session
+// migrated.
+func (s *Server) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	var report ShutdownReport
+	s.draining.Store(true)
+	if srv := s.httpServer.Load(); srv != nil {
+		// Hijacked WebSocket connections are left to us.
+		srv.Shutdown(ctx)
+	}
+
+	var sessions []*Peer
+	var wg sync.WaitGroup
+	for _, h := range s.hubs.Items() {
+		for _, p := range h.peers.Items() {
+			if p.reliable {
+				sessions = append(sessions, p)
+			} else {
+				report.Lost++
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.goAway()
+			}()
+		}
+	}
+	wg.Wait()
+
+	var err error
+	if s.backplane != nil {
+	wait:
+		for _, p := range sessions {
+			select {
+			case <-p.dead:
+			case <-ctx.Done():
+				err = ctx.Err()
+				break wait
+			}
+		}
+	}
+
+	// The sessions left must not be logged as dead.
+	for _, h := range s.hubs.Items() {
+		h.log.Store(nil)
+	}
+	for _, p := range sessions {
+		switch {
+		case p.migrated.Load():
+			report.Migrated++
+		case s.log != nil && p.stop():
+			report.Persisted++
+		case p.stop():
+			p.emit("died", PeerEvent{Reason: "server shut down"})
+			report.Lost++
+		default:
+			// Died meanwhile, e.g. closed by its client.
+			report.Lost++
+		}
+	}
+
+	for _, h := range s.hubs.Items() {
+		h.publish(&BackplaneMessage{Type: bpNodeLeft})
+		if b := h.backplane.Swap(nil); b != nil {
+			b.unsubscribe()
+		}
+	}
+	return report, err
+}
+
+// goAway tells the client of p to reconnect and closes its connection, once
+// the sequenced message being sent, if any, is written. Reliable peers then
+// wait to be recovered, on another node or after a restart.
+func (p *Peer) goAway() {
+	if !p.simple {
+		p.writeMu.Lock()
+		p.sendDownStreamSystemMessage(&webpubsub.DownstreamMessage_SystemMessage{
+			Message: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage_{DisconnectedMessage: &webpubsub.DownstreamMessage_SystemMessage_DisconnectedMessage{
+				Reason: shutdownReason,
+			}},
+		})
+		p.writeMu.Unlock()
+	}
+	if conn, ok := p.conn.Load().(*websocket.Conn); ok {
+		conn.Close(websocket.StatusGoingAway, shutdownReason)
+	}
+}
+
+// stop ends p without emitting "died", unless it already died. Its read loop
+// may not have noticed the connection closed yet.
+func (p *Peer) stop() bool {
+	return p.status.CompareAndSwap(peerStatusAlive, peerStatusDied) ||
+		p.status.CompareAndSwap(peerStatusWaitReconnect, peerStatusDied)
+}
@@ -0,0 +1,98 @@
+package reliablesocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownMigrates(t *testing.T) {
+	c := newTestCluster(t, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	var ids []string
+	messages := make(chan string, 8)
+	reasons := make(chan string, 8)
+	for _, user := range []string{"alice", "bob"} {
+		cl := newTestClient(t, c.front, user)
+		connected := make(chan string, 2)
+		cl.OnConnected(func(e *ConnectedEvent) { connected <- e.ConnectionId })
+		cl.OnDisconnected(func(e *DisconnectedEvent) { reasons <- e.Reason })
+		cl.OnServerMessage(func(msg *ServerMessage) { messages <- user + ": " + msg.Data.Text })
+		if err := cl.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer cl.Close()
+		ids = append(ids, <-connected)
+		if err := cl.JoinGroup(ctx, "room"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.route(1)
+	report, err := c.server(0).Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report != (ShutdownReport{Migrated: 2}) {
+		t.Fatalf("report %+v", report)
+	}
+	for range ids {
+		if reason := <-reasons; reason != shutdownReason {
+			t.Fatalf("disconnected with %q", reason)
+		}
+	}
+	if members := c.hub(1).GroupMembers("room"); len(members) != 2 {
+		t.Fatalf("%d members on the second node, want 2", len(members))
+	}
+	c.hub(1).SendToUser("alice", textData("still here"))
+	if got := <-messages; got != "alice: still here" {
+		t.Fatalf("got %q", got)
+	}
+
+	// The drained node refuses connections.
+	w := httptest.NewRecorder()
+	c.server(0).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/client/hubs/chat?access_token=carol", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", w.Code)
+	}
+}
+
+func TestShutdownStandalone(t *testing.T) {
+	for _, persist := range []bool{false, true} {
+		s := NewServer()
+		if persist {
+			l, err := OpenMessageLog(t.TempDir(), MessageLogOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			s.UseMessageLog(l)
+		}
+		ts := httptest.NewServer(s)
+		cl := newTestClient(t, ts, "alice")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := cl.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		report, err := s.Shutdown(ctx)
+		cl.Close()
+		ts.Close()
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ShutdownReport{Lost: 1}
+		if persist {
+			want = ShutdownReport{Persisted: 1}
+			if peers := s.log.peers(); len(peers) != 1 {
+				t.Fatalf("%d sessions in the message log, want 1", len(peers))
+			}
+		}
+		if report != want {
+			t.Fatalf("persist %v: report %+v, want %+v", persist, report, want)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package reliablesocket
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reliablesocket/proto/webpubsub"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// System events a webhook can subscribe to.
+const (
+	SystemEventConnect      = "connect"
+	SystemEventConnected    = "connected"
+	SystemEventDisconnected = "disconnected"
+)
+
+type WebhookOptions struct {
+	// URL receives the CloudEvents of the hub, in HTTP binary mode.
+	URL string
+	// UserEvents lists the user events sent upstream, "*" for all of them.
+	UserEvents []string
+	// SystemEvents lists the system events sent upstream, see SystemEventConnect.
+	SystemEvents []string
+	// AccessKey signs the connection id in the ce-signature header.
+	AccessKey  string
+	HTTPClient *http.Client
+	// Timeout bounds every attempt, 10 seconds by default.
+	Timeout time.Duration
+	// MaxRetries is how many times a failed delivery is retried, 2 by default
+	// and none when negative. Responses other than 5xx are not retried.
+	MaxRetries int
+}
+
+// Webhook posts the events of a hub to the application server, as Azure Web
+// PubSub event handlers do.
+type Webhook struct {
+	opts WebhookOptions
+}
+
+func NewWebhook(opts WebhookOptions) *Webhook {
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 2
+	}
+	return &Webhook{opts: opts}
+}
+
+func (wh *Webhook) handlesSystemEvent(event string) bool {
+	return slices.Contains(wh.opts.SystemEvents, event)
+}
+
+func (wh *Webhook) handlesUserEvent(event string) bool {
+	return slices.Contains(wh.opts.UserEvents, "*") || slices.Contains(wh.opts.UserEvents, event)
+}
+
+// cloudEvent is one upstream request.
+type cloudEvent struct {
+	typ          string
+	eventName    string
+	hub          string
+	connectionId string
+	userId       string
+	subprotocol  string
+	contentType  string
+	body         []byte
+}
+
+type webhookResponse struct {
+	statusCode  int
+	contentType string
+	body        []byte
+}
+
+// post delivers e, retrying transport errors and 5xx responses.
+func (wh *Webhook) post(ctx context.Context, e *cloudEvent) (*webhookResponse, error) {
+	id := xid.New().String()
+	delay := 500 * time.Millisecond
+	var err error
+	for attempt := 0; ; attempt++ {
+		var resp *webhookResponse
+		resp, err = wh.postOnce(ctx, id, e)
+		if err == nil && resp.statusCode < 500 {
+			return resp, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("webhook responded %d: %s", resp.statusCode, resp.body)
+		}
+		if attempt >= wh.opts.MaxRetries {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (wh *Webhook) postOnce(ctx context.Context, id string, e *cloudEvent) (*webhookResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, wh.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.opts.URL, bytes.NewReader(e.body))
+	if err != nil {
+		return nil, err
+	}
+	h := req.Header
+	h.Set("Content-Type", e.contentType)
+	h.Set("ce-specversion", "1.0")
+	h.Set("ce-type", e.typ)
+	h.Set("ce-source", "/hubs/"+e.hub+"/client/"+e.connectionId)
+	h.Set("ce-id", id)
+	h.Set("ce-time", time.Now().UTC().Format(time.RFC3339))
+	h.Set("ce-awpsversion", "1.0")
+	h.Set("ce-hub", e.hub)
+	h.Set("ce-connectionId", e.connectionId)
+	h.Set("ce-eventName", e.eventName)
+	if e.userId != "" {
+		h.Set("ce-userId", e.userId)
+	}
+	if e.subprotocol != "" {
+		h.Set("ce-subprotocol", e.subprotocol)
+	}
+	if wh.opts.AccessKey != "" {
+		mac := hmac.New(sha256.New, []byte(wh.opts.AccessKey))
+		mac.Write([]byte(e.connectionId))
+		h.Set("ce-signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := wh.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAPIBodySize))
+	if err != nil {
+		return nil, err
+	}
+	return &webhookResponse{statusCode: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: body}, nil
+}
+
+func (wh *Webhook) connect(ctx context.Context, req *ConnectRequest) (*ConnectResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := wh.post(ctx, &cloudEvent{
+		typ:          "azure.webpubsub.sys.connect",
+		eventName:    SystemEventConnect,
+		hub:          req.Hub,
+		connectionId: req.ConnectionId,
+		contentType:  "application/json",
+		body:         body,
+	})
+	if err != nil {
+		return nil, &ConnectError{StatusCode: http.StatusInternalServerError, Message: err.Error()}
+	}
+	if resp.statusCode >= 400 {
+		return nil, &ConnectError{StatusCode: resp.statusCode, Message: string(resp.body)}
+	}
+	var r ConnectResponse
+	if len(bytes.TrimSpace(resp.body)) > 0 {
+		if err := json.Unmarshal(resp.body, &r); err != nil {
+			return nil, &ConnectError{StatusCode: http.StatusInternalServerError, Message: err.Error()}
+		}
+	}
+	return &r, nil
+}
+
+func (wh *Webhook) connected(ctx context.Context, p *Peer) {
+	_, err := wh.post(ctx, &cloudEvent{
+		typ:          "azure.webpubsub.sys.connected",
+		eventName:    SystemEventConnected,
+		hub:          p.hub.hubId,
+		connectionId: p.PeerId,
+		userId:       p.UserId,
+		contentType:  "application/json",
+		body:         []byte("{}"),
+	})
+	if err != nil {
+		p.hub.report(fmt.Errorf("connected webhook: %w", err))
+	}
+}
+
+func (wh *Webhook) disconnected(ctx context.Context, p *Peer, reason string) {
+	body, _ := json.Marshal(map[string]string{"reason": reason})
+	_, err := wh.post(ctx, &cloudEvent{
+		typ:          "azure.webpubsub.sys.disconnected",
+		eventName:    SystemEventDisconnected,
+		hub:          p.hub.hubId,
+		connectionId: p.PeerId,
+		userId:       p.UserId,
+		contentType:  "application/json",
+		body:         body,
+	})
+	if err != nil {
+		p.hub.report(fmt.Errorf("disconnected webhook: %w", err))
+	}
+}
+
+// userEvent posts a user event and returns the data of the response, nil when
+// the response has no body.
+func (wh *Webhook) userEvent(ctx context.Context, p *Peer, event string, data *webpubsub.MessageData) (*webpubsub.MessageData, error) {
+	contentType, body, err := encodeWebhookData(data)
+	if err != nil {
+		return nil, err
+	}
+	var subprotocol string
+	if p.codec != nil {
+		subprotocol = p.codec.Subprotocol()
+	}
+	resp, err := wh.post(ctx, &cloudEvent{
+		typ:          "azure.webpubsub.user." + event,
+		eventName:    event,
+		hub:          p.hub.hubId,
+		connectionId: p.PeerId,
+		userId:       p.UserId,
+		subprotocol:  subprotocol,
+		contentType:  contentType,
+		body:         body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.statusCode >= 400 {
+		return nil, fmt.Errorf("webhook responded %d: %s", resp.statusCode, resp.body)
+	}
+	if resp.statusCode == http.StatusNoContent || len(resp.body) == 0 {
+		return nil, nil
+	}
+	return decodeWebhookData(resp.contentType, resp.body)
+}
+
+func encodeWebhookData(data *webpubsub.MessageData) (string, []byte, error) {
+	switch x := data.GetData().(type) {
+	case *webpubsub.MessageData_TextData:
+		return "text/plain", []byte(x.TextData), nil
+	case *webpubsub.MessageData_JsonData:
+		return "application/json", []byte(x.JsonData), nil
+	case *webpubsub.MessageData_BinaryData:
+		return "application/octet-stream", x.BinaryData, nil
+	case *webpubsub.MessageData_ProtobufData:
+		b, err := proto.Marshal(x.ProtobufData)
+		return "application/x-protobuf", b, err
+	}
+	return "application/octet-stream", nil, nil
+}
+
+func decodeWebhookData(contentType string, body []byte) (*webpubsub.MessageData, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json":
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_JsonData{JsonData: string(body)}}, nil
+	case mediaType == "application/x-protobuf":
+		var a anypb.Any
+		if err := proto.Unmarshal(body, &a); err != nil {
+			return nil, err
+		}
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_ProtobufData{ProtobufData: &a}}, nil
+	case strings.HasPrefix(mediaType, "text/"):
+		return &webpubsub.MessageData{Data: &webpubsub.MessageData_TextData{TextData: string(body)}}, nil
+	}
+	return &webpubsub.MessageData{Data: &webpubsub.MessageData_BinaryData{BinaryData: body}}, nil
+}
+
+// SetWebhook sends the events of the hub to wh, nil stops sending them.
+func (h *Hub) SetWebhook(wh *Webhook) {
+	h.webhook.Store(wh)
+}
+
+// maxPendingUserEvents bounds the user events of a peer waiting for the
+// webhook. Events past it are dropped, and nacked if they asked for an ack.
+const maxPendingUserEvents = 64
+
+type userEvent struct {
+	event string
+	ackId int64
+	data  *webpubsub.MessageData
+}
+
+// queueUserEvent handles a user event off the read loop, so a slow webhook
+// never stalls it, after the events received before it.
+func (p *Peer) queueUserEvent(event string, ackId int64, data *webpubsub.MessageData) {
+	if wh := p.hub.webhook.Load(); ackId == 0 && (wh == nil || !wh.handlesUserEvent(event)) {
+		return
+	}
+	p.userEventsOnce.Do(func() {
+		p.userEvents = make(chan userEvent, maxPendingUserEvents)
+		go p.handleUserEvents()
+	})
+	select {
+	case p.userEvents <- userEvent{event: event, ackId: ackId, data: data}:
+	default:
+		err := fmt.Errorf("%d user events pending, %s dropped", maxPendingUserEvents, event)
+		p.hub.report(fmt.Errorf("user event webhook: %w", err))
+		if ackId != 0 {
+			p.sendDownStreamAckMessage(&webpubsub.DownstreamMessage_AckMessage{
+				AckId: ackId,
+				Error: &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: "InternalServerError", Message: err.Error()},
+			})
+		}
+	}
+}
+
+// handleUserEvents runs the user events queued, until the peer died and
+// those left are handled.
+func (p *Peer) handleUserEvents() {
+	for {
+		select {
+		case e := <-p.userEvents:
+			p.handleUserEvent(e.event, e.ackId, e.data)
+		case <-p.dead:
+			for {
+				select {
+				case e := <-p.userEvents:
+					p.handleUserEvent(e.event, e.ackId, e.data)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// handleUserEvent sends the response of the webhook back to the peer.
+func (p *Peer) handleUserEvent(event string, ackId int64, data *webpubsub.MessageData) {
+	ack := &webpubsub.DownstreamMessage_AckMessage{AckId: ackId, Success: true}
+	if wh := p.hub.webhook.Load(); wh != nil && wh.handlesUserEvent(event) {
+		resp, err := wh.userEvent(context.Background(), p, event, data)
+		if err != nil {
+			p.hub.report(fmt.Errorf("user event webhook: %w", err))
+			ack.Success = false
+			ack.Error = &webpubsub.DownstreamMessage_AckMessage_ErrorMessage{Name: "InternalServerError", Message: err.Error()}
+		} else if resp != nil {
+			p.sendDownStreamDataMessage("server", nil, resp)
+		}
+	}
+	if ackId != 0 {
+		p.sendDownStreamAckMessage(ack)
+	}
+}
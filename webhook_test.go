@@ -0,0 +1,319 @@
+package reliablesocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reliablesocket/proto/webpubsub"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type upstreamEvent struct {
+	typ  string
+	body string
+}
+
+// newUpstream starts an application server that records the CloudEvents it
+// gets and answers them with handle.
+func newUpstream(t *testing.T, handle func(w http.ResponseWriter, typ string, body []byte)) (*httptest.Server, chan upstreamEvent) {
+	events := make(chan upstreamEvent, 16)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		typ := r.Header.Get("ce-type")
+		if r.Header.Get("ce-specversion") != "1.0" || r.Header.Get("ce-hub") != "chat" || r.Header.Get("ce-connectionId") == "" {
+			t.Errorf("bad CloudEvent headers %v", r.Header)
+		}
+		events <- upstreamEvent{typ: typ, body: string(body)}
+		handle(w, typ, body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, events
+}
+
+func nextEvent(t *testing.T, events chan upstreamEvent, typ string) upstreamEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.typ != typ {
+			t.Fatalf("got %s, want %s", e.typ, typ)
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s event", typ)
+	}
+	return upstreamEvent{}
+}
+
+func newWebhookServer(t *testing.T, upstream string) *httptest.Server {
+	s := NewServer()
+	s.Hub("chat").SetWebhook(NewWebhook(WebhookOptions{
+		URL:          upstream,
+		UserEvents:   []string{"*"},
+		SystemEvents: []string{SystemEventConnect, SystemEventConnected, SystemEventDisconnected},
+		MaxRetries:   -1,
+	}))
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestWebhookEvents(t *testing.T) {
+	upstream, events := newUpstream(t, func(w http.ResponseWriter, typ string, body []byte) {
+		switch typ {
+		case "azure.webpubsub.sys.connect":
+			json.NewEncoder(w).Encode(ConnectResponse{UserId: "renamed", Groups: []string{"lobby"}})
+		case "azure.webpubsub.user.echo":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(append([]byte("echo: "), body...))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	ts := newWebhookServer(t, upstream.URL)
+
+	c := newTestClient(t, ts, "alice")
+	connected := make(chan *ConnectedEvent, 1)
+	c.OnConnected(func(e *ConnectedEvent) { connected <- e })
+	received := make(chan string, 1)
+	c.OnServerMessage(func(msg *ServerMessage) { received <- msg.Data.Text })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	connect := nextEvent(t, events, "azure.webpubsub.sys.connect")
+	var req ConnectRequest
+	if err := json.Unmarshal([]byte(connect.body), &req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Claims["sub"]; len(got) != 1 || got[0] != "alice" {
+		t.Fatalf("claims %v, want sub alice", req.Claims)
+	}
+	if e := <-connected; e.UserId != "renamed" {
+		t.Fatalf("user id %q, want renamed", e.UserId)
+	}
+	nextEvent(t, events, "azure.webpubsub.sys.connected")
+
+	if err := c.SendEvent(ctx, "echo", &webpubsub.MessageData{Data: &webpubsub.MessageData_TextData{TextData: "hi"}}); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextEvent(t, events, "azure.webpubsub.user.echo"); e.body != "hi" {
+		t.Fatalf("event body %q, want hi", e.body)
+	}
+	select {
+	case got := <-received:
+		if got != "echo: hi" {
+			t.Fatalf("got %q, want the webhook response", got)
+		}
+	case <-ctx.Done():
+		t.Fatal("webhook response not delivered")
+	}
+
+	c.Close()
+	if e := nextEvent(t, events, "azure.webpubsub.sys.disconnected"); !strings.Contains(e.body, "reason") {
+		t.Fatalf("disconnected body %q", e.body)
+	}
+}
+
+func TestWebhookConnectRejected(t *testing.T) {
+	upstream, _ := newUpstream(t, func(w http.ResponseWriter, typ string, body []byte) {
+		http.Error(w, "go away", http.StatusForbidden)
+	})
+	ts := newWebhookServer(t, upstream.URL)
+
+	resp, err := http.Get(ts.URL + "/client/hubs/chat?access_token=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	wh := NewWebhook(WebhookOptions{URL: upstream.URL, MaxRetries: 1})
+	resp, err := wh.post(context.Background(), &cloudEvent{typ: "azure.webpubsub.sys.connected", hub: "chat", connectionId: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.statusCode != http.StatusNoContent || calls.Load() != 2 {
+		t.Fatalf("status %d after %d calls", resp.statusCode, calls.Load())
+	}
+
+	wh = NewWebhook(WebhookOptions{URL: upstream.URL, Timeout: 10 * time.Millisecond, MaxRetries: -1})
+	wh.opts.URL = "http://127.0.0.1:1"
+	if _, err := wh.post(context.Background(), &cloudEvent{typ: "azure.webpubsub.sys.connected"}); err == nil {
+		t.Fatal("want an error from an unreachable webhook")
+	}
+}
+
+func TestWebhookUserEventOrder(t *testing.T) {
+	const sent = 10
+	var inFlight atomic.Int32
+	upstream, events := newUpstream(t, func(w http.ResponseWriter, typ string, body []byte) {
+		if n, err := strconv.Atoi(string(body)); err == nil {
+			if inFlight.Add(1) > 1 {
+				t.Errorf("event %d sent before the previous one was answered", n)
+			}
+			defer inFlight.Add(-1)
+			// The first events are the slowest to answer.
+			time.Sleep(time.Duration(sent-n) * 5 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ts := newWebhookServer(t, upstream.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := newTestClient(t, ts, "alice")
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	nextEvent(t, events, "azure.webpubsub.sys.connect")
+	nextEvent(t, events, "azure.webpubsub.sys.connected")
+
+	// Sent without waiting for their acks.
+	for i := 0; i < sent; i++ {
+		err := c.Send(&webpubsub.UpstreamMessage{Message: &webpubsub.UpstreamMessage_EventMessage_{
+			EventMessage: &webpubsub.UpstreamMessage_EventMessage{Event: "echo", Data: textData(strconv.Itoa(i))},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < sent; i++ {
+		if e := nextEvent(t, events, "azure.webpubsub.user.echo"); e.body != strconv.Itoa(i) {
+			t.Fatalf("got event %s, want %d", e.body, i)
+		}
+	}
+}
+
+func TestWebhookErrors(t *testing.T) {
+	upstream, _ := newUpstream(t, func(w http.ResponseWriter, typ string, body []byte) {
+		if typ == "azure.webpubsub.sys.connect" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, "down", http.StatusInternalServerError)
+	})
+	s := NewServer()
+	reported := make(chan error, 4)
+	s.OnError = func(err error) { reported <- err }
+	s.Hub("chat").SetWebhook(NewWebhook(WebhookOptions{
+		URL:          upstream.URL,
+		UserEvents:   []string{"*"},
+		SystemEvents: []string{SystemEventConnect, SystemEventConnected, SystemEventDisconnected},
+		MaxRetries:   -1,
+	}))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The connected and disconnected webhooks run in the background, so
+	// the errors may come in any order.
+	c := newTestClient(t, ts, "alice")
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendEvent(ctx, "echo", textData("hi")); err == nil {
+		t.Fatal("event acked after the webhook failed")
+	}
+	c.Close()
+	want := map[string]bool{"connected webhook": true, "user event webhook": true, "disconnected webhook": true}
+	for len(want) > 0 {
+		select {
+		case err := <-reported:
+			prefix, _, _ := strings.Cut(strings.TrimPrefix(err.Error(), "hub chat: "), ":")
+			if !want[prefix] {
+				t.Fatalf("reported %v", err)
+			}
+			delete(want, prefix)
+		case <-ctx.Done():
+			t.Fatalf("%v not reported", want)
+		}
+	}
+}
+
+func TestWebhookUserEventQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	upstream, events := newUpstream(t, func(w http.ResponseWriter, typ string, body []byte) {
+		if typ == "azure.webpubsub.user.echo" {
+			<-release
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	go func() {
+		for range events {
+		}
+	}()
+	s := NewServer()
+	reported := make(chan error, maxPendingUserEvents)
+	s.OnError = func(err error) {
+		select {
+		case reported <- err:
+		default:
+		}
+	}
+	s.Hub("chat").SetWebhook(NewWebhook(WebhookOptions{URL: upstream.URL, UserEvents: []string{"echo"}, MaxRetries: -1}))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := newTestClient(t, ts, "alice")
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// One event is posted and the others wait for it, past the queue.
+	var wg sync.WaitGroup
+	var acked, nacked atomic.Int32
+	for i := 0; i < maxPendingUserEvents+2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var ackErr *AckError
+			if err := c.SendEvent(ctx, "echo", textData("hi")); err == nil {
+				acked.Add(1)
+			} else if errors.As(err, &ackErr) && ackErr.Name == "InternalServerError" {
+				nacked.Add(1)
+			} else {
+				t.Error(err)
+			}
+		}()
+	}
+	select {
+	case err := <-reported:
+		if !strings.Contains(err.Error(), "echo dropped") {
+			t.Fatalf("reported %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("dropped event not reported")
+	}
+	close(release)
+	wg.Wait()
+	if nacked.Load() == 0 || acked.Load() < maxPendingUserEvents {
+		t.Fatalf("%d events acked and %d nacked", acked.Load(), nacked.Load())
+	}
+}